@@ -0,0 +1,116 @@
+// Package capture records the raw reports written to and read from HID
+// devices to a capture file, and replays captures back as if the devices were
+// attached.  Captures are written as JSON lines, or as pcapng using the Linux
+// usbmon link type so they can be opened in Wireshark.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Direction is the direction a report travelled in
+type Direction string
+
+// the directions a report can travel in
+const (
+	Out Direction = "out"
+	In  Direction = "in"
+)
+
+// Record is a single report written to or read from a device
+type Record struct {
+	Time      time.Time `json:"time"`
+	Serial    string    `json:"serial"`
+	Product   string    `json:"product"`
+	Direction Direction `json:"dir"`
+	Data      Hex       `json:"data"`
+}
+
+// Hex is data that is encoded in JSON as a hex string
+type Hex []byte
+
+// MarshalJSON encodes the data as a hex string
+func (h Hex) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+// UnmarshalJSON decodes the data from a hex string
+func (h *Hex) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	*h = b
+	return nil
+}
+
+// Writer writes records to a capture
+type Writer interface {
+	WriteRecord(Record) error
+	Close() error
+}
+
+// Create creates a capture file at the path, using pcapng if the file has a
+// .pcapng extension and JSON lines otherwise
+func Create(path string) (Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".pcapng") {
+		return NewPcapngWriter(f), nil
+	}
+
+	return NewJSONWriter(f), nil
+}
+
+// ReadFile reads all the records in a capture file of either format
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(4)
+	if bytes.Equal(magic, pcapngMagic) {
+		return ReadPcapng(r)
+	}
+
+	return ReadJSON(r)
+}
+
+// ReadJSON reads all the records from a JSON lines capture
+func ReadJSON(r io.Reader) ([]Record, error) {
+	var records []Record
+
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, rec)
+	}
+}
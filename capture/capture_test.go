@@ -0,0 +1,133 @@
+package capture
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+func testRecords() []Record {
+	at := time.Date(2018, 3, 1, 12, 0, 0, 123456000, time.UTC)
+	return []Record{
+		{Time: at, Serial: "ASLID1", Product: "ASL IntelliDose", Direction: Out, Data: Hex{0, 'D', '0', 1}},
+		{Time: at.Add(time.Millisecond), Serial: "ASLID1", Product: "ASL IntelliDose", Direction: In, Data: Hex{'D', '0', 2, 3, 4}},
+		{Time: at.Add(2 * time.Millisecond), Serial: "ASLIC1", Product: "ASL IntelliClimate", Direction: Out, Data: Hex{0, 'D', '1'}},
+		{Time: at.Add(3 * time.Millisecond), Serial: "ASLIC1", Product: "ASL IntelliClimate", Direction: In, Data: Hex{'D', '1'}},
+	}
+}
+
+func TestFormatsRoundTrip(t *testing.T) {
+	formats := []struct {
+		name  string
+		write func(*bytes.Buffer) Writer
+		read  func(*bytes.Buffer) ([]Record, error)
+	}{
+		{"json", func(b *bytes.Buffer) Writer { return NewJSONWriter(b) }, func(b *bytes.Buffer) ([]Record, error) { return ReadJSON(b) }},
+		{"pcapng", func(b *bytes.Buffer) Writer { return NewPcapngWriter(b) }, func(b *bytes.Buffer) ([]Record, error) { return ReadPcapng(b) }},
+	}
+
+	for _, format := range formats {
+		buf := new(bytes.Buffer)
+		w := format.write(buf)
+		for _, rec := range testRecords() {
+			if err := w.WriteRecord(rec); err != nil {
+				t.Fatalf("%s: failed to write record: %s", format.name, err)
+			}
+		}
+
+		records, err := format.read(buf)
+		if err != nil {
+			t.Fatalf("%s: failed to read records: %s", format.name, err)
+		}
+
+		if len(records) != len(testRecords()) {
+			t.Fatalf("%s: expected %d records, got %d", format.name, len(testRecords()), len(records))
+		}
+
+		for i, expected := range testRecords() {
+			got := records[i]
+			if !got.Time.Equal(expected.Time) {
+				t.Errorf("%s: record %d: expected time %s, got %s", format.name, i, expected.Time, got.Time)
+			}
+			got.Time = expected.Time
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: record %d: expected %+v, got %+v", format.name, i, expected, got)
+			}
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	fake := hid.NewFakeBackend()
+	dev := fake.Plug(hid.DeviceInfo{Product: "ASL IntelliDose", SerialNumber: "ASLID1"})
+	dev.Respond([]byte("D0"), []byte("D0 first"))
+	dev.Respond([]byte("D1"), []byte("D1 answer"), []byte("D1 more"))
+
+	buf := new(bytes.Buffer)
+	recorder := NewRecordingBackend(fake, NewJSONWriter(buf))
+
+	infos, _ := recorder.Devices()
+	h, err := recorder.Open(infos[0])
+	if err != nil {
+		t.Fatalf("failed to open device: %s", err)
+	}
+
+	// the answers are read before the next request, like the devices are polled
+	exchanges := []struct {
+		request  string
+		expected []string
+	}{
+		{"\x00D0", []string{"D0 first"}},
+		{"\x00D1", []string{"D1 answer", "D1 more"}},
+	}
+
+	for _, x := range exchanges {
+		h.Write([]byte(x.request))
+		for _, e := range x.expected {
+			if got := string(<-h.ReadCh()); got != e {
+				t.Fatalf("expected %q from the recorded device, got %q", e, got)
+			}
+		}
+	}
+	h.Close()
+
+	records, err := ReadJSON(buf)
+	if err != nil {
+		t.Fatalf("failed to read capture: %s", err)
+	}
+
+	if len(records) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(records))
+	}
+
+	replay := NewReplayBackend(records)
+	infos, _ = replay.Devices()
+	if len(infos) != 1 || infos[0].SerialNumber != "ASLID1" || infos[0].Product != "ASL IntelliDose" {
+		t.Fatalf("expected the captured device, got %+v", infos)
+	}
+
+	h, err = replay.Open(infos[0])
+	if err != nil {
+		t.Fatalf("failed to open replayed device: %s", err)
+	}
+
+	// the capture is replayed out of order and wraps around
+	h.Write([]byte("\x00D1"))
+	h.Write([]byte("\x00D0"))
+	h.Write([]byte("\x00D1"))
+	for _, e := range []string{"D1 answer", "D1 more", "D0 first", "D1 answer", "D1 more"} {
+		if got := string(<-h.ReadCh()); got != e {
+			t.Fatalf("expected %q from the replayed device, got %q", e, got)
+		}
+	}
+
+	h.Write([]byte("\x00S0"))
+	select {
+	case report := <-h.ReadCh():
+		t.Errorf("expected no answer to a report that wasn't captured, got %q", report)
+	default:
+	}
+}
@@ -0,0 +1,36 @@
+package capture
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// JSONWriter writes records to a capture as JSON, one record per line
+type JSONWriter struct {
+	mutex *sync.Mutex
+	w     io.Writer
+	enc   *json.Encoder
+}
+
+// NewJSONWriter returns a writer of JSON lines records to w.  Closing the
+// writer closes w if it is an io.Closer.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{mutex: new(sync.Mutex), w: w, enc: json.NewEncoder(w)}
+}
+
+// WriteRecord writes the record as a line of JSON
+func (jw *JSONWriter) WriteRecord(rec Record) error {
+	jw.mutex.Lock()
+	defer jw.mutex.Unlock()
+
+	return jw.enc.Encode(rec)
+}
+
+// Close closes the underlying writer
+func (jw *JSONWriter) Close() error {
+	if c, ok := jw.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
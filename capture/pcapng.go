@@ -0,0 +1,314 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcapng block types
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+)
+
+// interface description options
+const (
+	optionEnd         = 0
+	optionName        = 2
+	optionDescription = 3
+)
+
+const (
+	byteOrderMagic = 0x1A2B3C4D
+
+	// linkTypeUSBLinux is the link type of packets captured by usbmon, each
+	// starting with a 48 byte header
+	linkTypeUSBLinux = 189
+	usbmonHeaderSize = 48
+
+	usbmonSubmit   = 'S'
+	usbmonComplete = 'C'
+
+	transferInterrupt = 1
+	endpointIn        = 0x80
+
+	// the status of a URB that has been submitted but hasn't completed
+	statusInProgress = -115
+
+	snapLength = 0xffff
+)
+
+var (
+	pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+	// ErrNotPcapng is returned when reading a capture that isn't a pcapng
+	// file written in little endian
+	ErrNotPcapng = errors.New("not a little endian pcapng capture")
+)
+
+// PcapngWriter writes records to a pcapng capture as usbmon packets, with an
+// interface for each device.  The devices don't use numbered reports, so the
+// report number written in front of each output report is left out of the
+// packet like it is on the wire.
+type PcapngWriter struct {
+	mutex      *sync.Mutex
+	w          io.Writer
+	started    bool
+	interfaces map[string]uint32
+	urb        uint64
+}
+
+// NewPcapngWriter returns a writer of pcapng records to w.  Closing the writer
+// closes w if it is an io.Closer.
+func NewPcapngWriter(w io.Writer) *PcapngWriter {
+	return &PcapngWriter{mutex: new(sync.Mutex), w: w, interfaces: map[string]uint32{}}
+}
+
+// WriteRecord writes the record as an enhanced packet block, first writing
+// the section header and an interface description for the device if needed
+func (pw *PcapngWriter) WriteRecord(rec Record) error {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	if !pw.started {
+		if err := pw.writeSectionHeader(); err != nil {
+			return err
+		}
+		pw.started = true
+	}
+
+	id, ok := pw.interfaces[rec.Serial]
+	if !ok {
+		id = uint32(len(pw.interfaces))
+		if err := pw.writeInterface(rec.Serial, rec.Product); err != nil {
+			return err
+		}
+		pw.interfaces[rec.Serial] = id
+	}
+
+	return pw.writePacket(id, rec)
+}
+
+// Close closes the underlying writer
+func (pw *PcapngWriter) Close() error {
+	if c, ok := pw.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (pw *PcapngWriter) writeSectionHeader() error {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1) // major version
+	binary.LittleEndian.PutUint16(body[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	return pw.writeBlock(blockSectionHeader, body)
+}
+
+func (pw *PcapngWriter) writeInterface(name, description string) error {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], linkTypeUSBLinux)
+	binary.LittleEndian.PutUint32(body[4:], snapLength)
+
+	body = appendOption(body, optionName, []byte(name))
+	body = appendOption(body, optionDescription, []byte(description))
+	body = appendOption(body, optionEnd, nil)
+	return pw.writeBlock(blockInterfaceDescription, body)
+}
+
+func (pw *PcapngWriter) writePacket(id uint32, rec Record) error {
+	data := []byte(rec.Data)
+	header := make([]byte, usbmonHeaderSize)
+
+	pw.urb++
+	binary.LittleEndian.PutUint64(header[0:], pw.urb)
+	header[9] = transferInterrupt
+	header[11] = byte(id + 1)
+	binary.LittleEndian.PutUint16(header[12:], 1)
+	header[14] = '-' // no setup packet
+
+	if rec.Direction == In {
+		header[8] = usbmonComplete
+		header[10] = endpointIn | 1
+	} else {
+		header[8] = usbmonSubmit
+		header[10] = 1
+		status := int32(statusInProgress)
+		binary.LittleEndian.PutUint32(header[28:], uint32(status))
+		if len(data) > 0 && data[0] == 0 {
+			data = data[1:]
+		}
+	}
+
+	binary.LittleEndian.PutUint64(header[16:], uint64(rec.Time.Unix()))
+	binary.LittleEndian.PutUint32(header[24:], uint32(rec.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[32:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[36:], uint32(len(data)))
+
+	packet := append(header, data...)
+	micros := uint64(rec.Time.UnixNano() / 1000)
+
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body[0:], id)
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	body = append(body, pad(packet)...)
+	return pw.writeBlock(blockEnhancedPacket, body)
+}
+
+func (pw *PcapngWriter) writeBlock(typ uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:], typ)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	block = append(block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(block[length-4:], length)
+
+	_, err := pw.w.Write(block)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	opt := make([]byte, 4)
+	binary.LittleEndian.PutUint16(opt[0:], code)
+	binary.LittleEndian.PutUint16(opt[2:], uint16(len(value)))
+	return append(append(b, opt...), pad(value)...)
+}
+
+// pad returns the data padded with zeros to a multiple of 4 bytes
+func pad(data []byte) []byte {
+	padded := make([]byte, (len(data)+3)&^3)
+	copy(padded, data)
+	return padded
+}
+
+type pcapngInterface struct {
+	linkType    uint16
+	name        string
+	description string
+}
+
+// ReadPcapng reads all the records from a pcapng capture of usbmon packets.
+// Packets without data, like the submissions of input transfers, are skipped.
+// The interface name and description are used as the serial number and
+// product of the device.
+func ReadPcapng(r io.Reader) ([]Record, error) {
+	var records []Record
+	var interfaces []pcapngInterface
+
+	first := true
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		typ := binary.LittleEndian.Uint32(head[0:])
+		length := binary.LittleEndian.Uint32(head[4:])
+		if first && typ != blockSectionHeader || length < 12 || length%4 != 0 {
+			return nil, ErrNotPcapng
+		}
+		first = false
+
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		body = body[:len(body)-4]
+
+		switch typ {
+		case blockSectionHeader:
+			if len(body) < 4 || binary.LittleEndian.Uint32(body) != byteOrderMagic {
+				return nil, ErrNotPcapng
+			}
+			interfaces = nil
+
+		case blockInterfaceDescription:
+			if len(body) < 8 {
+				return nil, ErrNotPcapng
+			}
+			iface := pcapngInterface{linkType: binary.LittleEndian.Uint16(body)}
+			readOptions(body[8:], func(code uint16, value []byte) {
+				switch code {
+				case optionName:
+					iface.name = string(value)
+				case optionDescription:
+					iface.description = string(value)
+				}
+			})
+			interfaces = append(interfaces, iface)
+
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return nil, ErrNotPcapng
+			}
+			id := binary.LittleEndian.Uint32(body[0:])
+			if int(id) >= len(interfaces) {
+				return nil, ErrNotPcapng
+			}
+
+			micros := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+			captured := binary.LittleEndian.Uint32(body[12:])
+			if int(captured) > len(body)-20 {
+				return nil, ErrNotPcapng
+			}
+
+			rec, ok := usbmonRecord(body[20 : 20+captured])
+			if !ok || interfaces[id].linkType != linkTypeUSBLinux {
+				continue
+			}
+
+			rec.Time = time.Unix(0, int64(micros)*1000)
+			rec.Serial = interfaces[id].name
+			rec.Product = interfaces[id].description
+			records = append(records, rec)
+		}
+	}
+}
+
+// usbmonRecord returns the record in a usbmon packet, putting the report
+// number back in front of output reports
+func usbmonRecord(packet []byte) (Record, bool) {
+	if len(packet) < usbmonHeaderSize {
+		return Record{}, false
+	}
+
+	data := packet[usbmonHeaderSize:]
+	if len(data) == 0 {
+		return Record{}, false
+	}
+
+	if packet[10]&endpointIn != 0 {
+		return Record{Direction: In, Data: Hex(append([]byte{}, data...))}, true
+	}
+
+	return Record{Direction: Out, Data: Hex(append([]byte{0}, data...))}, true
+}
+
+func readOptions(b []byte, fn func(code uint16, value []byte)) {
+	for len(b) >= 4 {
+		code := binary.LittleEndian.Uint16(b[0:])
+		length := int(binary.LittleEndian.Uint16(b[2:]))
+		if code == optionEnd || 4+length > len(b) {
+			return
+		}
+
+		fn(code, b[4:4+length])
+
+		next := 4 + (length+3)&^3
+		if next > len(b) {
+			return
+		}
+		b = b[next:]
+	}
+}
@@ -0,0 +1,135 @@
+package capture
+
+import (
+	"context"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+	"github.com/AutogrowSystems/go-intelli/util/tell"
+)
+
+// recordBuffer is the number of reports buffered by a recording device, the
+// same as the hidraw backend
+const recordBuffer = 30
+
+// RecordingBackend is a hid.Backend that records all the reports written to
+// and read from the devices it opens
+type RecordingBackend struct {
+	backend hid.Backend
+	w       Writer
+	now     func() time.Time
+}
+
+// NewRecordingBackend returns a backend that opens devices with the given
+// backend and records their reports to w
+func NewRecordingBackend(backend hid.Backend, w Writer) *RecordingBackend {
+	return &RecordingBackend{backend: backend, w: w, now: time.Now}
+}
+
+// Devices returns the devices of the wrapped backend
+func (b *RecordingBackend) Devices() ([]*hid.DeviceInfo, error) {
+	return b.backend.Devices()
+}
+
+// Hotplug passes on the hotplug events of the wrapped backend, if it has them
+func (b *RecordingBackend) Hotplug(stop <-chan struct{}) (<-chan hid.Event, error) {
+	if h, ok := b.backend.(hid.Hotplugger); ok {
+		return h.Hotplug(stop)
+	}
+	return nil, hid.ErrHotplugUnsupported
+}
+
+// Open opens the device with the wrapped backend and starts recording it
+func (b *RecordingBackend) Open(info *hid.DeviceInfo) (hid.Device, error) {
+	dev, err := b.backend.Open(info)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rd := &recordingDevice{
+		dev:     dev,
+		info:    *info,
+		backend: b,
+		reports: hid.NewReports(recordBuffer),
+		cancel:  cancel,
+	}
+
+	go rd.readThread(ctx)
+	return rd, nil
+}
+
+func (b *RecordingBackend) record(info hid.DeviceInfo, dir Direction, data []byte) {
+	rec := Record{
+		Time:      b.now(),
+		Serial:    info.SerialNumber,
+		Product:   info.Product,
+		Direction: dir,
+		Data:      Hex(append([]byte{}, data...)),
+	}
+
+	tell.IfErrorf(b.w.WriteRecord(rec), "failed to record %s report for %s", dir, info.SerialNumber)
+}
+
+// recordingDevice records the reports passing through a device
+type recordingDevice struct {
+	dev     hid.Device
+	info    hid.DeviceInfo
+	backend *RecordingBackend
+
+	reports *hid.Reports
+	cancel  context.CancelFunc
+}
+
+func (d *recordingDevice) Close() {
+	d.cancel()
+	d.reports.Close()
+	d.dev.Close()
+}
+
+func (d *recordingDevice) Write(data []byte) error {
+	d.backend.record(d.info, Out, data)
+	return d.dev.Write(data)
+}
+
+// feature reports are passed on without being recorded
+func (d *recordingDevice) GetFeatureReport(id byte, buf []byte) (int, error) {
+	return d.dev.GetFeatureReport(id, buf)
+}
+
+func (d *recordingDevice) SendFeatureReport(data []byte) error {
+	return d.dev.SendFeatureReport(data)
+}
+
+func (d *recordingDevice) ReadCh() <-chan []byte {
+	return d.reports.Ch()
+}
+
+func (d *recordingDevice) Read(ctx context.Context) ([]byte, error) {
+	return d.reports.Read(ctx)
+}
+
+func (d *recordingDevice) ReadError() error {
+	return d.reports.Err()
+}
+
+// Overflows counts the reports dropped by both the device and the recorder
+func (d *recordingDevice) Overflows() uint64 {
+	return d.dev.Overflows() + d.reports.Overflows()
+}
+
+// readThread records the reports read from the device as they are passed on.
+// Every report is read from the device so that none go unrecorded, even if
+// they are dropped before they are passed on.
+func (d *recordingDevice) readThread(ctx context.Context) {
+	for {
+		report, err := d.dev.Read(ctx)
+		if err != nil {
+			d.reports.Fail(err)
+			return
+		}
+
+		d.backend.record(d.info, In, report)
+		d.reports.Put(report)
+	}
+}
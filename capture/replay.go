@@ -0,0 +1,160 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+// commandLength is the number of bytes at the start of an output report,
+// including the report number, used to match it to one in the capture
+const commandLength = 3
+
+var (
+	// ErrReplayClosed is returned when writing to a replayed device that is closed
+	ErrReplayClosed = errors.New("replayed device is closed")
+)
+
+// ReplayBackend is a hid.Backend that plays back the devices in a capture.
+// Each output report written to a replayed device is matched to the next one
+// in the capture with the same command, and is answered with the input
+// reports that followed it.  The capture wraps around once it runs out, so a
+// capture of a few polls can be polled forever.
+type ReplayBackend struct {
+	mutex   *sync.Mutex
+	devices []*replayDevice
+}
+
+// NewReplayBackend returns a backend replaying the records
+func NewReplayBackend(records []Record) *ReplayBackend {
+	b := &ReplayBackend{mutex: new(sync.Mutex)}
+
+	bySerial := map[string]*replayDevice{}
+	for _, rec := range records {
+		d, ok := bySerial[rec.Serial]
+		if !ok {
+			d = &replayDevice{
+				mutex:       new(sync.Mutex),
+				ReportQueue: hid.NewReportQueue(),
+				info: hid.DeviceInfo{
+					Path:         "replay/" + rec.Serial,
+					Product:      rec.Product,
+					SerialNumber: rec.Serial,
+				},
+			}
+			bySerial[rec.Serial] = d
+			b.devices = append(b.devices, d)
+		}
+
+		d.records = append(d.records, rec)
+	}
+
+	return b
+}
+
+// Devices returns the info of the devices in the capture
+func (b *ReplayBackend) Devices() ([]*hid.DeviceInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	infos := make([]*hid.DeviceInfo, len(b.devices))
+	for i, d := range b.devices {
+		info := d.info
+		infos[i] = &info
+	}
+
+	return infos, nil
+}
+
+// Open opens the replayed device with the same path as the info
+func (b *ReplayBackend) Open(info *hid.DeviceInfo) (hid.Device, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, d := range b.devices {
+		if d.info.Path == info.Path {
+			d.Open()
+			return d, nil
+		}
+	}
+
+	return nil, hid.ErrDeviceNotFound
+}
+
+// replayDevice plays back the records of a single device
+type replayDevice struct {
+	mutex   *sync.Mutex
+	info    hid.DeviceInfo
+	records []Record
+	next    int
+
+	*hid.ReportQueue
+}
+
+// feature reports aren't captured, so can't be replayed
+func (d *replayDevice) GetFeatureReport(id byte, buf []byte) (int, error) {
+	return 0, hid.ErrNoFeatureReports
+}
+
+func (d *replayDevice) SendFeatureReport(data []byte) error {
+	return hid.ErrNoFeatureReports
+}
+
+// Write answers the output report with the input reports that followed the
+// next matching one in the capture.  Reports that were never captured go
+// unanswered.
+func (d *replayDevice) Write(data []byte) error {
+	reports, open := d.Queue()
+	if !open {
+		return ErrReplayClosed
+	}
+
+	for _, answer := range d.answers(data) {
+		reports.Put(answer)
+	}
+
+	return nil
+}
+
+// answers returns the input reports that answer the output report
+func (d *replayDevice) answers(data []byte) [][]byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	i, ok := d.match(data)
+	if !ok {
+		return nil
+	}
+
+	var answers [][]byte
+	for i++; i < len(d.records) && d.records[i].Direction == In; i++ {
+		answers = append(answers, append([]byte{}, d.records[i].Data...))
+	}
+	d.next = i % len(d.records)
+
+	return answers
+}
+
+// match returns the index of the next output record with the same command
+// as the report
+func (d *replayDevice) match(data []byte) (int, bool) {
+	n := len(d.records)
+	for j := 0; j < n; j++ {
+		i := (d.next + j) % n
+		rec := d.records[i]
+		if rec.Direction == Out && sameCommand(rec.Data, data) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func sameCommand(a, b []byte) bool {
+	if len(a) < commandLength || len(b) < commandLength {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(a[:commandLength], b[:commandLength])
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/go-nats"
+
+	"github.com/AutogrowSystems/go-intelli/util/tell"
+)
+
+const (
+	// natsReconnectDelay is how long to wait before connecting to NATS again
+	// after failing to or losing the connection, which doubles after each
+	// failure up to the max
+	natsReconnectDelay    = time.Second
+	natsReconnectMaxDelay = time.Minute
+
+	// natsStableAfter is how long a connection has to stay up for the
+	// backoff to start over once it is lost
+	natsStableAfter = time.Minute
+
+	// natsReplayBatch is how many spooled messages are sent before waiting
+	// for the server to have them, and natsFlushTimeout how long to wait
+	natsReplayBatch  = 100
+	natsFlushTimeout = 5 * time.Second
+)
+
+// broker keeps a connection to NATS, connecting again with a backoff
+// whenever it is lost, and spools the messages published while it is down
+// to send them in order once it is back
+type broker struct {
+	url  string
+	opts []nats.Option
+
+	// connected is called with each new connection, to subscribe on it
+	connected func(*nats.Conn) error
+
+	// mutex guards the connection, which is nil while disconnected, and the
+	// spool
+	mutex *sync.Mutex
+	nc    *nats.Conn
+	spool *spool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBroker(url string, opts []nats.Option, spool *spool, connected func(*nats.Conn) error) *broker {
+	return &broker{
+		url:       url,
+		opts:      opts,
+		connected: connected,
+		mutex:     new(sync.Mutex),
+		spool:     spool,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// run connects to NATS and stays connected until the broker is closed
+func (b *broker) run() {
+	defer close(b.done)
+
+	for attempt := 0; ; {
+		closed := make(chan struct{})
+		once := new(sync.Once)
+
+		// reconnecting is left to the broker so that it can back off, and
+		// subscribe again on the new connection
+		opts := append(append([]nats.Option{}, b.opts...), nats.NoReconnect(), nats.ClosedHandler(func(*nats.Conn) {
+			once.Do(func() { close(closed) })
+		}))
+
+		nc, err := nats.Connect(b.url, opts...)
+		if err != nil {
+			attempt++
+			wait := natsBackoff(attempt)
+			tell.Warnf("failed to connect to NATS, trying again in %s: %s", wait, err)
+
+			if !b.sleep(wait) {
+				return
+			}
+			continue
+		}
+
+		connectedAt := time.Now()
+		tell.Infof("connected to NATS at %s", nc.ConnectedUrl())
+
+		if err := b.connected(nc); err != nil {
+			tell.Errorf("failed to subscribe to NATS: %s", err)
+		}
+
+		// a connection that fails while sending the spool is given up on
+		// and made again, sending what is left then
+		replayed := b.replay(nc)
+		if !replayed {
+			nc.Close()
+		}
+
+		select {
+		case <-closed:
+			b.disconnected()
+
+			// a connection that keeps failing straight away is backed off
+			// from the same as one that can't be made
+			if replayed && time.Since(connectedAt) >= natsStableAfter {
+				attempt = 0
+			}
+			attempt++
+			wait := natsBackoff(attempt)
+			tell.Warnf("lost the connection to NATS, spooling updates and connecting again in %s: %v", wait, nc.LastError())
+
+			if !b.sleep(wait) {
+				return
+			}
+		case <-b.stop:
+			b.disconnected()
+			tell.IfErrorf(nc.Flush(), "failed to flush NATS")
+			nc.Close()
+			return
+		}
+	}
+}
+
+// sleep waits for the delay, returning false if the broker is closed first
+func (b *broker) sleep(delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-b.stop:
+		return false
+	}
+}
+
+// replay sends the messages in the spool before switching to the connection,
+// keeping them in order with any published in the meantime.  Each batch is
+// only removed from the spool once the server has it, and messages that can
+// never be sent are skipped.  It returns false if the connection failed.
+func (b *broker) replay(nc *nats.Conn) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if n := b.spool.len(); n > 0 {
+		tell.Infof("sending %d updates spooled while NATS was down", n)
+	}
+
+	skipped := 0
+	for {
+		batch := b.spool.head(natsReplayBatch)
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, msg := range batch {
+			err := nc.Publish(msg.Subject, msg.Data)
+			switch {
+			case err == nil:
+			case messageError(err):
+				tell.Warnf("skipping the spooled update to %s: %s", msg.Subject, err)
+				skipped++
+			default:
+				tell.Warnf("failed to send the spooled updates: %s", err)
+				tell.IfErrorf(b.spool.compact(), "failed to compact the NATS spool")
+				return false
+			}
+		}
+
+		if err := nc.FlushTimeout(natsFlushTimeout); err != nil {
+			tell.Warnf("failed to send the spooled updates: %s", err)
+			tell.IfErrorf(b.spool.compact(), "failed to compact the NATS spool")
+			return false
+		}
+
+		tell.IfErrorf(b.spool.pop(len(batch)), "failed to empty the NATS spool")
+	}
+
+	if skipped > 0 {
+		tell.Warnf("skipped %d spooled updates that can't be sent over NATS", skipped)
+	}
+
+	b.nc = nc
+	return true
+}
+
+func (b *broker) disconnected() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.nc = nil
+}
+
+// Publish sends the message, or spools it while NATS is down
+func (b *broker) Publish(subj string, data []byte) {
+	b.mutex.Lock()
+	failed := b.publish(subj, data)
+	b.mutex.Unlock()
+
+	// closed so that the broker connects again, and sends the spool then
+	if failed != nil {
+		failed.Close()
+	}
+}
+
+// publish sends or spools the message, returning the connection if it failed
+func (b *broker) publish(subj string, data []byte) *nats.Conn {
+	var failed *nats.Conn
+
+	if b.nc != nil {
+		err := b.nc.Publish(subj, data)
+		switch {
+		case err == nil:
+			return nil
+		case messageError(err):
+			// it would fail the same on any connection
+			tell.Errorf("failed to send %s over NATS, dropping it: %s", subj, err)
+			return nil
+		}
+
+		// spool everything from here on so that it stays in order, until
+		// the spool is sent on the next connection
+		tell.Warnf("failed to send %s over NATS, spooling it: %s", subj, err)
+		failed, b.nc = b.nc, nil
+	}
+
+	dropped := b.spool.dropped
+	tell.IfErrorf(b.spool.push(subj, data), "failed to spool %s", subj)
+	if b.spool.dropped > dropped {
+		tell.Warnf("the NATS spool is full, dropped the %d oldest updates", b.spool.dropped-dropped)
+	}
+
+	return failed
+}
+
+// messageError returns true if the error is down to the message rather than
+// the connection, so that sending it again can't help
+func messageError(err error) bool {
+	return err == nats.ErrMaxPayload || err == nats.ErrBadSubject
+}
+
+// Close disconnects from NATS, leaving anything still spooled in the file to
+// be sent the next time
+func (b *broker) Close() {
+	close(b.stop)
+	<-b.done
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	tell.IfErrorf(b.spool.close(), "failed to close the NATS spool")
+}
+
+// natsBackoff returns how long to wait before the given attempt to connect
+func natsBackoff(attempt int) time.Duration {
+	wait := natsReconnectDelay << uint(attempt-1)
+	if attempt > 16 || wait > natsReconnectMaxDelay {
+		return natsReconnectMaxDelay
+	}
+	return wait
+}
+
+// natsURL returns the URL of the NATS server, which is given as a host and
+// port unless it has a scheme like tls://
+func natsURL(host string) string {
+	if strings.Contains(host, "://") {
+		return host
+	}
+	return "nats://" + host
+}
+
+// natsOptions returns the options to connect to NATS with TLS, a credentials
+// file or an NKey, when they are given
+func natsOptions(secure bool, ca, cert, key, creds, nkey string) ([]nats.Option, error) {
+	opts := []nats.Option{nats.Name("intellid")}
+
+	if secure {
+		opts = append(opts, nats.Secure())
+	}
+
+	if ca != "" {
+		opts = append(opts, nats.RootCAs(ca))
+	}
+
+	if cert != "" || key != "" {
+		opts = append(opts, nats.ClientCert(cert, key))
+	}
+
+	if creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+
+	if nkey != "" {
+		opt, err := nats.NkeyOptionFromSeed(nkey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/go-nats"
+)
+
+// fakeServer speaks enough of the NATS protocol to take the messages
+// published to it
+type fakeServer struct {
+	listener   net.Listener
+	maxPayload int
+
+	// failPublish closes the connection as soon as a message is published,
+	// and hangUp closes it once the client has connected
+	failPublish bool
+	hangUp      bool
+
+	mutex    *sync.Mutex
+	received []string
+	conns    int
+}
+
+func startServer(t *testing.T, srv *fakeServer) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	srv.listener = listener
+	srv.mutex = new(sync.Mutex)
+	if srv.maxPayload == 0 {
+		srv.maxPayload = 1 << 20
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			srv.mutex.Lock()
+			srv.conns++
+			srv.mutex.Unlock()
+
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *fakeServer) url() string {
+	return "nats://" + srv.listener.Addr().String()
+}
+
+func (srv *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.0.0\",\"proto\":1,\"max_payload\":%d}\r\n", srv.maxPayload)
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+			if srv.hangUp {
+				return
+			}
+		case "PUB":
+			if srv.failPublish {
+				return
+			}
+
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+
+			srv.mutex.Lock()
+			srv.received = append(srv.received, fields[1]+" "+string(data[:n]))
+			srv.mutex.Unlock()
+		}
+	}
+}
+
+// messages returns the messages received as "<subject> <data>"
+func (srv *fakeServer) messages() []string {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return append([]string{}, srv.received...)
+}
+
+func (srv *fakeServer) connections() int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.conns
+}
+
+func (srv *fakeServer) close() {
+	srv.listener.Close()
+}
+
+// testBroker returns a broker that isn't connected, spooling to a temporary
+// file that is removed by the returned func
+func testBroker(t *testing.T, url string) (*broker, func()) {
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := openSpool(filepath.Join(dir, "nats.spool"), 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open the spool: %s", err)
+	}
+
+	b := newBroker(url, nil, spool, func(*nats.Conn) error { return nil })
+	return b, func() { os.RemoveAll(dir) }
+}
+
+func connect(t *testing.T, srv *fakeServer) *nats.Conn {
+	nc, err := nats.Connect(srv.url(), nats.NoReconnect())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	return nc
+}
+
+func expectMessages(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q to be sent, got %q", expected, got)
+	}
+}
+
+func TestBrokerSpoolsUntilConnected(t *testing.T) {
+	srv := startServer(t, &fakeServer{})
+	defer srv.close()
+
+	b, cleanup := testBroker(t, srv.url())
+	defer cleanup()
+
+	for i := 1; i <= 3; i++ {
+		b.Publish("intelli.SIMID00001", []byte(strconv.Itoa(i)))
+	}
+
+	if n := b.spool.len(); n != 3 {
+		t.Fatalf("expected the updates to be spooled while disconnected, got %d", n)
+	}
+
+	go b.run()
+
+	for i := 0; len(srv.messages()) < 3; i++ {
+		if i == 100 {
+			t.Fatalf("expected the spool to be sent once connected, got %q", srv.messages())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Publish("intelli.SIMID00001", []byte("4"))
+	b.Close()
+
+	expectMessages(t, srv.messages(), "intelli.SIMID00001 1", "intelli.SIMID00001 2", "intelli.SIMID00001 3", "intelli.SIMID00001 4")
+	if n := b.spool.len(); n != 0 {
+		t.Errorf("expected the spool to be empty, got %d", n)
+	}
+}
+
+func TestBrokerKeepsSpoolWhenReplayFails(t *testing.T) {
+	failing := startServer(t, &fakeServer{failPublish: true})
+	defer failing.close()
+
+	b, cleanup := testBroker(t, failing.url())
+	defer cleanup()
+
+	for i := 1; i <= 3; i++ {
+		b.Publish("intelli.SIMID00001", []byte(strconv.Itoa(i)))
+	}
+
+	nc := connect(t, failing)
+	if b.replay(nc) {
+		t.Errorf("expected the replay to fail")
+	}
+	nc.Close()
+
+	if n := b.spool.len(); n != 3 || b.nc != nil {
+		t.Fatalf("expected the spool to be kept while disconnected, got %d", n)
+	}
+
+	srv := startServer(t, &fakeServer{})
+	defer srv.close()
+
+	nc = connect(t, srv)
+	defer nc.Close()
+
+	if !b.replay(nc) {
+		t.Fatalf("expected the replay to succeed")
+	}
+
+	expectMessages(t, srv.messages(), "intelli.SIMID00001 1", "intelli.SIMID00001 2", "intelli.SIMID00001 3")
+	if n := b.spool.len(); n != 0 {
+		t.Errorf("expected the spool to be empty, got %d", n)
+	}
+}
+
+func TestBrokerSkipsUnsendableMessages(t *testing.T) {
+	srv := startServer(t, &fakeServer{maxPayload: 16})
+	defer srv.close()
+
+	b, cleanup := testBroker(t, srv.url())
+	defer cleanup()
+
+	large := strings.Repeat("x", 32)
+	b.Publish("intelli.SIMID00001", []byte("1"))
+	b.Publish("intelli.SIMID00001", []byte(large))
+	b.Publish("intelli.SIMID00001", []byte("2"))
+
+	nc := connect(t, srv)
+	defer nc.Close()
+
+	if !b.replay(nc) {
+		t.Fatalf("expected the replay to succeed")
+	}
+
+	// dropped instead of spooled, as no connection can take it
+	b.Publish("intelli.SIMID00001", []byte(large))
+	b.Publish("intelli.SIMID00001", []byte("3"))
+	nc.Flush()
+
+	expectMessages(t, srv.messages(), "intelli.SIMID00001 1", "intelli.SIMID00001 2", "intelli.SIMID00001 3")
+	if n := b.spool.len(); n != 0 || b.nc != nc {
+		t.Errorf("expected to stay connected with an empty spool, got %d spooled", n)
+	}
+}
+
+func TestBrokerBacksOffFromLostConnections(t *testing.T) {
+	srv := startServer(t, &fakeServer{hangUp: true})
+	defer srv.close()
+
+	b, cleanup := testBroker(t, srv.url())
+	defer cleanup()
+
+	go b.run()
+	time.Sleep(natsReconnectDelay / 2)
+	b.Close()
+
+	if n := srv.connections(); n != 1 {
+		t.Errorf("expected to wait before connecting again, connected %d times", n)
+	}
+}
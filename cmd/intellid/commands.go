@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/go-nats"
+
+	"github.com/AutogrowSystems/go-intelli/device"
+	"github.com/AutogrowSystems/go-intelli/util/tell"
+)
+
+// commandSubject is subscribed to for the commands sent to the devices, as
+// intelli.<serial>.cmd.<command>, see device.SubjectToken
+const commandSubject = "intelli.*.cmd.>"
+
+// commandTimeout is how long a command sent over NATS is given to run
+const commandTimeout = 30 * time.Second
+
+// commandWorkers is how many commands are run at the same time, the others
+// waiting in the subscription until one has finished
+const commandWorkers = 4
+
+// commander runs the commands sent over NATS and answers them through
+// request/reply
+type commander struct {
+	mgr     *device.Manager
+	running *sync.WaitGroup
+	workers chan struct{}
+
+	// mutex guards the subscription on the current connection, and whether
+	// the commander has been stopped
+	mutex   *sync.Mutex
+	sub     *nats.Subscription
+	stopped bool
+}
+
+func newCommander(mgr *device.Manager) *commander {
+	return &commander{
+		mgr:     mgr,
+		running: new(sync.WaitGroup),
+		workers: make(chan struct{}, commandWorkers),
+		mutex:   new(sync.Mutex),
+	}
+}
+
+// subscribe takes the commands sent over the connection, which is done again
+// for each new connection
+func (c *commander) subscribe(nc *nats.Conn) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopped {
+		return nil
+	}
+
+	sub, err := nc.Subscribe(commandSubject, func(m *nats.Msg) {
+		c.run(nc, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.sub = sub
+	return nil
+}
+
+// run answers the command in the background once a worker is free, unless
+// the commander has been stopped in the meantime
+func (c *commander) run(nc *nats.Conn, m *nats.Msg) {
+	c.workers <- struct{}{}
+
+	c.mutex.Lock()
+	if c.stopped {
+		c.mutex.Unlock()
+		<-c.workers
+		return
+	}
+	c.running.Add(1)
+	c.mutex.Unlock()
+
+	go func() {
+		defer c.running.Done()
+		defer func() { <-c.workers }()
+		answerCommand(nc, c.mgr, m)
+	}()
+}
+
+// stop stops taking commands and waits for the ones still running
+func (c *commander) stop() {
+	c.mutex.Lock()
+	c.stopped = true
+	if c.sub != nil {
+		c.sub.Unsubscribe()
+	}
+	c.mutex.Unlock()
+
+	c.running.Wait()
+}
+
+// answerCommand runs the command in the message and publishes the reply
+func answerCommand(nc *nats.Conn, mgr *device.Manager, m *nats.Msg) {
+	var reply device.CommandReply
+
+	// the subject is intelli.<serial>.cmd.<command>, the serial being the
+	// subject token of the device ID
+	tokens := strings.SplitN(m.Subject, ".", 4)
+	serial, command := tokens[1], tokens[3]
+
+	if strings.Contains(command, ".") {
+		reply.Error = &device.CommandError{Code: device.CodeUnknownCommand, Message: "unknown command " + command}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		reply = mgr.Command(ctx, serial, command, m.Data)
+		cancel()
+	}
+
+	switch {
+	case reply.OK:
+		tell.Infof("ran %s on %s", command, serial)
+	case reply.Error.Code == device.CodeNotFound:
+		// the device may be attached to another gateway on the same server,
+		// so leave the request for that one to answer
+		tell.Debugf("ignoring %s on %s, it isn't attached here", command, serial)
+		return
+	default:
+		tell.Warnf("failed to run %s on %s: %s", command, serial, reply.Error)
+	}
+
+	if m.Reply == "" {
+		return
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		tell.Errorf("failed to encode the reply to %s: %s", m.Subject, err)
+		return
+	}
+
+	tell.IfErrorf(nc.Publish(m.Reply, data), "failed to reply to %s", m.Subject)
+}
@@ -1,37 +1,92 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	nats "github.com/nats-io/go-nats"
 
 	"flag"
 
+	"github.com/AutogrowSystems/go-intelli/capture"
 	"github.com/AutogrowSystems/go-intelli/device"
+	"github.com/AutogrowSystems/go-intelli/hid"
+	"github.com/AutogrowSystems/go-intelli/simulator"
 	"github.com/AutogrowSystems/go-intelli/util/tell"
 )
 
 const enumerationInterval = 10
 
+// shutdownTimeout is how long requests to the API are given to finish when
+// shutting down
+const shutdownTimeout = 5 * time.Second
+
+// eventBuffer is the number of device events queued to be sent over NATS
+const eventBuffer = 256
+
 // Version is the current version of the software: can be set by LDFLAGS at
 // build time using: go build -ldflags "-X main.Version=1.0" ./cmd/natsgw
 var Version = "version not set"
 
+// hostname returns the name of the host, used as the default gateway ID
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "intellid"
+	}
+	return name
+}
+
 func main() {
 	var delay int
 	var natsHost string
 	var debug bool
 	var apiPort string
 	var printVersion bool
-
-	flag.StringVar(&natsHost, "nats", "localhost:4222", "the NATS URL to use")
+	var retries int
+	var reattach time.Duration
+	var stale int
+	var simulate string
+	var record string
+	var replay string
+	var granular bool
+	var gateway string
+	var natsTLS bool
+	var natsCA string
+	var natsCert string
+	var natsKey string
+	var natsCreds string
+	var natsNKey string
+	var spoolPath string
+	var spoolSize int
+
+	flag.StringVar(&natsHost, "nats", "localhost:4222", "the NATS URL to use, or empty to not use NATS")
+	flag.BoolVar(&natsTLS, "nats-tls", false, "connect to NATS over TLS")
+	flag.StringVar(&natsCA, "nats-ca", "", "the CA certificate file to verify the NATS server with, which implies -nats-tls")
+	flag.StringVar(&natsCert, "nats-cert", "", "the client certificate file to connect to NATS with, along with -nats-key")
+	flag.StringVar(&natsKey, "nats-key", "", "the client key file to connect to NATS with, along with -nats-cert")
+	flag.StringVar(&natsCreds, "nats-creds", "", "the credentials file to connect to NATS with")
+	flag.StringVar(&natsNKey, "nats-nkey", "", "the NKey seed file to connect to NATS with")
+	flag.StringVar(&spoolPath, "spool", filepath.Join(os.TempDir(), "intellid-nats.spool"), "the file updates are kept in while NATS is down")
+	flag.IntVar(&spoolSize, "spool-size", 16, "the most MB of updates kept while NATS is down, dropping the oldest beyond that")
 	flag.StringVar(&apiPort, "p", ":9191", "the API port to serve on")
 	flag.BoolVar(&debug, "debug", false, "Run gateway on debug mode")
 	flag.BoolVar(&printVersion, "version", false, "print the version and exit")
 	flag.IntVar(&delay, "delay", 15, "how often to poll the USB device")
+	flag.IntVar(&retries, "retries", 2, "how many times to retry a request the USB device doesn't answer")
+	flag.DurationVar(&reattach, "reattach", 30*time.Second, "how long to wait for an unplugged USB device to come back before forgetting it")
+	flag.IntVar(&stale, "stale", 3, "how many polls in a row a USB device can miss before its shadow is marked stale")
+	flag.StringVar(&simulate, "simulate", "", "simulate devices instead of using USB, e.g. dose=2,climate=1")
+	flag.StringVar(&record, "record", "", "record the USB traffic to a capture file (pcapng if it ends in .pcapng, JSON lines otherwise)")
+	flag.StringVar(&replay, "replay", "", "replay the devices in a capture file instead of using USB")
+	flag.BoolVar(&granular, "granular", false, "also publish each metric, function and alarm on its own NATS subject, and the devices present")
+	flag.StringVar(&gateway, "gateway", hostname(), "the ID of the gateway in the NATS subject of the devices present")
 	flag.Parse()
 
 	if printVersion {
@@ -43,34 +98,106 @@ func main() {
 		tell.Level = tell.INFO
 	}
 
-	nc, err := nats.Connect("nats://" + natsHost)
-	if err != nil {
-		tell.Fatalf("failed to connect to NATS: %s", err)
+	var backend hid.Backend = hid.System
+	switch {
+	case simulate != "":
+		sim, err := simulator.NewBackend(simulate)
+		if err != nil {
+			tell.Fatalf("failed to simulate devices: %s", err)
+		}
+
+		tell.Infof("simulating devices: %s", simulate)
+		backend = sim
+	case replay != "":
+		records, err := capture.ReadFile(replay)
+		if err != nil {
+			tell.Fatalf("failed to read capture: %s", err)
+		}
+
+		tell.Infof("replaying %d records from %s", len(records), replay)
+		backend = capture.NewReplayBackend(records)
 	}
 
-	mgr := device.NewManager(enumerationInterval, delay)
+	if record != "" {
+		w, err := capture.Create(record)
+		if err != nil {
+			tell.Fatalf("failed to create capture: %s", err)
+		}
+		defer w.Close()
 
-	// send the shadow over NATS whenever the device shadow is updated
-	mgr.OnDeviceUpdated(func(d device.Device) {
-		tell.Debugf("device %s updated", d.SerialNumber)
+		tell.Infof("recording USB traffic to %s", record)
+		backend = capture.NewRecordingBackend(backend, w)
+	}
 
-		subj := fmt.Sprintf("intelli.%s", d.SerialNumber)
-		data, err := json.Marshal(d.Shadow)
+	opts := []device.Option{device.WithRequestRetries(retries), device.WithBackend(backend), device.WithReattachGrace(reattach), device.WithStaleAfter(stale)}
+	mgr := device.NewManager(enumerationInterval, delay, opts...)
+
+	// send the shadow over NATS whenever the device shadow is updated, and
+	// let clients know when a device that went away is back with the shadow
+	// it had before.  The connection is kept up in the background, and the
+	// updates are spooled while it is down.
+	var nb *broker
+	var commands *commander
+	published := make(chan struct{})
+
+	if natsHost == "" {
+		tell.Infof("not using NATS")
+		close(published)
+	} else {
+		natsOpts, err := natsOptions(natsTLS, natsCA, natsCert, natsKey, natsCreds, natsNKey)
 		if err != nil {
-			tell.Errorf("failed to send device update over NATS: %s", err)
+			tell.Fatalf("failed to set up NATS: %s", err)
 		}
 
-		nc.Publish(subj, data)
-	})
+		spool, err := openSpool(spoolPath, spoolSize<<20)
+		if err != nil {
+			tell.Fatalf("failed to open the NATS spool: %s", err)
+		}
+
+		// run the commands sent to the devices over NATS on each connection
+		commands = newCommander(mgr)
+		nb = newBroker(natsURL(natsHost), natsOpts, spool, commands.subscribe)
+		go nb.run()
 
-	// start discovering devices attached via USB (loops forever)
-	go mgr.Discover()
+		events := mgr.Subscribe(eventBuffer, device.Block)
+		go func() {
+			defer close(published)
+			newPublisher(nb, mgr, gateway, granular).run(events)
+		}()
+	}
+
+	// shut down gracefully on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		tell.Infof("received %s, shutting down", sig)
+		cancel()
+	}()
 
 	// attach and API to the manager to see whats going on
 	r := gin.Default()
 	mgr.AttachAPI(r)
-	go r.Run(apiPort)
+	srv := &http.Server{Addr: apiPort, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			tell.Fatalf("failed to serve API: %s", err)
+		}
+	}()
+
+	// discover and interrogate devices attached via USB until told to stop
+	mgr.Run(ctx)
+	<-published
+	if commands != nil {
+		commands.stop()
+	}
+
+	shutdownCtx, done := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer done()
+	tell.IfErrorf(srv.Shutdown(shutdownCtx), "failed to shut down the API")
 
-	// interrogate the readings from the discovered devices (loops forever)
-	mgr.Interrogate()
+	if nb != nil {
+		nb.Close()
+	}
 }
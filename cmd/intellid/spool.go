@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+// spooled is a message kept in the spool
+type spooled struct {
+	Subject string `json:"subject"`
+	Data    []byte `json:"data"`
+}
+
+// spool keeps the messages that couldn't be sent over NATS in a file, one
+// JSON line each, so that they can be sent in order once it is back, even
+// after a restart.  It is bounded to maxBytes, dropping the oldest messages
+// when it is full.  It isn't safe to use from more than one goroutine.
+type spool struct {
+	path     string
+	maxBytes int
+	file     *os.File
+
+	// messages mirrors the file, less those popped since it was compacted
+	messages []spooled
+	sizes    []int
+	size     int
+
+	// dropped is the number of messages dropped because the spool was full
+	dropped int
+}
+
+// openSpool opens the spool in the file at the path, loading the messages
+// left in it.  Lines that can't be read, like one cut short by a crash, are
+// skipped.
+func openSpool(path string, maxBytes int) (*spool, error) {
+	s := &spool{path: path, maxBytes: maxBytes}
+
+	if f, err := os.Open(path); err == nil {
+		lines := bufio.NewScanner(f)
+		lines.Buffer(nil, maxBytes+1)
+		for lines.Scan() {
+			var msg spooled
+			if json.Unmarshal(lines.Bytes(), &msg) == nil {
+				s.add(msg, len(lines.Bytes())+1)
+			}
+		}
+		f.Close()
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *spool) add(msg spooled, size int) {
+	s.messages = append(s.messages, msg)
+	s.sizes = append(s.sizes, size)
+	s.size += size
+}
+
+// push adds the message to the end of the spool
+func (s *spool) push(subj string, data []byte) error {
+	line, err := json.Marshal(spooled{subj, data})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.add(spooled{subj, data}, len(line))
+	if s.size > s.maxBytes {
+		// make some room so that the file isn't rewritten for every message
+		for len(s.messages) > 0 && s.size > s.maxBytes*9/10 {
+			s.drop()
+			s.dropped++
+		}
+		return s.compact()
+	}
+
+	_, err = s.file.Write(line)
+	return err
+}
+
+// head returns up to n of the oldest messages in the spool
+func (s *spool) head(n int) []spooled {
+	if n > len(s.messages) {
+		n = len(s.messages)
+	}
+	return s.messages[:n]
+}
+
+// pop removes the n oldest messages, emptying the file once all of them have
+// been removed
+func (s *spool) pop(n int) error {
+	for i := 0; i < n && len(s.messages) > 0; i++ {
+		s.drop()
+	}
+
+	if len(s.messages) == 0 {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *spool) drop() {
+	s.size -= s.sizes[0]
+	s.messages = s.messages[1:]
+	s.sizes = s.sizes[1:]
+}
+
+func (s *spool) len() int {
+	return len(s.messages)
+}
+
+// compact rewrites the file with the messages still in the spool
+func (s *spool) compact() error {
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, msg := range s.messages {
+		line, _ := json.Marshal(msg)
+		w.Write(append(line, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// close compacts the file so that only the messages not yet sent are left
+// for the next time, and closes it
+func (s *spool) close() error {
+	if err := s.compact(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpoolKeepsOrderAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nats.spool")
+	s, err := openSpool(path, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open the spool: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.push("intelli.dose-1", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	// the first one was sent before the gateway stopped
+	s.pop(1)
+	s.close()
+
+	// a line cut short by a crash is skipped
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"subject":"intelli.do`)
+	f.Close()
+
+	s, err = openSpool(path, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open the spool again: %s", err)
+	}
+
+	messages := s.head(10)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages left, got %d", len(messages))
+	}
+
+	for i, msg := range messages {
+		if string(msg.Data) != fmt.Sprintf(`{"n":%d}`, i+1) {
+			t.Fatalf("expected message %d, got %s", i+1, msg.Data)
+		}
+	}
+	s.pop(len(messages))
+
+	if s.len() != 0 {
+		t.Errorf("expected the spool to be empty, got %d", s.len())
+	}
+
+	if info, _ := os.Stat(path); info.Size() != 0 {
+		t.Errorf("expected the file to be emptied, got %d bytes", info.Size())
+	}
+	s.close()
+}
+
+func TestSpoolDropsOldest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each message takes 49 bytes
+	s, _ := openSpool(filepath.Join(dir, "nats.spool"), 500)
+	for i := 0; i < 20; i++ {
+		s.push("intelli.dose-1", []byte(fmt.Sprintf(`{"n":%02d}`, i)))
+	}
+
+	if s.dropped == 0 || s.size > 500 {
+		t.Fatalf("expected the spool to stay under 500 bytes by dropping, got %d bytes after dropping %d", s.size, s.dropped)
+	}
+
+	if msg := s.head(1)[0]; string(msg.Data) != fmt.Sprintf(`{"n":%02d}`, s.dropped) {
+		t.Errorf("expected the oldest messages to be dropped, got %s first after dropping %d", msg.Data, s.dropped)
+	}
+	s.close()
+}
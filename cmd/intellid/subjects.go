@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/device"
+	"github.com/AutogrowSystems/go-intelli/util/tell"
+)
+
+// publisher sends the events of the devices over NATS.  The shadow is always
+// sent to intelli.<serial>, and when granular is set the metrics, functions,
+// alarms and the devices present are each sent on their own subjects too.
+// The <serial> of every subject is the subject token of the device ID, which
+// is its serial number unless it doesn't have one, see device.SubjectToken.
+type publisher struct {
+	broker   outbox
+	mgr      *device.Manager
+	gateway  string
+	granular bool
+
+	// sequences and functions are what was last sent for each device, so
+	// that only new readings and changed functions are sent
+	sequences map[string]uint64
+	functions map[string]map[string]device.FunctionStatus
+}
+
+// outbox takes the messages to be sent over NATS, which the broker does
+type outbox interface {
+	Publish(subj string, data []byte)
+}
+
+// metricMessage is sent to intelli.<serial>.metrics.<name>
+type metricMessage struct {
+	device.Metric
+	LastSeen int64 `json:"last_seen"`
+}
+
+// statusMessage is sent to intelli.<serial>.status.<function>
+type statusMessage struct {
+	device.FunctionStatus
+	Time time.Time `json:"time"`
+}
+
+// alarmMessage is sent to intelli.<serial>.alarms
+type alarmMessage struct {
+	Alarm string    `json:"alarm"`
+	Time  time.Time `json:"time"`
+}
+
+// presenceMessage is sent to intelli.gateway.<id>.devices
+type presenceMessage struct {
+	Gateway string          `json:"gateway"`
+	Devices []presentDevice `json:"devices"`
+	Time    time.Time       `json:"time"`
+}
+
+type presentDevice struct {
+	ID        string        `json:"id"`
+	Serial    string        `json:"serial"`
+	Type      string        `json:"type"`
+	Health    device.Health `json:"health"`
+	Connected bool          `json:"connected"`
+}
+
+func newPublisher(broker outbox, mgr *device.Manager, gateway string, granular bool) *publisher {
+	return &publisher{
+		broker:    broker,
+		mgr:       mgr,
+		gateway:   gateway,
+		granular:  granular,
+		sequences: map[string]uint64{},
+		functions: map[string]map[string]device.FunctionStatus{},
+	}
+}
+
+// run sends the events received by the subscription until it is closed
+func (p *publisher) run(events *device.Subscription) {
+	for ev := range events.Events() {
+		p.publish(ev)
+	}
+}
+
+func (p *publisher) publish(ev device.Event) {
+	switch {
+	case ev.Type == device.ShadowUpdated:
+		tell.Debugf("device %s updated", ev.DeviceID)
+		p.send(deviceSubject(ev.DeviceID), ev.Shadow)
+		if readings, ok := device.ReadingsOf(ev.Shadow); ok && p.granular {
+			p.publishReadings(ev.DeviceID, readings, ev.Time)
+		}
+	case ev.Type == device.DeviceAttached && ev.Reconnected:
+		p.send(deviceSubject(ev.DeviceID, "reconnected"), ev.Shadow)
+	case ev.Type == device.AlarmRaised:
+		tell.Warnf("device %s raised the %s alarm", ev.DeviceID, ev.Alarm)
+		if p.granular {
+			p.send(deviceSubject(ev.DeviceID, "alarms"), alarmMessage{ev.Alarm, ev.Time})
+		}
+	}
+
+	if !p.granular {
+		return
+	}
+
+	switch ev.Type {
+	case device.DeviceDetached:
+		if ev.Removed {
+			delete(p.sequences, ev.DeviceID)
+			delete(p.functions, ev.DeviceID)
+		}
+		p.publishPresence(ev.Time)
+	case device.DeviceAttached, device.HealthChanged:
+		p.publishPresence(ev.Time)
+	}
+}
+
+// publishReadings sends each metric of a new reading of the device, and each
+// function that has changed since it was last sent
+func (p *publisher) publishReadings(id string, readings device.Readings, at time.Time) {
+	if !readings.Stale && readings.Sequence != p.sequences[id] {
+		p.sequences[id] = readings.Sequence
+		for _, metric := range readings.Metrics {
+			p.send(deviceSubject(id, "metrics", metric.Name), metricMessage{metric, readings.LastSeen})
+		}
+	}
+
+	last := p.functions[id]
+	if last == nil {
+		last = map[string]device.FunctionStatus{}
+		p.functions[id] = last
+	}
+
+	for _, status := range readings.Functions {
+		if previous, ok := last[status.Function]; ok && previous == status {
+			continue
+		}
+
+		last[status.Function] = status
+		p.send(deviceSubject(id, "status", status.Function), statusMessage{status, at})
+	}
+}
+
+// publishPresence sends the devices the gateway has
+func (p *publisher) publishPresence(at time.Time) {
+	msg := presenceMessage{Gateway: p.gateway, Devices: []presentDevice{}, Time: at}
+	for _, d := range p.mgr.Devices() {
+		snapshot := d.Snapshot()
+		msg.Devices = append(msg.Devices, presentDevice{
+			ID:        snapshot.ID,
+			Serial:    snapshot.SerialNumber,
+			Type:      snapshot.DeviceType,
+			Health:    snapshot.Health.State,
+			Connected: snapshot.Connected,
+		})
+	}
+
+	p.send(subject("intelli", "gateway", p.gateway, "devices"), msg)
+}
+
+// send publishes the value as JSON
+func (p *publisher) send(subj string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		tell.Errorf("failed to send %s over NATS: %s", subj, err)
+		return
+	}
+
+	p.broker.Publish(subj, data)
+}
+
+// deviceSubject returns the subject intelli.<serial> of the device with the
+// given ID, followed by the tokens
+func deviceSubject(id string, tokens ...string) string {
+	return subject(append([]string{"intelli", id}, tokens...)...)
+}
+
+// subject joins the tokens into a NATS subject, making each one a single
+// token with device.SubjectToken
+func subject(tokens ...string) string {
+	for i, token := range tokens {
+		tokens[i] = device.SubjectToken(token)
+	}
+	return strings.Join(tokens, ".")
+}
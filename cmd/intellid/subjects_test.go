@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/device"
+	"github.com/AutogrowSystems/go-intelli/simulator"
+)
+
+func TestDeviceSubject(t *testing.T) {
+	subjects := map[string]string{
+		deviceSubject("ASLID06030112"):                       "intelli.ASLID06030112",
+		deviceSubject("usb-1-1.3:2", "reconnected"):          "intelli.usb-1-1_3:2.reconnected",
+		deviceSubject("usb-1-1.3:2", "metrics", "nut.temp"):  "intelli.usb-1-1_3:2.metrics.nut_temp",
+		subject("intelli", "gateway", "pi.local", "devices"): "intelli.gateway.pi_local.devices",
+	}
+
+	for got, expected := range subjects {
+		if got != expected {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+}
+
+// recorder is an outbox that keeps what is sent to it
+type recorder struct {
+	subjects []string
+	messages map[string]string
+}
+
+func newRecorder() *recorder {
+	return &recorder{messages: map[string]string{}}
+}
+
+func (r *recorder) Publish(subj string, data []byte) {
+	r.subjects = append(r.subjects, subj)
+	r.messages[subj] = string(data)
+}
+
+// expect checks that the subjects were sent to since it was last called
+func (r *recorder) expect(t *testing.T, step string, subjects ...string) {
+	t.Helper()
+
+	if strings.Join(r.subjects, " ") != strings.Join(subjects, " ") {
+		t.Errorf("%s: expected %v to be sent, got %v", step, subjects, r.subjects)
+	}
+	r.subjects = nil
+}
+
+func TestPublisherReadings(t *testing.T) {
+	out := newRecorder()
+	p := newPublisher(out, device.NewManager(1, 1), "pi", true)
+	at := time.Unix(1500000000, 0).UTC()
+
+	readings := device.Readings{
+		Metrics: []device.Metric{
+			{Name: "ec", Value: 1.2, Unit: "EC"},
+			{Name: "pH", Value: 5.8, Unit: "pH"},
+		},
+		Functions: []device.FunctionStatus{{Function: "ph", Enabled: true}},
+		Freshness: device.Freshness{LastSeen: 1500000000000, Sequence: 1},
+	}
+
+	all := []string{
+		"intelli.SIMID00001.metrics.ec",
+		"intelli.SIMID00001.metrics.pH",
+		"intelli.SIMID00001.status.ph",
+	}
+
+	p.publishReadings("SIMID00001", readings, at)
+	out.expect(t, "first reading", all...)
+
+	if msg := out.messages["intelli.SIMID00001.metrics.ec"]; msg != `{"name":"ec","value":1.2,"unit":"EC","last_seen":1500000000000}` {
+		t.Errorf("unexpected metric message %s", msg)
+	}
+	if msg := out.messages["intelli.SIMID00001.status.ph"]; msg != `{"function":"ph","active":false,"enabled":true,"force_on":false,"time":"2017-07-14T02:40:00Z"}` {
+		t.Errorf("unexpected status message %s", msg)
+	}
+
+	p.publishReadings("SIMID00001", readings, at)
+	out.expect(t, "same reading")
+
+	readings.Sequence, readings.Stale = 2, true
+	p.publishReadings("SIMID00001", readings, at)
+	out.expect(t, "stale reading")
+
+	readings.Stale = false
+	p.publishReadings("SIMID00001", readings, at)
+	out.expect(t, "new reading", all[:2]...)
+
+	readings.Functions = []device.FunctionStatus{{Function: "ph", Active: true, Enabled: true}}
+	p.publishReadings("SIMID00001", readings, at)
+	out.expect(t, "changed function", all[2])
+
+	p.publish(device.Event{Type: device.DeviceDetached, DeviceID: "SIMID00001", Time: at})
+	p.publishReadings("SIMID00001", readings, at)
+	out.expect(t, "reading after going away", "intelli.gateway.pi.devices")
+
+	p.publish(device.Event{Type: device.DeviceDetached, DeviceID: "SIMID00001", Removed: true, Time: at})
+	p.publishReadings("SIMID00001", readings, at)
+	out.expect(t, "reading after being removed", append([]string{"intelli.gateway.pi.devices"}, all...)...)
+}
+
+func TestPublisherPresence(t *testing.T) {
+	backend, _ := simulator.NewBackend("dose=1")
+	mgr := device.NewManager(1, 1, device.WithBackend(backend))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mgr.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := 0; !mgr.HasDevice("SIMID00001"); i++ {
+		if i == 100 {
+			t.Fatalf("expected the simulated device to be found")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	out := newRecorder()
+	at := time.Unix(1500000000, 0).UTC()
+
+	newPublisher(out, mgr, "pi.local", false).publish(device.Event{Type: device.DeviceAttached, DeviceID: "SIMID00001", Time: at})
+	out.expect(t, "attached without granular")
+
+	p := newPublisher(out, mgr, "pi.local", true)
+	for _, ev := range []device.Event{
+		{Type: device.DeviceAttached, DeviceID: "SIMID00001", Time: at},
+		{Type: device.HealthChanged, DeviceID: "SIMID00001", Time: at},
+		{Type: device.DeviceDetached, DeviceID: "SIMID00001", Time: at},
+	} {
+		p.publish(ev)
+		out.expect(t, string(ev.Type), "intelli.gateway.pi_local.devices")
+	}
+
+	var msg presenceMessage
+	if err := json.Unmarshal([]byte(out.messages["intelli.gateway.pi_local.devices"]), &msg); err != nil {
+		t.Fatalf("failed to decode the presence message: %s", err)
+	}
+
+	if msg.Gateway != "pi.local" || !msg.Time.Equal(at) || len(msg.Devices) != 1 || msg.Devices[0].Serial != "SIMID00001" {
+		t.Errorf("unexpected presence message %+v", msg)
+	}
+}
@@ -0,0 +1,202 @@
+package device
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrDeviceNotFound is returned by the API for serials the manager doesn't know
+var ErrDeviceNotFound = errors.New("device not found")
+
+// resource returns the part of a device served by one of the v1 endpoints
+type resource func(d Device) (interface{}, error)
+
+// attachV1 adds the per-device resources under /v1, which support field
+// selection with ?fields= and conditional requests with If-None-Match
+func (mgr *Manager) attachV1(r *gin.Engine) {
+	v1 := r.Group("/v1")
+
+	v1.GET("/devices", func(c *gin.Context) {
+		devices := []interface{}{}
+		for _, d := range mgr.Devices() {
+			selected, err := selectFields(d.Snapshot(), c.Query("fields"))
+			if err != nil {
+				c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			devices = append(devices, selected)
+		}
+
+		serveJSON(c, devices)
+	})
+
+	v1.GET("/devices/:serial", mgr.serve(func(d Device) (interface{}, error) {
+		return d, nil
+	}))
+
+	v1.GET("/devices/:serial/metrics", mgr.serve(func(d Device) (interface{}, error) {
+		metrics, _, _, err := sections(d.Shadow)
+		return metrics, err
+	}))
+
+	v1.GET("/devices/:serial/config", mgr.serve(func(d Device) (interface{}, error) {
+		_, config, _, err := sections(d.Shadow)
+		return config, err
+	}))
+
+	v1.GET("/devices/:serial/status", mgr.serve(func(d Device) (interface{}, error) {
+		_, _, status, err := sections(d.Shadow)
+		return status, err
+	}))
+
+	v1.GET("/devices/:serial/hid", mgr.serve(func(d Device) (interface{}, error) {
+		return d.HID, nil
+	}))
+}
+
+// serve returns a handler that serves the resource of the device with the
+// serial given in the path
+func (mgr *Manager) serve(get resource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d, found := mgr.FindDevice(c.Param("serial"))
+		if !found {
+			c.AbortWithStatusJSON(404, gin.H{"error": ErrDeviceNotFound.Error()})
+			return
+		}
+
+		v, err := get(d.Snapshot())
+		if err != nil {
+			c.AbortWithStatusJSON(503, gin.H{"error": err.Error()})
+			return
+		}
+
+		selected, err := selectFields(v, c.Query("fields"))
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		serveJSON(c, selected)
+	}
+}
+
+// serveJSON writes the value as JSON along with its ETag, or just the ETag
+// with a 304 when it matches the one the client already has
+func serveJSON(c *gin.Context, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	sum := sha1.Sum(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+
+	if etagMatches(c.Request.Header.Get("If-None-Match"), etag) {
+		c.Status(304)
+		return
+	}
+
+	c.Data(200, "application/json; charset=utf-8", body)
+}
+
+// etagMatches returns true if the If-None-Match header lists the ETag, which
+// is compared weakly as the body is the same whichever way it was encoded
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sections returns the metrics, config and status of the state reported in
+// the shadow
+func sections(shadow interface{}) (metrics, config, status interface{}, err error) {
+	switch s := shadow.(type) {
+	case iDoseShadow:
+		r := s.State.Reported
+		return r.Metrics, r.Config, r.Status, nil
+	case iClimateShadow:
+		r := s.State.Reported
+		return r.Metrics, r.Config, r.Status, nil
+	}
+
+	return nil, nil, nil, ErrNoState
+}
+
+// selectFields returns an object holding only the given comma separated
+// fields of the value.  Nested fields are given as dotted paths like
+// shadow.state.reported.metrics.pH and fields the value doesn't have are left
+// out.  The value is returned as it is when no fields are given.
+func selectFields(v interface{}, fields string) (interface{}, error) {
+	if strings.TrimSpace(fields) == "" {
+		return v, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	selected := map[string]interface{}{}
+	for _, path := range strings.Split(fields, ",") {
+		keys := strings.Split(strings.TrimSpace(path), ".")
+		if value, ok := pick(doc, keys); ok {
+			place(selected, keys, value)
+		}
+	}
+
+	return selected, nil
+}
+
+// pick returns the value at the keys in the document, and false if it
+// doesn't have one
+func pick(doc interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if doc, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
+
+// place puts the value at the keys in the object, adding the objects on the
+// way to it
+func place(object map[string]interface{}, keys []string, value interface{}) {
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			object[key] = child
+		}
+		object = child
+	}
+
+	object[keys[len(keys)-1]] = value
+}
@@ -0,0 +1,147 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+	"github.com/AutogrowSystems/go-intelli/simulator"
+)
+
+// get makes a request to the API with an optional If-None-Match header
+func get(r *gin.Engine, path, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func apiWithIDose(t *testing.T) (*gin.Engine, *Device) {
+	gin.SetMode(gin.TestMode)
+
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithRequestTimeout(100*time.Millisecond))
+	plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.discover()
+
+	r := gin.New()
+	mgr.AttachAPI(r)
+
+	d, _ := mgr.FindDevice("dose-1")
+	return r, d
+}
+
+func TestAPIResources(t *testing.T) {
+	r, d := apiWithIDose(t)
+
+	if w := get(r, "/v1/devices/dose-2", ""); w.Code != http.StatusNotFound || w.Body.String() != `{"error":"device not found"}` {
+		t.Errorf("expected a 404 for an unknown serial, got %d %s", w.Code, w.Body)
+	}
+
+	if w := get(r, "/v1/devices/dose-1/metrics", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 before the state has been read, got %d", w.Code)
+	}
+
+	d.open()
+	d.poll(context.Background(), time.Second)
+
+	w := get(r, "/v1/devices/dose-1/metrics", "")
+	var metrics MetricsIDose
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected the metrics of the device, got %d %s", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/v1/devices/dose-1", "/v1/devices/dose-1/config", "/v1/devices/dose-1/status"} {
+		if w := get(r, path, ""); w.Code != http.StatusOK {
+			t.Errorf("expected %s to be served, got %d", path, w.Code)
+		}
+	}
+
+	var info hid.DeviceInfo
+	w = get(r, "/v1/devices/dose-1/hid", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.SerialNumber != "dose-1" {
+		t.Errorf("expected the HID info of the device, got %s", w.Body)
+	}
+}
+
+func TestAPIFieldsAndETag(t *testing.T) {
+	r, d := apiWithIDose(t)
+	d.open()
+	d.poll(context.Background(), time.Second)
+
+	w := get(r, "/v1/devices/dose-1/metrics?fields=pH,missing", "")
+	if w.Body.String() != `{"pH":0}` {
+		t.Errorf("expected only the pH, got %s", w.Body)
+	}
+
+	w = get(r, "/v1/devices?fields=id,shadow.state.reported.metrics.ec", "")
+	if w.Body.String() != `[{"id":"dose-1","shadow":{"state":{"reported":{"metrics":{"ec":0}}}}}]` {
+		t.Errorf("expected the selected fields of each device, got %s", w.Body)
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag")
+	}
+
+	if w := get(r, "/v1/devices?fields=id,shadow.state.reported.metrics.ec", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected a 304 for an unchanged resource, got %d", w.Code)
+	}
+
+	if w := get(r, "/v1/devices?fields=id", `"other", W/`+etag); w.Code != http.StatusOK {
+		t.Errorf("expected a different selection to have a different ETag, got %d", w.Code)
+	}
+
+	// a new reading changes the freshness of the shadow, and so the ETag
+	etag = get(r, "/v1/devices/dose-1", "").Header().Get("ETag")
+	d.poll(context.Background(), time.Second)
+	if w := get(r, "/v1/devices/dose-1", etag); w.Code != http.StatusOK {
+		t.Errorf("expected a changed resource to be served again, got %d", w.Code)
+	}
+}
+
+func TestAPIConfigRejectsUnwritableFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	backend, _ := simulator.NewBackend("dose=1")
+	mgr := NewManager(1, 1, WithBackend(backend))
+	mgr.discover()
+
+	r := gin.New()
+	mgr.AttachAPI(r)
+
+	d, _ := mgr.FindDevice("SIMID00001")
+	d.open()
+	d.poll(context.Background(), time.Second)
+
+	put := func(patch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("PUT", "/devices/SIMID00001/config", strings.NewReader(patch)))
+		return w
+	}
+
+	for _, patch := range []string{
+		`{"metrics":{"ec":9.9}}`,
+		`{"status":{"status":[{"function":"bogus","force_on":true}]}}`,
+		`{"status":{"set_points":{"ph":5.85}}}`,
+	} {
+		if w := put(patch); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected with a 400, got %d %s", patch, w.Code, w.Body)
+		}
+	}
+
+	if w := put(`{"status":{"set_points":{"ph":5.8}}}`); w.Code != http.StatusOK {
+		t.Errorf("expected the set point to be written, got %d %s", w.Code, w.Body)
+	}
+}
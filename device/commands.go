@@ -0,0 +1,181 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pollWait is how often a refresh checks whether the poll it is waiting on
+// has finished
+const pollWait = 10 * time.Millisecond
+
+// the commands that can be sent to a device
+const (
+	// SetConfigCommand writes a partial reported document to the device, like
+	// PUT /devices/:serial/config
+	SetConfigCommand = "set_config"
+
+	// ForceOnCommand forces a function of the device on or off, given as
+	// {"function": "ph", "force_on": true}
+	ForceOnCommand = "force_on"
+
+	// RefreshCommand reads the state from the device straight away
+	RefreshCommand = "refresh"
+
+	// GetShadowCommand returns the last shadow of the device
+	GetShadowCommand = "get_shadow"
+)
+
+// the codes of the errors returned by commands
+const (
+	CodeNotFound       = "not_found"
+	CodeUnknownCommand = "unknown_command"
+	CodeBadRequest     = "bad_request"
+	CodeUnavailable    = "unavailable"
+	CodeUnsupported    = "unsupported"
+	CodeFailed         = "failed"
+)
+
+// CommandError is why a command failed, with a code that can be acted on
+type CommandError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *CommandError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// CommandReply is the outcome of a command, holding the shadow of the device
+// when it succeeded
+type CommandReply struct {
+	OK     bool          `json:"ok"`
+	Result interface{}   `json:"result,omitempty"`
+	Error  *CommandError `json:"error,omitempty"`
+}
+
+// subjectReplacer replaces the characters that can't be used in a token of a
+// NATS subject
+var subjectReplacer = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_")
+
+// SubjectToken returns the string as a single token of a NATS subject, with
+// the dots, spaces and wildcards in it replaced by underscores.  A device is
+// addressed over NATS by the token of its ID, so one without a serial number
+// like usb-1-1.3:0 is intelli.usb-1-1_3:0, see Manager.FindDeviceBySubject.
+func SubjectToken(s string) string {
+	return subjectReplacer.Replace(s)
+}
+
+// forceOn is the payload of the force_on command
+type forceOn struct {
+	Function string `json:"function"`
+	ForceOn  *bool  `json:"force_on"`
+}
+
+// Command runs the named command on the device with the given ID, or the
+// subject token of it, writing through the same path as the API, and returns
+// the reply to send back to whoever asked for it
+func (mgr *Manager) Command(ctx context.Context, id, name string, payload []byte) CommandReply {
+	d, found := mgr.FindDeviceBySubject(id)
+	if !found {
+		return failed(&CommandError{CodeNotFound, ErrDeviceNotFound.Error()})
+	}
+
+	var result interface{}
+	var err error
+
+	switch name {
+	case SetConfigCommand:
+		result, err = d.ApplyConfig(ctx, payload)
+	case ForceOnCommand:
+		var patch []byte
+		if patch, err = forceOnPatch(payload); err == nil {
+			result, err = d.ApplyConfig(ctx, patch)
+		}
+	case RefreshCommand:
+		if err = d.readNow(ctx); err == nil {
+			result = d.shadow()
+		}
+	case GetShadowCommand:
+		if result = d.shadow(); result == nil {
+			err = ErrNoState
+		}
+	default:
+		err = &CommandError{CodeUnknownCommand, "unknown command " + name}
+	}
+
+	if err != nil {
+		return failed(commandError(err))
+	}
+
+	return CommandReply{OK: true, Result: result}
+}
+
+func failed(err *CommandError) CommandReply {
+	return CommandReply{Error: err}
+}
+
+// commandError gives the error the same meaning the API does
+func commandError(err error) *CommandError {
+	switch err {
+	case ErrNotOpen, ErrNoState:
+		return &CommandError{CodeUnavailable, err.Error()}
+	case ErrUnsupportedDevice:
+		return &CommandError{CodeUnsupported, err.Error()}
+	}
+
+	switch e := err.(type) {
+	case *CommandError:
+		return e
+	case *PatchError:
+		return &CommandError{CodeBadRequest, err.Error()}
+	}
+
+	return &CommandError{CodeFailed, err.Error()}
+}
+
+// forceOnPatch returns the patch forcing the function in the payload on, or
+// off when force_on is false
+func forceOnPatch(payload []byte) ([]byte, error) {
+	var cmd forceOn
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return nil, &CommandError{CodeBadRequest, "bad force_on payload: " + err.Error()}
+	}
+
+	if cmd.Function == "" {
+		return nil, &CommandError{CodeBadRequest, "no function to force on"}
+	}
+
+	on := cmd.ForceOn == nil || *cmd.ForceOn
+	return json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"status": []interface{}{
+				map[string]interface{}{"function": cmd.Function, "force_on": on},
+			},
+		},
+	})
+}
+
+// readNow polls the device straight away, once any poll already running has
+// finished, returning why it failed
+func (d *Device) readNow(ctx context.Context) error {
+	if !d.isOpen() {
+		return ErrNotOpen
+	}
+
+	for !atomic.CompareAndSwapInt32(d.polling, 0, 1) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollWait):
+		}
+	}
+	defer atomic.StoreInt32(d.polling, 0)
+
+	err := d.updateShadow(ctx)
+	d.polled(err)
+	return err
+}
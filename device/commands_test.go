@@ -0,0 +1,61 @@
+package device
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AutogrowSystems/go-intelli/simulator"
+)
+
+func TestCommands(t *testing.T) {
+	backend, _ := simulator.NewBackend("dose=1")
+	mgr := NewManager(1, 1, WithBackend(backend))
+	mgr.discover()
+
+	ctx := context.Background()
+	if reply := mgr.Command(ctx, "SIMID00001", GetShadowCommand, nil); reply.OK || reply.Error.Code != CodeUnavailable {
+		t.Errorf("expected the shadow to be unavailable before the device is read, got %+v", reply)
+	}
+
+	if reply := mgr.Command(ctx, "SIMID00001", RefreshCommand, nil); reply.OK || reply.Error.Code != CodeUnavailable {
+		t.Errorf("expected a closed device not to be refreshed, got %+v", reply)
+	}
+
+	d, _ := mgr.FindDevice("SIMID00001")
+	d.open()
+
+	if reply := mgr.Command(ctx, "SIMID00001", RefreshCommand, nil); !reply.OK || reply.Result == nil {
+		t.Fatalf("expected the device to be refreshed, got %+v", reply.Error)
+	}
+
+	reply := mgr.Command(ctx, "SIMID00001", SetConfigCommand, []byte(`{"status": {"set_points": {"ph": 5.9}}}`))
+	if !reply.OK || reply.Result.(iDoseShadow).State.Reported.Status.SetPoints.Ph != 5.9 {
+		t.Errorf("expected the pH set point to be written, got %+v", reply.Error)
+	}
+
+	reply = mgr.Command(ctx, "SIMID00001", ForceOnCommand, []byte(`{"function": "ph"}`))
+	if !reply.OK {
+		t.Fatalf("expected pH to be forced on, got %+v", reply.Error)
+	}
+
+	reply = mgr.Command(ctx, "SIMID00001", GetShadowCommand, nil)
+	if ph := getStatusIDoseFunctionByName(reply.Result.(iDoseShadow).State.Reported.Status.Status, phFunction); !ph.ForceOn {
+		t.Errorf("expected the shadow to have pH forced on, got %+v", ph)
+	}
+
+	errors := []struct {
+		serial, command, payload, code string
+	}{
+		{"SIMID00002", GetShadowCommand, "", CodeNotFound},
+		{"SIMID00001", "reboot", "", CodeUnknownCommand},
+		{"SIMID00001", SetConfigCommand, `{"status": {"set_points": {"phh": 5.9}}}`, CodeBadRequest},
+		{"SIMID00001", ForceOnCommand, `{"force_on": true}`, CodeBadRequest},
+		{"SIMID00001", ForceOnCommand, `{"function": "nonexistent"}`, CodeBadRequest},
+	}
+
+	for _, e := range errors {
+		if reply := mgr.Command(ctx, e.serial, e.command, []byte(e.payload)); reply.OK || reply.Error.Code != e.code {
+			t.Errorf("expected %s on %s to fail with %s, got %+v", e.command, e.serial, e.code, reply.Error)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+var (
+	// ErrNotOpen is returned when trying to write to a device that is not open
+	ErrNotOpen = errors.New("device is not open")
+
+	// ErrNoState is returned when trying to write to a device that has not
+	// been read yet, as there is no reported state to merge the changes into
+	ErrNoState = errors.New("device state has not been read yet")
+
+	// ErrUnsupportedDevice is returned when trying to write to a device type
+	// that has no known packet layout
+	ErrUnsupportedDevice = errors.New("device type does not support writing")
+
+	errJSONObject = errors.New("patch must be a JSON object")
+)
+
+// PatchError is returned when a partial document can't be merged into the
+// reported state, usually because it is malformed or has unknown fields
+type PatchError struct {
+	Err error
+}
+
+func (e *PatchError) Error() string {
+	return "invalid patch: " + e.Err.Error()
+}
+
+// ApplyConfig merges the given partial reported document over the last state
+// reported by the device and writes the result to the device.  The state is
+// then read back from the device and returned.  The context bounds how long
+// to wait for the device to answer.
+func (d *Device) ApplyConfig(ctx context.Context, patch []byte) (interface{}, error) {
+	d.updating.Lock()
+	defer d.updating.Unlock()
+
+	if !d.isOpen() {
+		return nil, ErrNotOpen
+	}
+
+	if d.shadow() == nil || !d.checkStates() {
+		return nil, ErrNoState
+	}
+
+	switch shadow := d.shadow().(type) {
+	case iDoseShadow:
+		if err := mergeJSON(&shadow.State.Reported, patch); err != nil {
+			return nil, err
+		}
+
+		if err := validatePatch(iDoseLayout, patch); err != nil {
+			return nil, err
+		}
+
+		if err := d.writeDoseData(ctx, shadow); err != nil {
+			return nil, err
+		}
+	case iClimateShadow:
+		if err := mergeJSON(&shadow.State.Reported, patch); err != nil {
+			return nil, err
+		}
+
+		if err := validatePatch(iClimateLayout, patch); err != nil {
+			return nil, err
+		}
+
+		if err := d.writeClimateData(ctx, shadow); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnsupportedDevice
+	}
+
+	if err := d.updateState(ctx); err != nil {
+		return nil, err
+	}
+
+	current := d.parseStates(time.Now().Unix())
+	d.report(current)
+	d.publish(Event{Type: WriteApplied, Patch: json.RawMessage(patch), Shadow: d.shadow()})
+	return current, nil
+}
+
+// validatePatch checks that every value in the patch is written to the
+// device, as the others would be left out without a word
+func validatePatch(l *layout, patch []byte) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(patch, &doc); err != nil {
+		return &PatchError{err}
+	}
+
+	return l.validate(doc)
+}
+
+// mergeJSON applies the JSON patch over the value pointed to by v.  Objects are
+// merged recursively, and arrays of objects are merged element by element
+// (matched on the "function" key where present, else by index) so that a
+// partial status list doesn't reset the functions it leaves out.  Fields that
+// don't exist in v are rejected.
+func mergeJSON(v interface{}, patch []byte) error {
+	var src interface{}
+	if err := json.Unmarshal(patch, &src); err != nil {
+		return &PatchError{err}
+	}
+
+	if _, ok := src.(map[string]interface{}); !ok {
+		return &PatchError{errJSONObject}
+	}
+
+	current, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var dst interface{}
+	if err := json.Unmarshal(current, &dst); err != nil {
+		return err
+	}
+
+	merged, err := json.Marshal(mergeValue(dst, src))
+	if err != nil {
+		return err
+	}
+
+	// decode into a zero value so arrays aren't appended to the old ones
+	rv := reflect.ValueOf(v).Elem()
+	fresh := reflect.New(rv.Type())
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fresh.Interface()); err != nil {
+		return &PatchError{err}
+	}
+
+	rv.Set(fresh.Elem())
+	return nil
+}
+
+func mergeValue(dst, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		d, ok := dst.(map[string]interface{})
+		if !ok || d == nil {
+			return s
+		}
+
+		for k, v := range s {
+			if v == nil {
+				continue
+			}
+			d[k] = mergeValue(d[k], v)
+		}
+		return d
+
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok || !allObjects(s) {
+			return s
+		}
+
+		for i, v := range s {
+			if j := matchElement(d, v, i); j >= 0 {
+				d[j] = mergeValue(d[j], v)
+				continue
+			}
+			d = append(d, v)
+		}
+		return d
+	}
+
+	return src
+}
+
+// matchElement finds the index in list of the element that v should be merged
+// into, or -1 if it should be appended
+func matchElement(list []interface{}, v interface{}, i int) int {
+	obj, _ := v.(map[string]interface{})
+	fn, hasFn := obj["function"]
+	if !hasFn {
+		if i < len(list) {
+			return i
+		}
+		return -1
+	}
+
+	for j, el := range list {
+		if elObj, ok := el.(map[string]interface{}); ok && elObj["function"] == fn {
+			return j
+		}
+	}
+
+	return -1
+}
+
+func allObjects(list []interface{}) bool {
+	for _, v := range list {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
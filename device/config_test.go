@@ -0,0 +1,58 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestMergeJSONKeepsUnpatchedFields(t *testing.T) {
+	reported := ReportedIDose{
+		Status: StatusIDose{
+			SetPoints: SetPointsIDose{Nutrient: 100, NutrientNight: 150, Ph: 5.8},
+			Status: []StatusStatusIDose{
+				{Function: nutrientDosingFunction, Enabled: true},
+				{Function: phFunction, Enabled: true},
+			},
+		},
+	}
+
+	patch := []byte(`{"status":{"set_points":{"ph":6.1},"status":[{"function":"ph","force_on":true}]}}`)
+	if err := mergeJSON(&reported, patch); err != nil {
+		t.Fatalf("failed to merge: %s", err)
+	}
+
+	if reported.Status.SetPoints.Ph != 6.1 {
+		t.Errorf("expected pH set point to be 6.1, got %v", reported.Status.SetPoints.Ph)
+	}
+
+	if reported.Status.SetPoints.Nutrient != 100 || reported.Status.SetPoints.NutrientNight != 150 {
+		t.Errorf("expected nutrient set points to be untouched, got %+v", reported.Status.SetPoints)
+	}
+
+	if len(reported.Status.Status) != 2 {
+		t.Fatalf("expected 2 status entries, got %d", len(reported.Status.Status))
+	}
+
+	ph := getStatusIDoseFunctionByName(reported.Status.Status, phFunction)
+	if !ph.Enabled || !ph.ForceOn {
+		t.Errorf("expected pH to be enabled and forced on, got %+v", ph)
+	}
+
+	nut := getStatusIDoseFunctionByName(reported.Status.Status, nutrientDosingFunction)
+	if !nut.Enabled || nut.ForceOn {
+		t.Errorf("expected nutrient dosing to be untouched, got %+v", nut)
+	}
+}
+
+func TestMergeJSONRejectsUnknownFields(t *testing.T) {
+	reported := ReportedIDose{}
+
+	err := mergeJSON(&reported, []byte(`{"status":{"set_points":{"phh":6.1}}}`))
+	if _, ok := err.(*PatchError); !ok {
+		t.Errorf("expected a patch error for an unknown field, got %v", err)
+	}
+
+	err = mergeJSON(&reported, []byte(`[1, 2]`))
+	if _, ok := err.(*PatchError); !ok {
+		t.Errorf("expected a patch error for a non object patch, got %v", err)
+	}
+}
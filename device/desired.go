@@ -0,0 +1,359 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/util/tell"
+)
+
+const maxReconcileBackoff = 5 * time.Minute
+
+// flushTimeout is how long writing the pending desired state to a device can
+// take when it is being stopped
+const flushTimeout = 10 * time.Second
+
+// ReconcileStatus shows how far the device is from converging on the desired state
+type ReconcileStatus struct {
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	GaveUp    bool   `json:"gave_up"`
+	InSync    bool   `json:"in_sync"`
+}
+
+// SetDesired merges the given partial reported document into the desired state
+// of the device.  The reconciler will then keep writing the difference between
+// the desired and reported states to the device until they match.
+func (d *Device) SetDesired(patch []byte) error {
+	var src interface{}
+	if err := json.Unmarshal(patch, &src); err != nil {
+		return &PatchError{err}
+	}
+
+	d.desiredLock.Lock()
+	merged := mergeValue(copyDocument(d.desired), src)
+	d.desiredLock.Unlock()
+
+	desired, ok := merged.(map[string]interface{})
+	if !ok {
+		return &PatchError{errJSONObject}
+	}
+
+	if err := d.validateDesired(desired); err != nil {
+		return err
+	}
+
+	d.desiredLock.Lock()
+	d.desired = desired
+	d.Reconcile = ReconcileStatus{}
+	d.desiredLock.Unlock()
+
+	d.refresh()
+
+	select {
+	case d.desiredChanged <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// ClearDesired removes the desired state so the reconciler leaves the device alone
+func (d *Device) ClearDesired() {
+	d.desiredLock.Lock()
+	d.desired = nil
+	d.Reconcile = ReconcileStatus{}
+	d.desiredLock.Unlock()
+
+	d.refresh()
+}
+
+// validateDesired checks that the desired document fits the reported one, and
+// that it only holds values that are written to the device, as the others
+// would never be reported and the delta would never clear
+func (d *Device) validateDesired(desired map[string]interface{}) error {
+	patch, err := json.Marshal(desired)
+	if err != nil {
+		return &PatchError{err}
+	}
+
+	var l *layout
+	switch d.DeviceType {
+	case IntelliDoseDeviceType:
+		l, err = iDoseLayout, mergeJSON(&ReportedIDose{}, patch)
+	case IntelliClimateDeviceType:
+		l, err = iClimateLayout, mergeJSON(&ReportedIClimate{}, patch)
+	default:
+		return ErrUnsupportedDevice
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return l.validate(desired)
+}
+
+// withDesired sets the desired and delta sections on the given shadow
+func (d *Device) withDesired(shadow interface{}) interface{} {
+	d.desiredLock.Lock()
+	desired := copyDocument(d.desired)
+	d.desiredLock.Unlock()
+
+	switch s := shadow.(type) {
+	case iDoseShadow:
+		s.State.Desired = desired
+		s.State.Delta = computeDelta(desired, s.State.Reported)
+		return s
+	case iClimateShadow:
+		s.State.Desired = desired
+		s.State.Delta = computeDelta(desired, s.State.Reported)
+		return s
+	}
+
+	return shadow
+}
+
+// currentDelta returns the difference between the desired state and the last
+// reported state of the device
+func (d *Device) currentDelta() map[string]interface{} {
+	switch s := d.withDesired(d.shadow()).(type) {
+	case iDoseShadow:
+		return s.State.Delta
+	case iClimateShadow:
+		return s.State.Delta
+	}
+
+	return nil
+}
+
+// computeDelta returns the parts of the desired document that differ from the
+// reported state, or nil if there are no differences
+func computeDelta(desired map[string]interface{}, reported interface{}) map[string]interface{} {
+	if len(desired) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(reported)
+	if err != nil {
+		return nil
+	}
+
+	var current interface{}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return nil
+	}
+
+	delta, _ := diffValue(desired, current).(map[string]interface{})
+	if len(delta) == 0 {
+		return nil
+	}
+
+	return delta
+}
+
+// diffValue returns the parts of want that differ from have, or nil when they match
+func diffValue(want, have interface{}) interface{} {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		h, ok := have.(map[string]interface{})
+		if !ok {
+			return w
+		}
+
+		delta := map[string]interface{}{}
+		for k, v := range w {
+			if diff := diffValue(v, h[k]); diff != nil {
+				delta[k] = diff
+			}
+		}
+
+		if len(delta) == 0 {
+			return nil
+		}
+		return delta
+
+	case []interface{}:
+		h, ok := have.([]interface{})
+		if !ok || !allObjects(w) {
+			if reflect.DeepEqual(w, have) {
+				return nil
+			}
+			return w
+		}
+
+		var delta []interface{}
+		for i, v := range w {
+			j := matchElement(h, v, i)
+			if j < 0 {
+				delta = append(delta, v)
+				continue
+			}
+
+			diff, _ := diffValue(v, h[j]).(map[string]interface{})
+			if len(diff) == 0 {
+				continue
+			}
+
+			// keep the key the element is matched on so the delta can be merged
+			if fn, ok := v.(map[string]interface{})["function"]; ok {
+				diff["function"] = fn
+			}
+			delta = append(delta, diff)
+		}
+
+		if len(delta) == 0 {
+			return nil
+		}
+		return delta
+	}
+
+	if reflect.DeepEqual(want, have) {
+		return nil
+	}
+	return want
+}
+
+func copyDocument(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+
+	var cp map[string]interface{}
+	json.Unmarshal(data, &cp)
+	return cp
+}
+
+// reconcile keeps writing the delta between the desired and reported state to
+// the device until they match.  Each failed attempt backs off exponentially
+// and after the given number of retries it gives up until the desired state
+// is changed again.  It returns when the stop channel is closed, after making
+// a last attempt to write the delta if there is one.
+func (d *Device) reconcile(stop <-chan struct{}, retries int, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	attempts := 0
+	wait := interval
+
+	for {
+		select {
+		case <-stop:
+			d.flushDesired()
+			return
+		case <-d.desiredChanged:
+			attempts = 0
+		case <-time.After(wait):
+		}
+
+		wait = interval
+
+		if d.shadow() == nil {
+			continue
+		}
+
+		delta := d.currentDelta()
+		if len(delta) == 0 {
+			d.setReconcileStatus(attempts, nil, false, true)
+			attempts = 0
+			continue
+		}
+
+		if attempts >= retries {
+			continue
+		}
+
+		patch, err := json.Marshal(delta)
+		if err != nil {
+			tell.Errorf("failed to encode delta for %s: %s", d.SerialNumber, err)
+			continue
+		}
+
+		tell.Debugf("reconciling %s with delta %s", d.SerialNumber, patch)
+
+		_, err = d.ApplyConfig(ctx, patch)
+		if err == ErrNotOpen || err == ErrNoState {
+			// the device isn't reachable right now, try again without using
+			// up an attempt
+			continue
+		}
+
+		attempts++
+		if err == nil && len(d.currentDelta()) == 0 {
+			tell.Infof("device %s converged on desired state after %d attempts", d.SerialNumber, attempts)
+			d.setReconcileStatus(attempts, nil, false, true)
+			attempts = 0
+			continue
+		}
+
+		if err != nil {
+			tell.Errorf("failed to reconcile %s: %s", d.SerialNumber, err)
+		}
+
+		if attempts >= retries {
+			tell.Errorf("giving up reconciling %s after %d attempts", d.SerialNumber, attempts)
+			d.setReconcileStatus(attempts, err, true, false)
+			continue
+		}
+
+		d.setReconcileStatus(attempts, err, false, false)
+
+		wait = interval << uint(attempts)
+		if wait > maxReconcileBackoff {
+			wait = maxReconcileBackoff
+		}
+	}
+}
+
+// flushDesired writes the delta between the desired and reported state to the
+// device once, if it is open
+func (d *Device) flushDesired() {
+	if !d.isOpen() || d.shadow() == nil {
+		return
+	}
+
+	delta := d.currentDelta()
+	if len(delta) == 0 {
+		return
+	}
+
+	patch, err := json.Marshal(delta)
+	if err != nil {
+		tell.Errorf("failed to encode delta for %s: %s", d.SerialNumber, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	tell.Infof("flushing delta %s to %s", patch, d.SerialNumber)
+	_, err = d.ApplyConfig(ctx, patch)
+	tell.IfErrorf(err, "failed to flush desired state to %s", d.SerialNumber)
+}
+
+func (d *Device) setReconcileStatus(attempts int, err error, gaveUp, inSync bool) {
+	d.desiredLock.Lock()
+	defer d.desiredLock.Unlock()
+
+	d.Reconcile = ReconcileStatus{
+		Attempts: attempts,
+		GaveUp:   gaveUp,
+		InSync:   inSync,
+	}
+
+	if err != nil {
+		d.Reconcile.LastError = err.Error()
+	}
+}
@@ -0,0 +1,74 @@
+package device
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+func TestComputeDelta(t *testing.T) {
+	reported := ReportedIDose{
+		Status: StatusIDose{
+			SetPoints: SetPointsIDose{Nutrient: 100, Ph: 5.8},
+			Status: []StatusStatusIDose{
+				{Function: nutrientDosingFunction, Enabled: true},
+				{Function: phFunction, Enabled: true},
+			},
+		},
+	}
+
+	var desired map[string]interface{}
+	json.Unmarshal([]byte(`{"status":{"set_points":{"nutrient":100,"ph":6.1},"status":[{"function":"ph","enabled":true,"force_on":true},{"function":"Nutrient Dosing","enabled":true}]}}`), &desired)
+
+	delta := computeDelta(desired, reported)
+	data, _ := json.Marshal(delta)
+	expected := `{"status":{"set_points":{"ph":6.1},"status":[{"force_on":true,"function":"ph"}]}}`
+	if string(data) != expected {
+		t.Errorf("expected delta %s, got %s", expected, data)
+	}
+
+	// applying the delta should leave nothing left to do
+	if err := mergeJSON(&reported, data); err != nil {
+		t.Fatalf("failed to merge delta: %s", err)
+	}
+
+	if delta := computeDelta(desired, reported); delta != nil {
+		t.Errorf("expected no delta after merging, got %v", delta)
+	}
+}
+
+func TestSetFirstDesired(t *testing.T) {
+	d := NewDevice("test", IntelliDoseDeviceType, "IntelliDose", hid.DeviceInfo{})
+	if err := d.SetDesired([]byte(`{"status":{"set_points":{"ph":6.1}}}`)); err != nil {
+		t.Errorf("failed to set the first desired state: %s", err)
+	}
+}
+
+func TestSetDesiredRejectsUnwritableValues(t *testing.T) {
+	d := NewDevice("test", IntelliDoseDeviceType, "IntelliDose", hid.DeviceInfo{})
+
+	for _, patch := range []string{
+		`{"metrics":{"pH":6.1}}`,
+		`{"config":{"general":{"firmware":2.5}}}`,
+		`{"status":{"status":[{"function":"ph","active":true}]}}`,
+		`{"status":{"set_points":{"ph":6.15}}}`,
+		`{"status":{"set_points":{"ph":30}}}`,
+		`{"timestamp":1}`,
+	} {
+		err := d.SetDesired([]byte(patch))
+		if _, ok := err.(*PatchError); !ok {
+			t.Errorf("expected %s to be rejected, got %v", patch, err)
+		}
+	}
+
+	for _, patch := range []string{
+		`{"status":{"status":[{"function":"ph","force_on":true}]}}`,
+		`{"status":{"status":[{"function":"irrigation","enabled":true}]}}`,
+		`{"config":{"times":{"day_start":360}}}`,
+	} {
+		if err := d.SetDesired([]byte(patch)); err != nil {
+			t.Errorf("expected %s to be accepted, got %s", patch, err)
+		}
+	}
+}
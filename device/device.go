@@ -1,8 +1,12 @@
 package device
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AutogrowSystems/go-intelli/hid"
@@ -29,6 +33,22 @@ const (
 	IntelliClimateDeviceType = "iclimate"
 )
 
+const (
+	defaultRequestTimeout = 2 * time.Second
+	defaultRequestRetries = 2
+
+	// requestDelay gives the device time to settle between requests
+	requestDelay = 100 * time.Millisecond
+)
+
+var (
+	// ErrNoResponse is returned when a device doesn't answer a request, even
+	// after retrying it
+	ErrNoResponse = errors.New("device did not respond")
+
+	errRequestTimeout = errors.New("request timed out")
+)
+
 var validDevices = []string{
 	IntelliDoseDeviceName,
 	IntelliClimateDeviceName,
@@ -42,6 +62,8 @@ func isValidDevice(name string) bool {
 
 // Device represents an Intelli device
 type Device struct {
+	// ID identifies the device across reconnections, see hid.DeviceInfo.Identity
+	ID            string `json:"id"`
 	SerialNumber  string `json:"serial"`
 	Name          string `json:"name"`
 	DeviceType    string `json:"type"`
@@ -51,15 +73,46 @@ type Device struct {
 	m             *sync.Mutex
 	readWriteLock *sync.Mutex
 	updating      *sync.Mutex
-	Shadow        interface{} `json:"shadow"`
-	IsOpen        bool        `json:"is_open"`
-	onUpdateFunc  func(Device)
+
+	// state guards the fields below that are written while the device is
+	// in use, along with the HID device and its handle
+	state     *sync.RWMutex
+	Shadow    interface{}  `json:"shadow"`
+	IsOpen    bool         `json:"is_open"`
+	Connected bool         `json:"connected"`
+	Health    HealthStatus `json:"health"`
+	freshness Freshness
+
+	Stats  *FrameStats `json:"stats"`
+	events *Bus
+	alarms map[string]bool
+
+	backend        hid.Backend
+	requestTimeout time.Duration
+	requestRetries int
+	degradeAfter   int
+	staleAfter     int
+	polling        *int32
+	disconnectedAt time.Time
+
+	desired        map[string]interface{}
+	desiredLock    *sync.Mutex
+	desiredChanged chan struct{}
+	stopReconcile  chan struct{}
+	stopOnce       *sync.Once
+	Reconcile      ReconcileStatus `json:"reconcile"`
 }
 
 // NewDevice creates a new Intelli device from the given serial, type (dose or climate), name
 // and HID device info
 func NewDevice(sn, dtype, name string, hiddev hid.DeviceInfo) *Device {
+	id := sn
+	if id == "" {
+		id = hiddev.Identity()
+	}
+
 	return &Device{
+		ID:            id,
 		SerialNumber:  sn,
 		DeviceType:    dtype,
 		hidDevice:     &hidDevice{hidDevice: hiddev},
@@ -68,6 +121,23 @@ func NewDevice(sn, dtype, name string, hiddev hid.DeviceInfo) *Device {
 		m:             &sync.Mutex{},
 		readWriteLock: &sync.Mutex{},
 		updating:      &sync.Mutex{},
+		state:         &sync.RWMutex{},
+		Stats:         &FrameStats{},
+		Connected:     true,
+		Health:        newHealthStatus(),
+		events:        NewBus(),
+
+		backend:        hid.System,
+		requestTimeout: defaultRequestTimeout,
+		requestRetries: defaultRequestRetries,
+		degradeAfter:   defaultDegradeAfter,
+		staleAfter:     defaultStaleAfter,
+		polling:        new(int32),
+
+		desiredLock:    &sync.Mutex{},
+		desiredChanged: make(chan struct{}, 1),
+		stopReconcile:  make(chan struct{}),
+		stopOnce:       &sync.Once{},
 	}
 }
 
@@ -85,28 +155,159 @@ type States struct {
 }
 
 func (d *Device) update(shadow interface{}) {
-	d.Shadow = shadow
-	d.onUpdated()
+	if shadow == nil {
+		return
+	}
+
+	d.state.Lock()
+	d.Shadow = d.stamp(d.withDesired(shadow))
+	shadow = d.Shadow
+	d.state.Unlock()
+
+	d.publish(Event{Type: ShadowUpdated, Shadow: shadow})
+}
+
+// refresh applies the desired state to the last shadow again
+func (d *Device) refresh() {
+	d.state.Lock()
+	if d.Shadow == nil {
+		d.state.Unlock()
+		return
+	}
+	d.Shadow = d.stamp(d.withDesired(d.Shadow))
+	shadow := d.Shadow
+	d.state.Unlock()
+
+	d.publish(Event{Type: ShadowUpdated, Shadow: shadow})
 }
 
-func (d *Device) onUpdated() {
-	go d.onUpdateFunc(*d)
+// report updates the shadow with the state just read from the device, and
+// raises any alarms that have gone off since it was last read
+func (d *Device) report(shadow interface{}) {
+	if shadow == nil {
+		return
+	}
+
+	d.state.Lock()
+	d.freshness.seen(time.Now())
+	d.state.Unlock()
+
+	d.update(shadow)
+	d.publishAlarms(d.shadow())
 }
 
-// OnUpdate adds a single callback function to be called whenever the devices
-// attributes are updated
+// shadow returns the last shadow of the device
+func (d *Device) shadow() interface{} {
+	d.state.RLock()
+	defer d.state.RUnlock()
+
+	return d.Shadow
+}
+
+// isOpen returns true if the device is open
+func (d *Device) isOpen() bool {
+	d.state.RLock()
+	defer d.state.RUnlock()
+
+	return d.IsOpen
+}
+
+// connected returns true if the device hasn't gone away
+func (d *Device) connected() bool {
+	d.state.RLock()
+	defer d.state.RUnlock()
+
+	return d.Connected
+}
+
+func (d *Device) setConnected(connected bool) {
+	d.state.Lock()
+	defer d.state.Unlock()
+
+	d.Connected = connected
+}
+
+// Snapshot returns a copy of the exported fields of the device, which can be
+// read while the device is being used
+func (d *Device) Snapshot() Device {
+	d.state.RLock()
+	snapshot := Device{
+		ID:           d.ID,
+		SerialNumber: d.SerialNumber,
+		Name:         d.Name,
+		DeviceType:   d.DeviceType,
+		HID:          d.HID,
+		Shadow:       d.Shadow,
+		IsOpen:       d.IsOpen,
+		Connected:    d.Connected,
+		Health:       d.Health.copy(),
+	}
+	d.state.RUnlock()
+
+	stats := d.Stats.Snapshot()
+	snapshot.Stats = &stats
+
+	d.desiredLock.Lock()
+	snapshot.Reconcile = d.Reconcile
+	d.desiredLock.Unlock()
+
+	return snapshot
+}
+
+// MarshalJSON encodes a snapshot of the device
+func (d *Device) MarshalJSON() ([]byte, error) {
+	type device Device
+	snapshot := device(d.Snapshot())
+	return json.Marshal(snapshot)
+}
+
+// Events returns the bus the events of the device are published on, which is
+// shared by all the devices of a manager
+func (d *Device) Events() *Bus {
+	return d.events
+}
+
+// OnUpdate adds a callback function to be called, in order, whenever the
+// devices attributes are updated
 func (d *Device) OnUpdate(callback func(Device)) {
-	d.onUpdateFunc = callback
+	onEvent(d.events.Subscribe(callbackBuffer, Block), func(ev Event) {
+		if ev.Type == ShadowUpdated && ev.DeviceID == d.ID {
+			callback(ev.Device)
+		}
+	})
+}
+
+// stopReconciling stops the reconciler of the device, which can be done more
+// than once
+func (d *Device) stopReconciling() {
+	d.stopOnce.Do(func() { close(d.stopReconcile) })
 }
 
+// close closes the device if it is open
 func (d *Device) close() error {
+	d.state.Lock()
+	if !d.IsOpen {
+		d.state.Unlock()
+		return nil
+	}
 	d.IsOpen = false
-	d.hidDevice.hidDeviceImpl.Close()
+	impl := d.hidDevice.hidDeviceImpl
+	d.state.Unlock()
+
+	impl.Close()
 	return nil
 }
 
 func (d *Device) open() error {
-	dev, err := d.hidDevice.hidDevice.Open()
+	d.state.RLock()
+	info := d.hidDevice.hidDevice
+	d.state.RUnlock()
+
+	dev, err := d.backend.Open(&info)
+
+	d.state.Lock()
+	defer d.state.Unlock()
+
 	if err != nil {
 		d.IsOpen = false
 		return err
@@ -117,11 +318,167 @@ func (d *Device) open() error {
 	return nil
 }
 
-func (d *Device) sentRequest(request []byte) ([]byte, error) {
+// handle returns the handle of the open HID device
+func (d *Device) handle() hid.Device {
+	d.state.RLock()
+	defer d.state.RUnlock()
+
+	return d.hidDevice.hidDeviceImpl
+}
+
+// rebind points the device at the info it was last found with, closing it
+// if it has moved to a new path so that it is reopened there.  It returns
+// true if the path changed.
+func (d *Device) rebind(info hid.DeviceInfo) bool {
+	d.state.RLock()
+	moved := info.Path != d.hidDevice.hidDevice.Path
+	d.state.RUnlock()
+
+	if !moved {
+		return false
+	}
+
+	d.close()
+
+	d.state.Lock()
+	d.hidDevice.hidDevice = info
+	d.HID = info
+	d.state.Unlock()
+	return true
+}
+
+// sentRequest writes the request to the device and returns the response to
+// it.  Reports that don't answer the request are dropped, and the request is
+// retried when the response is corrupt or doesn't arrive in time.
+func (d *Device) sentRequest(ctx context.Context, request []byte) ([]byte, error) {
 	d.m.Lock()
 	defer d.m.Unlock()
-	time.Sleep(time.Millisecond * time.Duration(100))
-	err := d.hidDevice.hidDeviceImpl.Write(request)
-	tell.IfErrorf(err, "Error during sending data to device : ", d.SerialNumber)
-	return <-d.hidDevice.hidDeviceImpl.ReadCh(), err
+
+	var err error
+	for attempt := 0; attempt <= d.requestRetries; attempt++ {
+		if attempt > 0 {
+			tell.Debugf("retrying %s request to %s after: %s", request[1:3], d.SerialNumber, err)
+		}
+
+		var frame Frame
+		frame, err = d.exchange(ctx, request)
+		switch {
+		case err == nil:
+			return frame, nil
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err == errRequestTimeout, isFrameError(err):
+			continue
+		default:
+			return nil, err
+		}
+	}
+
+	if err == errRequestTimeout {
+		return nil, ErrNoResponse
+	}
+
+	return nil, err
+}
+
+// sizeRequest pads the request with zeros to the length of the output report
+// given by the device's report descriptor, after the report number in front
+// of it, as some devices drop output reports that are too short
+func (d *Device) sizeRequest(request []byte) []byte {
+	d.state.RLock()
+	length := 1 + int(d.hidDevice.hidDevice.OutputReportLength)
+	d.state.RUnlock()
+
+	if len(request) >= length {
+		return request
+	}
+
+	sized := make([]byte, length)
+	copy(sized, request)
+	return sized
+}
+
+// exchange writes the request once and waits for the response to it
+func (d *Device) exchange(ctx context.Context, request []byte) (Frame, error) {
+	impl := d.handle()
+	reports := impl.ReadCh()
+
+	// throw away reports that arrived after an earlier request gave up
+	// waiting for them, so they can't be taken as the answer to this one
+	for drained := false; !drained; {
+		select {
+		case _, ok := <-reports:
+			drained = !ok
+		default:
+			drained = true
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(requestDelay):
+	}
+
+	if err := impl.Write(d.sizeRequest(request)); err != nil {
+		tell.Errorf("Error during sending data to device %s: %s", d.SerialNumber, err)
+		return nil, err
+	}
+
+	defer atomic.StoreUint64(&d.Stats.Overflows, impl.Overflows())
+
+	readCtx, cancel := context.WithTimeout(ctx, d.requestTimeout)
+	defer cancel()
+
+	// skip the report ID at the start of the request
+	command := request[1:3]
+
+	for {
+		// reading with Read rather than from the channel means no responses
+		// are dropped while the device waits for them to be read
+		response, err := impl.Read(readCtx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			if err == context.DeadlineExceeded {
+				atomic.AddUint64(&d.Stats.Timeouts, 1)
+				return nil, errRequestTimeout
+			}
+
+			return nil, err
+		}
+
+		frame, err := NewFrame(response, command)
+		d.Stats.count(err)
+
+		if err == ErrUnexpectedCommand {
+			tell.Debugf("dropped stale %s report from %s", response[:2], d.SerialNumber)
+			continue
+		}
+
+		if err != nil {
+			tell.Errorf("dropped response to %s from %s: %s: % x", command, d.SerialNumber, err, response)
+			return nil, err
+		}
+
+		return frame, nil
+	}
+}
+
+// poll updates the shadow from the device, giving up when the timeout passes.
+// It does nothing if the last poll of the device is still running so that
+// polls of a wedged device don't pile up.
+func (d *Device) poll(ctx context.Context, timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(d.polling, 0, 1) {
+		tell.Warnf("skipping poll of %s as the last one hasn't finished", d.SerialNumber)
+		return
+	}
+	defer atomic.StoreInt32(d.polling, 0)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d.polled(d.updateShadow(ctx))
 }
@@ -1,13 +1,12 @@
 package device
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
-	"strconv"
 	"time"
 
-	"github.com/AutogrowSystems/go-intelli/util/encoding"
 	"github.com/AutogrowSystems/go-intelli/util/tell"
 	"github.com/snksoft/crc"
 )
@@ -123,7 +122,9 @@ type iClimateShadow struct {
 
 // StateIClimate represents the State data structure from an IntelliClimate packet
 type StateIClimate struct {
-	Reported ReportedIClimate `json:"reported"`
+	Reported ReportedIClimate       `json:"reported"`
+	Desired  map[string]interface{} `json:"desired,omitempty"`
+	Delta    map[string]interface{} `json:"delta,omitempty"`
 }
 
 // ReportedIClimate represents the Reported data structure from an IntelliClimate packet
@@ -135,6 +136,7 @@ type ReportedIClimate struct {
 	Device    string          `json:"device"`
 	Timestamp int64           `json:"timestamp"`
 	Connected bool            `json:"connected"`
+	Freshness
 }
 
 // ConfigIClimate represents the Config data structure from an IntelliClimate packet
@@ -492,7 +494,9 @@ type iDoseShadow struct {
 
 // StateIDose represents the State data structure from an IntelliDose packet
 type StateIDose struct {
-	Reported ReportedIDose `json:"reported"`
+	Reported ReportedIDose          `json:"reported"`
+	Desired  map[string]interface{} `json:"desired,omitempty"`
+	Delta    map[string]interface{} `json:"delta,omitempty"`
 }
 
 // ReportedIDose represents the Reported data structure from an IntelliDose packet
@@ -504,6 +508,7 @@ type ReportedIDose struct {
 	Device    string       `json:"device"`
 	Timestamp int64        `json:"timestamp"`
 	Connected bool         `json:"connected"`
+	Freshness
 }
 
 // ConfigIDose represents the Config data structure from an IntelliDose packet
@@ -656,30 +661,50 @@ type GeneralIDose struct {
 	Firmware   float64 `json:"firmware"`
 }
 
-func (device *Device) updateShadow() {
+// updateShadow reads the state from the device and updates the shadow with
+// it, returning the error if it couldn't be read
+func (device *Device) updateShadow(ctx context.Context) error {
 	device.updating.Lock()
 	defer device.updating.Unlock()
 
 	var currentState interface{}
-	err := device.updateState()
-	if err != nil && !device.checkStates() {
-		device.IsOpen = false
+	err := device.updateState(ctx)
+	switch {
+	case err == context.Canceled:
+		// stopped part way through, most likely because of a shutdown
+		tell.Debugf("stopped updating %s: %s", device.SerialNumber, err)
+		return err
+	case err != nil:
+		// the last good shadow is kept.  A device that is only slow to answer
+		// or sent a corrupt packet stays open, but one without a full set of
+		// states to fall back on is closed to be opened again.
+		keepOpen := isFrameError(err) || err == context.DeadlineExceeded || err == ErrNoResponse
+		if !keepOpen && !device.checkStates() {
+			device.close()
+		}
+
 		tell.Errorf("failed to update device state: %s", err)
-		return
+		device.publish(Event{Type: PollFailed, Error: err.Error(), Shadow: device.shadow()})
+		return err
 	}
 
-	timestamp := time.Now().Unix()
+	currentState = device.parseStates(time.Now().Unix())
+	device.report(currentState)
+	return nil
+}
+
+// parseStates builds a shadow for the device type from the last state packets
+func (device *Device) parseStates(timestamp int64) interface{} {
 	switch device.DeviceType {
 	case IntelliDoseDeviceType:
-		currentState = parseByteResponseForIDose(device.states.d0State, device.states.d1State, device.states.d2State, device.SerialNumber, timestamp)
+		return parseByteResponseForIDose(device.states.d0State, device.states.d1State, device.states.d2State, device.SerialNumber, timestamp)
 	case IntelliClimateDeviceType:
-		currentState = parseByteResponseForIClimate(device.states.d0State, device.states.d1State, device.states.d2State, device.states.d3State, device.SerialNumber, timestamp)
+		return parseByteResponseForIClimate(device.states.d0State, device.states.d1State, device.states.d2State, device.states.d3State, device.SerialNumber, timestamp)
 	}
-
-	device.update(currentState)
+	return nil
 }
 
-func (device Device) checkStates() bool {
+func (device *Device) checkStates() bool {
 	if len(device.states.d0State) != requestLength || len(device.states.d1State) != requestLength || len(device.states.d2State) != requestLength {
 		return false
 	}
@@ -691,1120 +716,109 @@ func (device Device) checkStates() bool {
 	return true
 }
 
-func (device Device) updateState() error {
+func (device *Device) updateState(ctx context.Context) error {
 	device.readWriteLock.Lock()
 	defer device.readWriteLock.Unlock()
-	var err error
-	deviceType := device.DeviceType
-	device.states.d0State, err = device.sentRequest(d0Request)
-	if err != nil {
-		return err
-	}
-	tell.Debugf(fmt.Sprintf("%s D0: % x", device.SerialNumber, device.states.d0State))
-	device.states.d1State, err = device.sentRequest(d1Request)
-	if err != nil {
-		return err
-	}
-	tell.Debugf(fmt.Sprintf("%s D1: % x", device.SerialNumber, device.states.d1State))
-	device.states.d2State, err = device.sentRequest(d2Request)
-	if err != nil {
-		return err
+
+	requests := [][]byte{d0Request, d1Request, d2Request}
+	if device.DeviceType == IntelliClimateDeviceType {
+		requests = append(requests, d3Request)
 	}
-	tell.Debugf(fmt.Sprintf("%s D2: % x", device.SerialNumber, device.states.d2State))
-	if deviceType == IntelliClimateDeviceType {
-		device.states.d3State, err = device.sentRequest(d3Request)
+
+	packets := make([][]byte, len(requests))
+	for i, request := range requests {
+		frame, err := device.sentRequest(ctx, request)
 		if err != nil {
 			return err
 		}
-		tell.Debugf(fmt.Sprintf("%s D3: % x", device.SerialNumber, device.states.d3State))
+		tell.Debugf(fmt.Sprintf("%s D%d: % x", device.SerialNumber, i, frame))
+		packets[i] = frame
 	}
-	return nil
-}
 
-func (device Device) writeDoseData(state iDoseShadow) {
-	device.readWriteLock.Lock()
-	defer device.readWriteLock.Unlock()
-	d0State := device.states.d0State
-
-	s0Request := device.states.d1State
-	prepareS0RequestForIDose(&d0State, &s0Request, state)
-	s0Request = append([]byte{0x00}, s0Request...)
-	device.sentRequest(s0Request)
-
-	tell.Debugf(fmt.Sprintf("%s S0 iDose request: % x", device.SerialNumber, s0Request))
-
-	s1Request := device.states.d2State
-	prepareS1RequestForIDose(&d0State, &s1Request, state)
-	s1Request = append([]byte{0x00}, s1Request...)
-	device.sentRequest(s1Request)
-
-	tell.Debugf(fmt.Sprintf("%s S1 iDose request: % x", device.SerialNumber, s1Request))
-}
-
-func prepareS0RequestForIDose(d0bytes *[]byte, bytes *[]byte, doseShadow iDoseShadow) {
-	nutTempMax := int(doseShadow.State.Reported.Status.Nutrient.NutTemp.Max * 100)
-	nutTempMin := int(doseShadow.State.Reported.Status.Nutrient.NutTemp.Min * 100)
-	nutTempEnabled := doseShadow.State.Reported.Status.Nutrient.NutTemp.Enabled
-	pHMax := int(doseShadow.State.Reported.Status.Nutrient.Ph.Max * 10)
-	pHMin := int(doseShadow.State.Reported.Status.Nutrient.Ph.Min * 10)
-	pHEnabled := doseShadow.State.Reported.Status.Nutrient.Ph.Enabled
-	eCMax := int(doseShadow.State.Reported.Status.Nutrient.Ec.Max / 10)
-	eCMin := int(doseShadow.State.Reported.Status.Nutrient.Ec.Min / 10)
-	eCEnabled := doseShadow.State.Reported.Status.Nutrient.Ec.Enabled
-	nutrient := int(doseShadow.State.Reported.Status.SetPoints.Nutrient)
-	nutrientNight := int(doseShadow.State.Reported.Status.SetPoints.NutrientNight)
-	phMode := getBoolFromPHMode(doseShadow.State.Reported.Status.SetPoints.PhDosing)
-	ph := doseShadow.State.Reported.Status.SetPoints.Ph * 10
-	nutrientDosingStatus := getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, nutrientDosingFunction)
-	pHStatus := getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, phFunction)
-	phDosingHi, phDosingLo := getPhDosingBoolByString(doseShadow.State.Reported.Config.Functions.PhDosing)
-	dayNightEc := doseShadow.State.Reported.Config.Functions.DayNightEc
-	mutebuzzer := doseShadow.State.Reported.Config.Functions.MuteBuzzer
-	separatePumpOutput := doseShadow.State.Reported.Config.Functions.SeparatePumpOutput
-
-	irrigation0Status := getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, irrigationStation1Function)
-	irrigation1Status := getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, irrigationStation2Function)
-	irrigation2Status := getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, irrigationStation3Function)
-	irrigation3Status := getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, irrigationStation4Function)
-
-	waterStatus := getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, waterFunction)
-
-	irrigationMode := doseShadow.State.Reported.Config.Functions.IrrigationMode
-
-	dateFormat := doseShadow.State.Reported.Config.Units.DateFormat
-	temperature := doseShadow.State.Reported.Config.Units.Temperature
-	nutrientConfigH, nutrientConfigL := isNutrientConfig(doseShadow.State.Reported.Config.Units.Ec)
-
-	var irrigationIndepended bool
-	var irrigationSequential bool
-	if irrigationMode == irrigationModeIndependent {
-		irrigationIndepended = true
-		irrigationSequential = false
-	} else if irrigationMode == irrigationModeSequential {
-		irrigationIndepended = true
-		irrigationSequential = true
-	} else {
-		irrigationIndepended = false
-		irrigationSequential = false
-	}
-
-	if irrigationIndepended == irrigationSequential {
-		irrigation0Status = getStatusIDoseFunctionByName(doseShadow.State.Reported.Status.Status, irrigationFunction)
+	// only keep the packets once they have all been read so the shadow is
+	// never parsed from a mix of old and new packets
+	device.states.d0State, device.states.d1State, device.states.d2State = packets[0], packets[1], packets[2]
+	if len(packets) > 3 {
+		device.states.d3State = packets[3]
 	}
 
-	irrigateTOD0, irrigateDayOnly0 := getIrrigationStationConfigurationByString(doseShadow.State.Reported.Config.Functions.IrrigationStation1)
-	irrigateTOD1, irrigateDayOnly1 := getIrrigationStationConfigurationByString(doseShadow.State.Reported.Config.Functions.IrrigationStation2)
-	irrigateTOD2, irrigateDayOnly2 := getIrrigationStationConfigurationByString(doseShadow.State.Reported.Config.Functions.IrrigationStation3)
-	irrigateTOD3, irrigateDayOnly3 := getIrrigationStationConfigurationByString(doseShadow.State.Reported.Config.Functions.IrrigationStation4)
-
-	useWater := doseShadow.State.Reported.Config.Functions.UseWater
+	return nil
+}
 
-	irrigationDuration := doseShadow.State.Reported.Status.General.IrrigationDuration1
-	irrigationDay := doseShadow.State.Reported.Status.General.IrrigationInterval1.Day
-	irrigationNight := doseShadow.State.Reported.Status.General.IrrigationInterval1.Night
-	irrigationEvery := doseShadow.State.Reported.Status.General.IrrigationInterval1.Every
+// statePackets returns the state packets last read from the device
+func (device *Device) statePackets() [][]byte {
+	packets := [][]byte{device.states.d0State, device.states.d1State, device.states.d2State}
+	if device.DeviceType == IntelliClimateDeviceType {
+		packets = append(packets, device.states.d3State)
+	}
+	return packets
+}
 
-	tdsConversationStandart := doseShadow.State.Reported.Config.Units.TdsConversationStandart
+func (device *Device) writeDoseData(ctx context.Context, state iDoseShadow) error {
+	return device.writeData(ctx, iDoseLayout, &state.State.Reported)
+}
 
-	irrigationStations := doseShadow.State.Reported.Config.Functions.IrrigationStations
-	irrigationInstalled := false
-	if irrigationStations > 0 {
-		irrigationInstalled = true
-	}
+func (device *Device) writeClimateData(ctx context.Context, state iClimateShadow) error {
+	return device.writeData(ctx, iClimateLayout, &state.State.Reported)
+}
 
-	(*bytes)[0] = 0x53
-	(*bytes)[1] = 0x30
-	(*bytes)[2] = updateByte((*bytes)[2], doseShadow.State.Reported.Config.Advanced.ProportinalDosing, 0)
-	(*bytes)[2] = updateByte((*bytes)[2], doseShadow.State.Reported.Config.Advanced.SequentialDosing, 1)
-	(*bytes)[2] = updateByte((*bytes)[2], doseShadow.State.Reported.Config.Functions.ExternalAlarm, 2)
-	(*bytes)[2] = updateByte((*bytes)[2], phMode, 3)
-	(*bytes)[2] = updateByte((*bytes)[2], nutrientDosingStatus.Enabled, 4)
-	(*bytes)[2] = updateByte((*bytes)[2], irrigation0Status.Enabled, 5)
-	(*bytes)[2] = updateByte((*bytes)[2], waterStatus.Enabled, 6)
-	(*bytes)[2] = updateByte((*bytes)[2], irrigateDayOnly0, 7)
-	(*bytes)[3] = updateByte((*bytes)[3], phDosingLo, 0)
-	(*bytes)[3] = updateByte((*bytes)[3], phDosingHi, 1)
-	(*bytes)[3] = updateByte((*bytes)[3], dayNightEc, 2)
-	(*bytes)[3] = updateByte((*bytes)[3], irrigateTOD0, 3)
-	(*bytes)[3] = updateByte((*bytes)[3], irrigation0Status.ForceOn, 4)
-	(*bytes)[3] = updateByte((*bytes)[3], waterStatus.ForceOn, 5)
-	(*bytes)[3] = updateByte((*bytes)[3], pHStatus.ForceOn, 6)
-	(*bytes)[3] = updateByte((*bytes)[3], nutrientDosingStatus.ForceOn, 7)
-	(*bytes)[4] = updateByte((*bytes)[4], useWater, 2)
-	(*bytes)[4] = updateByte((*bytes)[4], irrigationInstalled, 3)
-	(*bytes)[4] = updateByte((*bytes)[4], isUSADateFormat(dateFormat), 4)
-	(*bytes)[4] = updateByte((*bytes)[4], nutrientConfigH, 5)
-	(*bytes)[4] = updateByte((*bytes)[4], nutrientConfigL, 6)
-	(*bytes)[4] = updateByte((*bytes)[4], isTemperatureF(temperature), 7)
-	(*bytes)[5] = updateByte((*bytes)[5], pHStatus.Enabled, 0)
-	(*bytes)[5] = updateByte((*bytes)[5], separatePumpOutput, 1)
-	(*bytes)[5] = updateByte((*bytes)[5], doseShadow.State.Reported.Config.Advanced.DisablePh, 2)
-	(*bytes)[5] = updateByte((*bytes)[5], doseShadow.State.Reported.Config.Advanced.DisableEc, 3)
-	(*bytes)[5] = updateByte((*bytes)[5], mutebuzzer, 4)
-	(*bytes)[5] = updateByte((*bytes)[5], nutTempEnabled, 5)
-	(*bytes)[5] = updateByte((*bytes)[5], pHEnabled, 6)
-	(*bytes)[5] = updateByte((*bytes)[5], eCEnabled, 7)
-	(*bytes)[6] = doseShadow.State.Reported.Status.Nutrient.Detent
-	(*bytes)[7] = byte(eCMax)
-	(*bytes)[8] = byte(eCMin)
-	(*bytes)[9] = byte(pHMax)
-	(*bytes)[10] = byte(pHMin)
-	(*bytes)[11] = byte(nutTempMax)
-	(*bytes)[12] = byte(nutTempMax >> 8)
-	(*bytes)[13] = byte(nutTempMin)
-	(*bytes)[14] = byte(nutTempMin >> 8)
-	(*bytes)[15] = byte(nutrient)
-	(*bytes)[16] = byte(nutrient >> 8)
-	(*bytes)[17] = byte(nutrientNight)
-	(*bytes)[18] = byte(nutrientNight >> 8)
-	(*bytes)[19] = byte(ph)
-	(*bytes)[20] = doseShadow.State.Reported.Status.General.MaxNutrientDoseTime
-	(*bytes)[21] = doseShadow.State.Reported.Status.General.NutrientDoseTime
-	(*bytes)[22] = doseShadow.State.Reported.Status.General.Mix1
-	(*bytes)[23] = doseShadow.State.Reported.Status.General.Mix2
-	(*bytes)[24] = doseShadow.State.Reported.Status.General.Mix3
-	(*bytes)[25] = doseShadow.State.Reported.Status.General.MaxPhDoseTime
-	(*bytes)[26] = doseShadow.State.Reported.Status.General.PhDoseTime
-	(*bytes)[28] = doseShadow.State.Reported.Status.General.DoseInterval
-	(*bytes)[29] = byte(irrigationDuration)
-	(*bytes)[30] = byte(irrigationDuration >> 8)
-	(*bytes)[31] = byte(irrigationDay)
-	(*bytes)[32] = byte(irrigationDay >> 8)
-	(*bytes)[33] = byte(irrigationNight)
-	(*bytes)[34] = byte(irrigationNight >> 8)
-	(*bytes)[35] = byte(irrigationEvery)
-	(*bytes)[36] = byte(irrigationEvery >> 8)
-	(*bytes)[37] = doseShadow.State.Reported.Status.General.WaterOnTime
-	(*bytes)[38] = byte(doseShadow.State.Reported.Config.Times.DayStart / 6)
-	(*bytes)[39] = byte(doseShadow.State.Reported.Config.Times.DayEnd / 6)
-	(*bytes)[40] = doseShadow.State.Reported.Config.Functions.NutrientsParts
-	(*bytes)[48] = doseShadow.State.Reported.Status.General.Mix4
-	(*bytes)[49] = doseShadow.State.Reported.Status.General.Mix5
-	(*bytes)[50] = doseShadow.State.Reported.Status.General.Mix6
-	(*bytes)[51] = doseShadow.State.Reported.Status.General.Mix7
-	(*bytes)[52] = doseShadow.State.Reported.Status.General.Mix8
-	(*bytes)[53] = byte(tdsConversationStandart)
-	(*bytes)[54] = byte(tdsConversationStandart >> 8)
-	(*bytes)[57] = updateByte((*bytes)[57], irrigation1Status.Enabled, 0)
-	(*bytes)[57] = updateByte((*bytes)[57], irrigateDayOnly1, 2)
-	(*bytes)[57] = updateByte((*bytes)[57], irrigateTOD1, 3)
-	(*bytes)[57] = updateByte((*bytes)[57], irrigation1Status.ForceOn, 4)
-	(*bytes)[57] = updateByte((*bytes)[57], irrigation1Status.ForceOn, 4)
-	(*bytes)[58] = updateByte((*bytes)[58], irrigation2Status.Enabled, 0)
-	(*bytes)[58] = updateByte((*bytes)[58], irrigateDayOnly2, 2)
-	(*bytes)[58] = updateByte((*bytes)[58], irrigateTOD2, 3)
-	(*bytes)[58] = updateByte((*bytes)[58], irrigation2Status.ForceOn, 4)
-	(*bytes)[58] = updateByte((*bytes)[58], irrigationSequential, 7)
-	(*bytes)[59] = updateByte((*bytes)[59], irrigation3Status.Enabled, 0)
-	(*bytes)[59] = updateByte((*bytes)[59], irrigateDayOnly3, 2)
-	(*bytes)[59] = updateByte((*bytes)[59], irrigateTOD3, 3)
-	(*bytes)[59] = updateByte((*bytes)[59], irrigation3Status.ForceOn, 4)
-	(*bytes)[59] = updateByte((*bytes)[59], irrigationIndepended, 7)
-	(*bytes)[60] = irrigationStations
-	(*bytes)[61] = (*d0bytes)[61]
-
-	createCheckSum(bytes)
-}
-
-func prepareS1RequestForIDose(d0bytes *[]byte, bytes *[]byte, doseShadow iDoseShadow) {
-	irrigationDuration1 := doseShadow.State.Reported.Status.General.IrrigationDuration2
-	irrigationDuration2 := doseShadow.State.Reported.Status.General.IrrigationDuration3
-	irrigationDuration3 := doseShadow.State.Reported.Status.General.IrrigationDuration4
-
-	irrigationDay1 := doseShadow.State.Reported.Status.General.IrrigationInterval2.Day
-	irrigationNight1 := doseShadow.State.Reported.Status.General.IrrigationInterval2.Night
-	irrigationEvery1 := doseShadow.State.Reported.Status.General.IrrigationInterval2.Every
-	irrigationDay2 := doseShadow.State.Reported.Status.General.IrrigationInterval3.Day
-	irrigationNight2 := doseShadow.State.Reported.Status.General.IrrigationInterval3.Night
-	irrigationEvery2 := doseShadow.State.Reported.Status.General.IrrigationInterval3.Every
-	irrigationDay3 := doseShadow.State.Reported.Status.General.IrrigationInterval4.Day
-	irrigationNight3 := doseShadow.State.Reported.Status.General.IrrigationInterval4.Night
-	irrigationEvery3 := doseShadow.State.Reported.Status.General.IrrigationInterval4.Every
-
-	deviceName := doseShadow.State.Reported.Config.General.DeviceName
-	var deviceNameByteArray [10]byte
-	copy(deviceNameByteArray[:], deviceName)
-
-	(*bytes)[0] = 0x53
-	(*bytes)[1] = 0x31
-	(*bytes)[2] = deviceNameByteArray[0]
-	(*bytes)[3] = deviceNameByteArray[1]
-	(*bytes)[4] = deviceNameByteArray[2]
-	(*bytes)[5] = deviceNameByteArray[3]
-	(*bytes)[6] = deviceNameByteArray[4]
-	(*bytes)[7] = deviceNameByteArray[5]
-	(*bytes)[8] = deviceNameByteArray[6]
-	(*bytes)[9] = deviceNameByteArray[7]
-	(*bytes)[10] = deviceNameByteArray[8]
-	(*bytes)[11] = deviceNameByteArray[9]
-	(*bytes)[21] = byte(irrigationDuration1)
-	(*bytes)[22] = byte(irrigationDuration1 >> 8)
-	(*bytes)[23] = byte(irrigationDay1)
-	(*bytes)[24] = byte(irrigationDay1 >> 8)
-	(*bytes)[25] = byte(irrigationNight1)
-	(*bytes)[26] = byte(irrigationNight1 >> 8)
-	(*bytes)[27] = byte(irrigationEvery1)
-	(*bytes)[28] = byte(irrigationEvery1 >> 8)
-	(*bytes)[29] = byte(irrigationDuration2)
-	(*bytes)[30] = byte(irrigationDuration2 >> 8)
-	(*bytes)[31] = byte(irrigationDay2)
-	(*bytes)[32] = byte(irrigationDay2 >> 8)
-	(*bytes)[33] = byte(irrigationNight2)
-	(*bytes)[34] = byte(irrigationNight2 >> 8)
-	(*bytes)[35] = byte(irrigationEvery2)
-	(*bytes)[36] = byte(irrigationEvery2 >> 8)
-	(*bytes)[37] = byte(irrigationDuration3)
-	(*bytes)[38] = byte(irrigationDuration3 >> 8)
-	(*bytes)[39] = byte(irrigationDay3)
-	(*bytes)[40] = byte(irrigationDay3 >> 8)
-	(*bytes)[41] = byte(irrigationNight3)
-	(*bytes)[42] = byte(irrigationNight3 >> 8)
-	(*bytes)[43] = byte(irrigationEvery3)
-	(*bytes)[44] = byte(irrigationEvery3 >> 8)
-	(*bytes)[61] = (*d0bytes)[61]
-	createCheckSum(bytes)
-}
-
-func (device Device) writeClimateData(state iClimateShadow) {
+// writeData writes the reported document pointed to by reported to the device,
+// using the S packets built from the last state read from it
+func (device *Device) writeData(ctx context.Context, l *layout, reported interface{}) error {
 	device.readWriteLock.Lock()
 	defer device.readWriteLock.Unlock()
-	d0State := device.states.d0State
-
-	s0Request := device.states.d1State
-	prepareS0RequestForIClimate(&d0State, &s0Request, state)
-	s0Request = append([]byte{0x00}, s0Request...)
-	device.sentRequest(s0Request)
-
-	tell.Debugf(fmt.Sprintf("%s S0 iClimat request: % x", device.SerialNumber, s0Request))
-
-	s1Request := device.states.d2State
-	prepareS1RequestForIClimate(&d0State, &s1Request, state)
-	s1Request = append([]byte{0x00}, s1Request...)
-	device.sentRequest(s1Request)
-
-	tell.Debugf(fmt.Sprintf("%s S1 iClimat request: % x", device.SerialNumber, s1Request))
-
-	s2Request := device.states.d3State
-	prepareS2RequestForIClimate(&d0State, &s2Request, state)
-	s2Request = append([]byte{0x00}, s2Request...)
-	device.sentRequest(s2Request)
-
-	tell.Debugf(fmt.Sprintf("%s S2 iClimat request: % x", device.SerialNumber, s2Request))
-}
-
-func prepareS0RequestForIClimate(d0bytes *[]byte, bytes *[]byte, climateShadow iClimateShadow) {
-	tempCool := int(climateShadow.State.Reported.Status.Readings.AirTemp.Cool * 100)
-	tempHeat := int(climateShadow.State.Reported.Status.Readings.AirTemp.Heat * 100)
-	tempMin := int(climateShadow.State.Reported.Status.Readings.AirTemp.Min * 100)
-	tempMax := int(climateShadow.State.Reported.Status.Readings.AirTemp.Max * 100)
-	tempAlarmEnabled := climateShadow.State.Reported.Status.Readings.AirTemp.Enabled
-	rHAlarmEnabled := climateShadow.State.Reported.Status.Readings.Rh.Enabled
-	lightAlarmEnabled := climateShadow.State.Reported.Status.Readings.Light.Enabled
-	lightMin := int(climateShadow.State.Reported.Status.Readings.Light.Min)
-	powerFailAlarmEnabled := climateShadow.State.Reported.Status.Readings.PowerFail.Enabled
-	failSafeAlarmEnabled := climateShadow.State.Reported.Status.Readings.FailSafeAlarms.Enabled
-	co2AlarmEnabled := climateShadow.State.Reported.Status.Readings.CO2.Enabled
-	co2Max := int(climateShadow.State.Reported.Status.Readings.CO2.Max / 25)
-	co2Min := int(climateShadow.State.Reported.Status.Readings.CO2.Min / 25)
-	co2Target := int(climateShadow.State.Reported.Status.Readings.CO2.Target)
-	intruderAlarmEanbled := climateShadow.State.Reported.Status.Readings.IntruderAlarm.Enabled
-	buzzerMuted := climateShadow.State.Reported.Config.Functions.MuteBuzzer
-
-	co2SensorConfigEnabled := climateShadow.State.Reported.Config.Functions.Co2Sensor
-	fan1ConfigEnabled := climateShadow.State.Reported.Config.Functions.Fan1
-	fan2ConfigEnabled := climateShadow.State.Reported.Config.Functions.Fan2
-	airConditionerConfigEnabled := climateShadow.State.Reported.Config.Functions.AirConditioner
-	co2InjectionConfigEnabled := climateShadow.State.Reported.Config.Functions.Co2Injection
-	heaterConfigEnabled := climateShadow.State.Reported.Config.Functions.Heater
-	dehumidifierConfigEnabled := climateShadow.State.Reported.Config.Functions.Dehumidifier
-	humidifierConfigEnabled := climateShadow.State.Reported.Config.Functions.Humidifier
-	light1ConfigEnabled := climateShadow.State.Reported.Config.Functions.LightBank1
-	light2ConfigEnabled := climateShadow.State.Reported.Config.Functions.LightBank2
-	lightsAirConfigEnabled := climateShadow.State.Reported.Config.Functions.LightsAirColored
-	foggerConfigEnabled := climateShadow.State.Reported.Config.Functions.PulsedFogger
-	intruderAlarmConfigEnabled := climateShadow.State.Reported.Config.Functions.IntruderAlarm
-	outsideTempConfigEnabled := climateShadow.State.Reported.Config.Functions.OutsideTempSensor
-	secondEnviroSensorConfigEnabled := climateShadow.State.Reported.Config.Functions.SecondEnviroSensor
-	lampOverTempShutdownSensorsConfigEnabled := climateShadow.State.Reported.Config.Functions.LampOverTempShutdownSensors
-
-	dehumidifyBy := climateShadow.State.Reported.Config.Functions.DehumidifyBy
-
-	purge, ac := isDehumidifyBy(dehumidifyBy)
-
-	fan1Status := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, fan1Function)
-	fan2Status := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, fan2Function)
-	airConditionerStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, airConFunction)
-	co2ExtractStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, co2ExtractFunction)
-	co2InjectStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, co2InjectionFunction)
-	heaterStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, heaterFunction)
-	dehumidifierStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, dehumidifierFunction)
-	humidifierStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, humidifierFunction)
-	light1Status := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, lightBank1Function)
-	light2Status := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, lightBank2Function)
-	foggerStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, foggerFunction)
-	purgingStatus := getStatusIClimateFunctionByName(climateShadow.State.Reported.Status.Status, purgingFunction)
-	dateFormat := climateShadow.State.Reported.Config.Units.DateFormat
-	temperature := climateShadow.State.Reported.Config.Units.Temperature
-
-	tell.Infof("D1 SetBool5: %s", encoding.ByteToBitString((*bytes)[6]))
-
-	deviceName := climateShadow.State.Reported.Config.General.DeviceName
-	var deviceNameByteArray [10]byte
-	copy(deviceNameByteArray[:], deviceName)
-
-	(*bytes)[0], (*bytes)[1] = byte('S'), byte('0')
-
-	// slice to have correct index
-	specificationBytes := (*bytes)[2:]
-
-	specificationBytes[0] = encoding.ComposeByte(fan1ConfigEnabled, fan2ConfigEnabled, airConditionerConfigEnabled, heaterConfigEnabled,
-		co2SensorConfigEnabled, co2InjectionConfigEnabled, foggerConfigEnabled, humidifierConfigEnabled)
-
-	specificationBytes[1] = encoding.ComposeByte(dehumidifierConfigEnabled, light1ConfigEnabled, light2ConfigEnabled, outsideTempConfigEnabled,
-		secondEnviroSensorConfigEnabled, intruderAlarmConfigEnabled, false, lightsAirConfigEnabled)
-
-	specificationBytes[2] = encoding.ComposeByte(isTemperatureF(temperature), isUSADateFormat(dateFormat), false, // control by VPD never used by specs for d1
-		failSafeAlarmEnabled, false, buzzerMuted, ac, purge)
-
-	var co2InjectionEnabledComposite bool
-	if co2InjectionConfigEnabled {
-		co2InjectionEnabledComposite = co2InjectStatus.Enabled
-	} else {
-		co2InjectionEnabledComposite = co2ExtractStatus.Enabled
-	}
-	specificationBytes[3] = encoding.ComposeByte(tempAlarmEnabled, rHAlarmEnabled, co2AlarmEnabled, lightAlarmEnabled,
-		intruderAlarmEanbled, powerFailAlarmEnabled, co2InjectionEnabledComposite, lampOverTempShutdownSensorsConfigEnabled)
-
-	var fan2On, fun2En bool
-	if fan2ConfigEnabled {
-		fan2On, fun2En = fan2Status.ForceOn, fan2Status.Enabled
-	} else {
-		fan2On, fun2En = airConditionerStatus.ForceOn, airConditionerStatus.Enabled
-	}
-	specificationBytes[4] = encoding.ComposeByte(fan1Status.Enabled, fan1Status.ForceOn, fun2En, fan2On,
-		heaterStatus.Enabled, heaterStatus.ForceOn, dehumidifierStatus.Enabled, dehumidifierStatus.ForceOn)
-
-	var humidOn, humidEn bool
-	if humidifierConfigEnabled {
-		humidOn, humidEn = humidifierStatus.ForceOn, humidifierStatus.Enabled
-	} else {
-		humidOn, humidEn = foggerStatus.ForceOn, foggerStatus.Enabled
+
+	requests, err := l.requests(device.statePackets(), reported)
+	if err != nil {
+		return err
 	}
-	specificationBytes[5] = encoding.ComposeByte(humidEn, humidOn, light1Status.Enabled, light1Status.ForceOn,
-		light2Status.Enabled, light2Status.ForceOn, purgingStatus.Enabled, purgingStatus.ForceOn)
-
-	specificationBytes[7] = climateShadow.State.Reported.Status.Readings.Detent
-	specificationBytes[8], specificationBytes[9] = encoding.UnsignedIntToBytes(tempCool)
-	specificationBytes[10], specificationBytes[11] = encoding.UnsignedIntToBytes(tempMin)
-	specificationBytes[12], specificationBytes[13] = encoding.UnsignedIntToBytes(tempMax)
-	specificationBytes[14] = climateShadow.State.Reported.Status.Readings.Rh.Target
-	specificationBytes[15] = climateShadow.State.Reported.Status.Readings.Rh.Min
-	specificationBytes[16] = climateShadow.State.Reported.Status.Readings.Rh.Max
-	specificationBytes[23], specificationBytes[24] = encoding.UnsignedIntToBytes(co2Target)
-	specificationBytes[25] = byte(co2Min)
-	specificationBytes[26] = byte(co2Max)
-	specificationBytes[27], specificationBytes[28] = encoding.UnsignedIntToBytes(lightMin)
-	for i := range deviceNameByteArray {
-		specificationBytes[31+i] = deviceNameByteArray[i]
+
+	for i, request := range requests {
+		request = append([]byte{0x00}, request...)
+		tell.Debugf(fmt.Sprintf("%s S%d request: % x", device.SerialNumber, i, request))
+		if _, err := device.sentRequest(ctx, request); err != nil {
+			return err
+		}
 	}
-	fillSetPointData(&specificationBytes, climateShadow.State.Reported.Status.SetPoints[0])
-	specificationBytes[57], specificationBytes[58] = encoding.UnsignedIntToBytes(tempHeat)
-	specificationBytes[59] = (*d0bytes)[61]
 
-	createCheckSum(bytes)
+	return nil
 }
 
-// extracts and set SetPointIClimate data to array
-func fillSetPointData(bytes *[]byte, iClimate SetPointIClimate) {
-	(*bytes)[41] = byte(getLightBoxModeToInt(iClimate.LightBank))
-	(*bytes)[42], (*bytes)[43] = encoding.UnsignedIntToBytes(iClimate.LightOn)
-	(*bytes)[44], (*bytes)[45] = encoding.UnsignedIntToBytes(iClimate.LightDuration)
-	(*bytes)[46], (*bytes)[47] = encoding.UnsignedIntToBytes(int(iClimate.DayTemp * 100))
-	(*bytes)[48], (*bytes)[49] = encoding.UnsignedIntToBytes(int(iClimate.NightDropDeg * 100))
-	(*bytes)[50], (*bytes)[51] = encoding.UnsignedIntToBytes(iClimate.RhDay)
-	(*bytes)[52], (*bytes)[53] = encoding.UnsignedIntToBytes(iClimate.RhNight)
-	(*bytes)[54] = byte(iClimate.RhMax)
-	(*bytes)[55], (*bytes)[56] = encoding.UnsignedIntToBytes(int(iClimate.CO2))
-}
-
-func prepareS1RequestForIClimate(d0bytes *[]byte, bytes *[]byte, climateShadow iClimateShadow) {
-	co2ExtractionEnabled := climateShadow.State.Reported.Config.Functions.Co2Extraction
-
-	daySecs := climateShadow.State.Reported.Config.Advanced.Rules.MinimumAirChangeRules.DaySecs
-	everyDayMins := climateShadow.State.Reported.Config.Advanced.Rules.MinimumAirChangeRules.EveryDayMins
-	nightSecs := climateShadow.State.Reported.Config.Advanced.Rules.MinimumAirChangeRules.NightSecs
-	everyNightMins := climateShadow.State.Reported.Config.Advanced.Rules.MinimumAirChangeRules.EveryNightMins
-	swOffLightTempExceed := int(climateShadow.State.Reported.Config.Advanced.FailSafeSettings.FanFailOverride.SwOffLightTempExceed * 100)
-	swOffLightsTempExceed := int(climateShadow.State.Reported.Config.Advanced.FailSafeSettings.FanFailOverride.SwOffLightsTempExceed * 100)
-	swOnFansCo2Exceed := climateShadow.State.Reported.Config.Advanced.FailSafeSettings.Co2FailSafe.SwOnFansCo2Exceed
-	revertFansCo2Falls := climateShadow.State.Reported.Config.Advanced.FailSafeSettings.Co2InjectionOverride.RevertFansCo2Falls
-	swAllExhaustFans := int(climateShadow.State.Reported.Config.Advanced.FailSafeSettings.AirConOverride.SwAllExhaustFans)
-	lowerCoolingTemp := int(climateShadow.State.Reported.Config.Advanced.Rules.HumidifyTempRules.LowerCoolingTemp * 100)
-	raiseHeatingTemp := int(climateShadow.State.Reported.Config.Advanced.Rules.HumidifyTempRules.RaiseHeatingTemp * 100)
-	rhLowThenRaise := int(climateShadow.State.Reported.Config.Advanced.Rules.HumidifyTempRules.RhLowThenRaise * 100)
-	autoChangeAirCon := int(climateShadow.State.Reported.Config.Advanced.Rules.AirCon.AutoChangeAirCon * 100)
-	injectIfLightGreater := int(climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.InjectIfLightGreater)
-	co2Cycling := int(climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.Co2Cycling * 100)
-	riseVentTemp := int(climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.RiseVentTemp * 100)
-	fogToAchieveRh := int(climateShadow.State.Reported.Config.Advanced.Rules.FoggingRules.FogToAchieveRh * 100)
-	fogTimes := int(climateShadow.State.Reported.Config.Advanced.Rules.FoggingRules.FogTimes)
-	autoStartAirCon := int(climateShadow.State.Reported.Config.Advanced.Rules.AirCon.AutoStartAirCon * 100)
-
-	(*bytes)[0] = 0x53
-	(*bytes)[1] = 0x31
-
-	(*bytes)[2] = updateByte((*bytes)[2], getBoolFromCo2SensorRange(climateShadow.State.Reported.Config.Functions.Co2SensorRange), 0)
-	(*bytes)[2] = updateByte((*bytes)[2], co2ExtractionEnabled, 1)
-	(*bytes)[2] = updateByte((*bytes)[2], climateShadow.State.Reported.Config.Advanced.Rules.Humidification.AllowHumidification, 2)
-	(*bytes)[2] = updateByte((*bytes)[2], climateShadow.State.Reported.Config.Advanced.Rules.AirCon.ForceAirCon, 3)
-	(*bytes)[2] = updateByte((*bytes)[2], climateShadow.State.Reported.Config.Advanced.FailSafeSettings.LightingOverride.LightFallsAlarmMinimum, 4)
-	(*bytes)[2] = updateByte((*bytes)[2], climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.Co2InjectionAllowed, 5)
-	(*bytes)[2] = updateByte((*bytes)[2], climateShadow.State.Reported.Config.Advanced.Rules.AllowAirCon, 6)
-	(*bytes)[2] = updateByte((*bytes)[2], climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.Co2InjectionAvoid, 7)
-	(*bytes)[3] = byte(swAllExhaustFans)
-	(*bytes)[4] = byte(swAllExhaustFans >> 8)
-	(*bytes)[5] = byte(swOffLightTempExceed)
-	(*bytes)[6] = byte(swOffLightTempExceed >> 8)
-	(*bytes)[7] = byte(swOffLightsTempExceed)
-	(*bytes)[8] = byte(swOffLightsTempExceed >> 8)
-	(*bytes)[9] = climateShadow.State.Reported.Config.Advanced.FailSafeSettings.DehumidifierOverride.SwOnFansRhExceed
-	(*bytes)[10] = climateShadow.State.Reported.Config.Advanced.FailSafeSettings.DehumidifierOverride.SwAcRhExceed
-	(*bytes)[11] = byte(swOnFansCo2Exceed)
-	(*bytes)[12] = byte(swOnFansCo2Exceed >> 8)
-	(*bytes)[13] = byte(revertFansCo2Falls)
-	(*bytes)[14] = byte(revertFansCo2Falls >> 8)
-	(*bytes)[15] = climateShadow.State.Reported.Config.Advanced.Rules.Lighting.LampCoolDownTime
-	(*bytes)[16] = climateShadow.State.Reported.Config.Advanced.FailSafeSettings.PowerFailure.SwLightsAfterCoolDown
-	(*bytes)[17] = climateShadow.State.Reported.Config.Advanced.Rules.Lighting.SwOnNextLightBank
-	(*bytes)[18] = climateShadow.State.Reported.Config.Advanced.Rules.SetpointRamping.RampSetpoints
-	(*bytes)[19] = climateShadow.State.Reported.Config.Advanced.Rules.HumidifyTempRules.PreventHeater
-	(*bytes)[20] = climateShadow.State.Reported.Config.Advanced.Rules.Humidification.ChangeHumidification
-	(*bytes)[21] = byte(autoStartAirCon & 0xff)
-	(*bytes)[22] = byte(autoStartAirCon >> 8)
-	(*bytes)[23] = climateShadow.State.Reported.Config.Advanced.Rules.AirCon.StartBefore
-	(*bytes)[24] = byte(lowerCoolingTemp & 0xff)
-	(*bytes)[25] = byte(lowerCoolingTemp >> 8)
-	(*bytes)[27] = byte(raiseHeatingTemp & 0xff)
-	(*bytes)[26] = climateShadow.State.Reported.Config.Advanced.Rules.FoggingRules.FogToCool
-	(*bytes)[28] = byte(raiseHeatingTemp >> 8)
-	(*bytes)[29] = byte(rhLowThenRaise & 0xff)
-	(*bytes)[30] = byte(rhLowThenRaise >> 8)
-	(*bytes)[31] = climateShadow.State.Reported.Config.Advanced.Rules.PurgingRules.PurgeMins
-	(*bytes)[32] = climateShadow.State.Reported.Config.Advanced.Rules.PurgingRules.PurgeMin
-	(*bytes)[33] = climateShadow.State.Reported.Config.Advanced.Rules.PurgingRules.PurgeMax
-	(*bytes)[34] = byte(fogToAchieveRh)
-	(*bytes)[35] = byte(fogToAchieveRh >> 8)
-	(*bytes)[36] = byte(fogTimes)
-	(*bytes)[37] = climateShadow.State.Reported.Config.Advanced.Rules.FoggingRules.FogTimeMin
-	(*bytes)[38] = climateShadow.State.Reported.Config.Advanced.Rules.FoggingRules.FogTimeMax
-	(*bytes)[39] = byte(autoChangeAirCon)
-	(*bytes)[40] = byte(autoChangeAirCon >> 8)
-	(*bytes)[41] = byte(everyDayMins)
-	(*bytes)[42] = byte(everyDayMins >> 8)
-	(*bytes)[43] = byte(everyNightMins)
-	(*bytes)[44] = byte(everyNightMins >> 8)
-	(*bytes)[45] = byte(daySecs)
-	(*bytes)[46] = byte(daySecs >> 8)
-	(*bytes)[47] = byte(nightSecs)
-	(*bytes)[48] = byte(nightSecs >> 8)
-	(*bytes)[49] = byte(injectIfLightGreater)
-	(*bytes)[50] = byte(injectIfLightGreater >> 8)
-	(*bytes)[51] = byte(co2Cycling & 0xff)
-	(*bytes)[52] = byte(co2Cycling >> 8)
-	(*bytes)[53] = byte(riseVentTemp & 0xff)
-	(*bytes)[54] = byte(riseVentTemp >> 8)
-	(*bytes)[55] = climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.InjectTimeMin
-	(*bytes)[56] = climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.InjectTimeMax
-	(*bytes)[57] = climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.WaitTimeMin
-	(*bytes)[58] = climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.WaitTimeMax
-	(*bytes)[59] = climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.VentTimeMin
-	(*bytes)[60] = climateShadow.State.Reported.Config.Advanced.Rules.CO2Rules.VentTimeMax
-	(*bytes)[61] = (*d0bytes)[61]
-	createCheckSum(bytes)
-}
-
-func prepareS2RequestForIClimate(d0bytes *[]byte, bytes *[]byte, climateShadow iClimateShadow) {
-	fansOn := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.FansOn * 100)
-	fansOff := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.FansOff * 100)
-	heaterOn := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.HeaterOn * 100)
-	heaterOff := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.HeaterOff * 100)
-	humidifierOn := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.HumidifierOn)
-	humidifierOff := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.HumidifierOff)
-	dehumidifierOn := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.DehumidifierOn)
-	dehumidifierOff := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.DehumidifierOff)
-	cO2On := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.CO2On)
-	cO2Off := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.CO2Off)
-	airConditionerOn := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.AirConditionerOn * 100)
-	airConditionerOff := int(climateShadow.State.Reported.Config.Advanced.SwitchingOffsets.AirConditionerOff * 100)
-	heatingOffset := int(climateShadow.State.Reported.Config.Advanced.Rules.HumidifyTempRules.HeatingOffset * 100)
-	fogTimes := int(climateShadow.State.Reported.Config.Advanced.Rules.FoggingRules.FogTimes)
-
-	(*bytes)[0] = 0x53
-	(*bytes)[1] = 0x32
-	(*bytes)[3] = byte(heaterOn & 0xff)
-	(*bytes)[4] = byte(heaterOn >> 8)
-	(*bytes)[5] = byte(heaterOff & 0xff)
-	(*bytes)[6] = byte(heaterOff >> 8)
-	(*bytes)[7] = byte(fansOn & 0xff)
-	(*bytes)[8] = byte(fansOn >> 8)
-	(*bytes)[9] = byte(fansOff & 0xff)
-	(*bytes)[10] = byte(fansOff >> 8)
-	(*bytes)[11] = byte(airConditionerOn & 0xff)
-	(*bytes)[12] = byte(airConditionerOn >> 8)
-	(*bytes)[13] = byte(airConditionerOff & 0xff)
-	(*bytes)[14] = byte(airConditionerOff >> 8)
-	(*bytes)[15] = byte(humidifierOn & 0xff)
-	(*bytes)[16] = byte(humidifierOn >> 8)
-	(*bytes)[17] = byte(humidifierOff & 0xff)
-	(*bytes)[18] = byte(humidifierOff >> 8)
-	(*bytes)[19] = byte(dehumidifierOn & 0xff)
-	(*bytes)[20] = byte(dehumidifierOn >> 8)
-	(*bytes)[21] = byte(dehumidifierOff & 0xff)
-	(*bytes)[22] = byte(dehumidifierOff >> 8)
-	(*bytes)[23] = byte(cO2On & 0xff)
-	(*bytes)[24] = byte(cO2On >> 8)
-	(*bytes)[25] = byte(cO2Off & 0xff)
-	(*bytes)[26] = byte(cO2Off >> 8)
-	(*bytes)[27] = byte(heatingOffset & 0xff)
-	(*bytes)[28] = byte(heatingOffset >> 8)
-	(*bytes)[35] = byte(fogTimes >> 8)
-	(*bytes)[61] = (*d0bytes)[61]
-	createCheckSum(bytes)
+// copyState returns a copy of a state packet so it can be turned into a set
+// request without clobbering the last state read from the device
+func copyState(state []byte) []byte {
+	return append([]byte{}, state...)
 }
 
 func parseByteResponseForIDose(d0Response []byte, d1Response []byte, d2Response []byte, name string, timestamp int64) iDoseShadow {
-	irrigationInstalled := getBoolFromByte(d1Response[4], 3)
-	irrigationIndepended := getBoolFromByte(d1Response[59], 7)
-	irrigationSequential := getBoolFromByte(d1Response[58], 7)
-	irrigationStations := d1Response[60]
-	irrigationMode := getIrrigationMode(irrigationSequential, irrigationIndepended)
-	if !irrigationInstalled {
-		irrigationStations = 0
-	} else {
-		if irrigationStations == 0 {
-			irrigationStations = 1
-		}
+	reported := newReportedIDose(name, timestamp)
+	if err := iDoseLayout.decode([][]byte{d0Response, d1Response, d2Response}, &reported); err != nil {
+		tell.Errorf("failed to parse %s: %s", name, err)
 	}
 
-	return iDoseShadow{
-		StateIDose{
-			Reported: ReportedIDose{
-				Config: ConfigIDose{
-					Units: UnitsIDose{
-						DateFormat:  getDateFormat(getBoolFromByte(d1Response[4], 4)),
-						Temperature: getTemperatureF(getBoolFromByte(d1Response[4], 7)),
-						Ec:          getNutrientConfig(getBoolFromByte(d1Response[4], 6), getBoolFromByte(d1Response[4], 5)),
-						TdsConversationStandart: getFloatFrom2Bytes(d1Response[54], d1Response[53]),
-					},
-					Times: TimesIDose{
-						DayStart: int(d1Response[38]) * 6,
-						DayEnd:   int(d1Response[39]) * 6,
-					},
-					Functions: FunctionsIDose{
-						NutrientsParts:     getDefaultValue(d1Response[40], 1),
-						PhDosing:           getPhDosingModeByBool(getBoolFromByte(d1Response[3], 1), getBoolFromByte(d1Response[3], 0)),
-						IrrigationMode:     irrigationMode,
-						IrrigationStations: irrigationStations,
-						SeparatePumpOutput: getBoolFromByte(d1Response[5], 1),
-						UseWater:           getBoolFromByte(d1Response[4], 2),
-						ExternalAlarm:      getBoolFromByte(d1Response[2], 2),
-						DayNightEc:         getBoolFromByte(d1Response[3], 2),
-						IrrigationStation1: getIrrigationStationConfiguration(getBoolFromByte(d1Response[3], 3), getBoolFromByte(d1Response[2], 7)),
-						IrrigationStation2: getIrrigationStationConfiguration(getBoolFromByte(d1Response[57], 3), getBoolFromByte(d1Response[57], 2)),
-						IrrigationStation3: getIrrigationStationConfiguration(getBoolFromByte(d1Response[58], 3), getBoolFromByte(d1Response[58], 2)),
-						IrrigationStation4: getIrrigationStationConfiguration(getBoolFromByte(d1Response[59], 3), getBoolFromByte(d1Response[59], 2)),
-						Scheduling:         false,
-						MuteBuzzer:         getBoolFromByte(d1Response[5], 4),
-					},
-					Advanced: AdvancedIDose{
-						ProportinalDosing: getBoolFromByte(d1Response[2], 0),
-						SequentialDosing:  getBoolFromByte(d1Response[2], 1),
-						DisableEc:         getBoolFromByte(d1Response[5], 3),
-						DisablePh:         getBoolFromByte(d1Response[5], 2),
-						MntnReminderFreq:  "weekly",
-					},
-					General: GeneralIDose{
-						DeviceName: string(d2Response[2:12]),
-						Firmware:   prepareInt(getSignedFloatFrom2Bytes(d0Response[8], d0Response[7]), 2, 100),
-					},
-				},
-				Status: StatusIDose{
-					Nutrient: NutrientIDose{
-						Detent: d1Response[6],
-						Ec: EcIDose{
-							Min:     prepareByte(d1Response[8], 1, 1) * 10,
-							Max:     prepareByte(d1Response[7], 1, 1) * 10,
-							Enabled: getBoolFromByte(d1Response[5], 7),
-						},
-						Ph: PhIDose{
-							Min:     prepareByte(d1Response[10], 1, 10),
-							Max:     prepareByte(d1Response[9], 1, 10),
-							Enabled: getBoolFromByte(d1Response[5], 6),
-						},
-						NutTemp: NutTempIDose{
-							Min:     prepareInt(getFloatFrom2Bytes(d1Response[14], d1Response[13]), 1, 100),
-							Max:     prepareInt(getFloatFrom2Bytes(d1Response[12], d1Response[11]), 1, 100),
-							Enabled: getBoolFromByte(d1Response[5], 5),
-						},
-					},
-					Status: []StatusStatusIDose{
-						{
-							Active:   getBoolFromByte(d0Response[15], 7),
-							Enabled:  getBoolFromByte(d1Response[2], 4),
-							ForceOn:  getBoolFromByte(d1Response[3], 7),
-							Function: nutrientDosingFunction,
-						},
-						{
-							Active:   getBoolFromByte(d0Response[15], 6),
-							Enabled:  getBoolFromByte(d1Response[5], 0),
-							ForceOn:  getBoolFromByte(d1Response[3], 3),
-							Function: phFunction,
-						},
-						{
-							Active:   getBoolFromByte(d0Response[17], 7),
-							Enabled:  getBoolFromByte(d1Response[2], 5),
-							ForceOn:  getBoolFromByte(d1Response[3], 4),
-							Function: irrigationFunction,
-						},
-						{
-							Active:   getBoolFromByte(d0Response[17], 7),
-							Enabled:  getBoolFromByte(d1Response[2], 5),
-							ForceOn:  getBoolFromByte(d1Response[3], 4),
-							Function: irrigationStation1Function,
-						},
-						{
-							Active:   getBoolFromByte(d0Response[17], 6),
-							Enabled:  getBoolFromByte(d1Response[57], 0),
-							ForceOn:  getBoolFromByte(d1Response[57], 4),
-							Function: irrigationStation2Function,
-						},
-						{
-							Active:   getBoolFromByte(d0Response[17], 5),
-							Enabled:  getBoolFromByte(d1Response[58], 0),
-							ForceOn:  getBoolFromByte(d1Response[58], 4),
-							Function: irrigationStation3Function,
-						},
-						{
-							Active:   getBoolFromByte(d0Response[17], 4),
-							Enabled:  getBoolFromByte(d1Response[59], 0),
-							ForceOn:  getBoolFromByte(d1Response[59], 4),
-							Function: irrigationStation4Function,
-						},
-						{
-							Active:   getBoolFromByte(d0Response[15], 4),
-							Enabled:  getBoolFromByte(d1Response[2], 6),
-							ForceOn:  getBoolFromByte(d1Response[3], 5),
-							Function: waterFunction,
-						},
-					},
-					SetPoints: SetPointsIDose{
-						Nutrient:      prepareInt(getFloatFrom2Bytes(d1Response[16], d1Response[15]), 0, 1),
-						NutrientNight: prepareInt(getFloatFrom2Bytes(d1Response[18], d1Response[17]), 0, 1),
-						PhDosing:      getPHMode(getBoolFromByte(d1Response[2], 3)),
-						Ph:            prepareByte(d1Response[19], 1, 10),
-					},
-					General: GeneralStatusIDose{
-						NutrientDoseTime:    d1Response[21],
-						MaxNutrientDoseTime: d1Response[20],
-						DoseInterval:        d1Response[28],
-						WaterOnTime:         d1Response[37],
-						IrrigationInterval1: IrrigationIntervalIDose{
-							Day:   getFloatFrom2Bytes(d1Response[32], d1Response[31]),
-							Night: getFloatFrom2Bytes(d1Response[34], d1Response[33]),
-							Every: getFloatFrom2Bytes(d1Response[36], d1Response[35]),
-						},
-						IrrigationInterval2: IrrigationIntervalIDose{
-							Day:   getFloatFrom2Bytes(d2Response[24], d2Response[23]),
-							Night: getFloatFrom2Bytes(d2Response[26], d2Response[25]),
-							Every: getFloatFrom2Bytes(d2Response[28], d2Response[27]),
-						},
-						IrrigationInterval3: IrrigationIntervalIDose{
-							Day:   getFloatFrom2Bytes(d2Response[32], d2Response[31]),
-							Night: getFloatFrom2Bytes(d2Response[34], d2Response[33]),
-							Every: getFloatFrom2Bytes(d2Response[36], d2Response[35]),
-						},
-						IrrigationInterval4: IrrigationIntervalIDose{
-							Day:   getFloatFrom2Bytes(d2Response[40], d2Response[39]),
-							Night: getFloatFrom2Bytes(d2Response[42], d2Response[41]),
-							Every: getFloatFrom2Bytes(d2Response[44], d2Response[43]),
-						},
-						IrrigationDuration1: getFloatFrom2Bytes(d1Response[30], d1Response[29]),
-						IrrigationDuration2: getFloatFrom2Bytes(d2Response[22], d2Response[21]),
-						IrrigationDuration3: getFloatFrom2Bytes(d2Response[30], d2Response[29]),
-						IrrigationDuration4: getFloatFrom2Bytes(d2Response[38], d2Response[37]),
-						Mix1:                d1Response[22],
-						Mix2:                d1Response[23],
-						Mix3:                d1Response[24],
-						Mix4:                d1Response[48],
-						Mix5:                d1Response[49],
-						Mix6:                d1Response[50],
-						Mix7:                d1Response[51],
-						Mix8:                d1Response[52],
-						PhDoseTime:          d1Response[26],
-						MaxPhDoseTime:       d1Response[25],
-					},
-				},
-				Metrics: MetricsIDose{
-					Ec:      checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[10], d0Response[9]), 1, 1),
-					PH:      checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[12], d0Response[11]), 1, 100),
-					NutTemp: checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[14], d0Response[13]), 1, 100),
-				},
-				Device:    name,
-				Timestamp: timestamp,
-				Source:    "Gateway",
-				Connected: true,
-			},
-		},
-	}
+	return iDoseShadow{StateIDose{Reported: reported}}
 }
 
 func parseByteResponseForIClimate(d0Response []byte, d1Response []byte, d2Response []byte, d3Response []byte, name string, timestamp int64) iClimateShadow {
-
-	return iClimateShadow{
-		State: StateIClimate{
-			Reported: ReportedIClimate{
-				Config: ConfigIClimate{
-					Units: UnitsIClimate{
-						DateFormat:  getDateFormat(getBoolFromByte(d1Response[4], 6)),
-						Temperature: getTemperatureF(getBoolFromByte(d1Response[4], 7)),
-					},
-					Functions: FunctionsIClimate{
-						Fan1:                        getBoolFromByte(d1Response[2], 7),
-						Fan2:                        getBoolFromByte(d1Response[2], 6),
-						AirConditioner:              getBoolFromByte(d1Response[2], 5),
-						Heater:                      getBoolFromByte(d1Response[2], 4),
-						Co2Sensor:                   getBoolFromByte(d1Response[2], 3),
-						Co2SensorRange:              getCo2SensorRangeFromBool(getBoolFromByte(d2Response[2], 0)),
-						Co2Injection:                getBoolFromByte(d1Response[2], 2),
-						Co2Extraction:               getBoolFromByte(d2Response[2], 1),
-						Dehumidifier:                getBoolFromByte(d1Response[3], 7),
-						Humidifier:                  getBoolFromByte(d1Response[2], 0),
-						PulsedFogger:                getBoolFromByte(d1Response[2], 1),
-						LightBank1:                  getBoolFromByte(d1Response[3], 6),
-						LightsAirColored:            getBoolFromByte(d1Response[3], 0),
-						LightBank2:                  getBoolFromByte(d1Response[3], 5),
-						LampOverTempShutdownSensors: getBoolFromByte(d1Response[5], 0),
-						OutsideTempSensor:           getBoolFromByte(d1Response[3], 4),
-						SecondEnviroSensor:          getBoolFromByte(d1Response[3], 3),
-						IntruderAlarm:               getBoolFromByte(d1Response[3], 2),
-						DehumidifyBy:                getDehumidifyBy(getBoolFromByte(d1Response[4], 0), getBoolFromByte(d1Response[4], 1)),
-						Setup:                       "Manual",
-						MuteBuzzer:                  getBoolFromByte(d1Response[4], 2),
-					},
-					Advanced: AdvancedIClimate{
-						ViewAdvancedSetting: false,
-						SwitchingOffsets: SwitchingOffsetsIClimate{
-							FansOn:            prepareInt(getSignedFloatFrom2Bytes(d3Response[8], d3Response[7]), 1, 100),
-							FansOff:           prepareInt(getSignedFloatFrom2Bytes(d3Response[10], d3Response[9]), 1, 100),
-							HeaterOn:          prepareInt(getSignedFloatFrom2Bytes(d3Response[4], d3Response[3]), 1, 100),
-							HeaterOff:         prepareInt(getSignedFloatFrom2Bytes(d3Response[6], d3Response[5]), 1, 100),
-							HumidifierOn:      prepareInt(getSignedFloatFrom2Bytes(d3Response[16], d3Response[15]), 1, 1),
-							HumidifierOff:     prepareInt(getSignedFloatFrom2Bytes(d3Response[18], d3Response[17]), 1, 1),
-							DehumidifierOn:    prepareInt(getSignedFloatFrom2Bytes(d3Response[20], d3Response[19]), 1, 1),
-							DehumidifierOff:   prepareInt(getSignedFloatFrom2Bytes(d3Response[22], d3Response[21]), 1, 1),
-							CO2On:             prepareInt(getSignedFloatFrom2Bytes(d3Response[24], d3Response[23]), 1, 1),
-							CO2Off:            prepareInt(getSignedFloatFrom2Bytes(d3Response[26], d3Response[25]), 1, 1),
-							PulsedFoggerOn:    10,
-							PulsedFoggerOff:   12,
-							AirConditionerOn:  prepareInt(getSignedFloatFrom2Bytes(d3Response[12], d3Response[11]), 1, 100),
-							AirConditionerOff: prepareInt(getSignedFloatFrom2Bytes(d3Response[14], d3Response[13]), 1, 100),
-						},
-						Rules: RulesIClimate{
-							MinimumAirChangeRules: MinimumAirChangeRulesIClimate{
-								DaySecs:        getFloatFrom2Bytes(d2Response[46], d2Response[45]),
-								EveryDayMins:   getFloatFrom2Bytes(d2Response[42], d2Response[41]),
-								NightSecs:      getFloatFrom2Bytes(d2Response[48], d2Response[47]),
-								EveryNightMins: getFloatFrom2Bytes(d2Response[44], d2Response[43]),
-							},
-							HumidifyTempRules: HumidifyTempRulesIClimate{
-								LowerCoolingTemp: prepareInt(getSignedFloatFrom2Bytes(d2Response[25], d2Response[24]), 1, 100),
-								RaiseHeatingTemp: prepareInt(getSignedFloatFrom2Bytes(d2Response[28], d2Response[27]), 1, 100),
-								RhLowThenRaise:   prepareInt(getSignedFloatFrom2Bytes(d2Response[30], d2Response[29]), 1, 100),
-								PreventHeater:    d2Response[19],
-								HeatingOffset:    prepareInt(getSignedFloatFrom2Bytes(d3Response[28], d3Response[27]), 1, 100),
-							},
-							AllowAirCon: getBoolFromByte(d2Response[2], 6),
-							SetpointRamping: SetpointRampingIClimate{
-								RampSetpoints: d2Response[18],
-							},
-							AirCon: AirConIClimate{
-								ForceAirCon:      getBoolFromByte(d2Response[2], 3),
-								AutoChangeAirCon: prepareInt(getFloatFrom2Bytes(d2Response[40], d2Response[39]), 1, 100),
-								StartBefore:      d2Response[23],
-								AutoStartAirCon:  prepareInt(getSignedFloatFrom2Bytes(d2Response[22], d2Response[21]), 1, 100),
-							},
-							CO2Rules: CO2RulesIClimate{
-								Co2InjectionAllowed:  getBoolFromByte(d2Response[2], 5),
-								InjectIfLightGreater: prepareInt(getFloatFrom2Bytes(d2Response[50], d2Response[49]), 1, 1),
-								Co2InjectionAvoid:    getBoolFromByte(d2Response[2], 7),
-								Co2Cycling:           prepareInt(getSignedFloatFrom2Bytes(d2Response[52], d2Response[51]), 1, 100),
-								RiseVentTemp:         prepareInt(getSignedFloatFrom2Bytes(d2Response[54], d2Response[53]), 1, 100),
-								InjectTimeMin:        d2Response[55],
-								InjectTimeMax:        d2Response[56],
-								WaitTimeMin:          d2Response[57],
-								WaitTimeMax:          d2Response[58],
-								VentTimeMin:          d2Response[59],
-								VentTimeMax:          d2Response[60],
-							},
-							Humidification: HumidificationIClimate{
-								ChangeHumidification: d2Response[20],
-								AllowHumidification:  getBoolFromByte(d2Response[2], 2),
-							},
-							Lighting: LightingIClimate{
-								LampCoolDownTime:  d2Response[15],
-								SwOnNextLightBank: d2Response[17],
-							},
-							FoggingRules: FoggingRulesIClimate{
-								FogToCool:      d2Response[26],
-								FogToAchieveRh: prepareInt(getFloatFrom2Bytes(d2Response[35], d2Response[34]), 1, 100),
-								FogTimes:       getFloatFrom2Bytes(d3Response[29], d2Response[36]),
-								FogTimeMax:     d2Response[38],
-								FogTimeMin:     d2Response[37],
-							},
-							PurgingRules: PurgingRulesIClimate{
-								PurgeMins: d2Response[31],
-								PurgeMin:  d2Response[32],
-								PurgeMax:  d2Response[33],
-							},
-						},
-						FailSafeSettings: FailSafeSettingsIClimate{
-							FanFailOverride: FanFailOverrideIClimate{
-								SwOffLightsTempExceed: prepareInt(getFloatFrom2Bytes(d2Response[8], d2Response[7]), 1, 100),
-								SwOffLightTempExceed:  prepareInt(getFloatFrom2Bytes(d2Response[6], d2Response[5]), 1, 100),
-							},
-							DehumidifierOverride: DehumidifierOverrideIClimate{
-								SwOnFansRhExceed: d2Response[9],
-								SwAcRhExceed:     d2Response[10],
-							},
-							Co2FailSafe: Co2FailSafeIClimate{
-								SwOnFansCo2Exceed: getFloatFrom2Bytes(d2Response[12], d2Response[11]),
-							},
-							Co2InjectionOverride: Co2InjectionOverrideIClimate{
-								RevertFansCo2Falls: getFloatFrom2Bytes(d2Response[14], d2Response[13]),
-							},
-							PowerFailure: PowerFailureIClimate{
-								SwLightsAfterCoolDown: d2Response[16],
-							},
-							LightingOverride: LightingOverrideIClimate{
-								LightFallsAlarmMinimum: getBoolFromByte(d2Response[2], 4),
-							},
-							AirConOverride: AirConOverrideIClimate{
-								SwAllExhaustFans: prepareInt(getFloatFrom2Bytes(d2Response[4], d2Response[3]), 1, 100),
-							},
-						},
-					},
-					General: GeneralIClimate{
-						DeviceName: string(d1Response[33:43]),
-						Firmware:   prepareInt(getSignedFloatFrom2Bytes(d0Response[8], d0Response[7]), 2, 100),
-					},
-				},
-				Status: StatusIClimate{
-					Readings: ReadingsIClimate{
-						AirTemp: AirTempIClimate{
-							Cool:    prepareInt(getFloatFrom2Bytes(d1Response[11], d1Response[10]), 1, 100),
-							Heat:    prepareInt(getFloatFrom2Bytes(d1Response[60], d1Response[59]), 1, 100),
-							Min:     prepareInt(getFloatFrom2Bytes(d1Response[13], d1Response[12]), 1, 100),
-							Max:     prepareInt(getFloatFrom2Bytes(d1Response[15], d1Response[14]), 1, 100),
-							Enabled: getBoolFromByte(d1Response[5], 7),
-							Page:    false,
-						},
-						Rh: RhIClimate{
-							Target:  d1Response[16],
-							Min:     d1Response[17],
-							Max:     d1Response[18],
-							Enabled: getBoolFromByte(d1Response[5], 6),
-							Page:    false,
-						},
-						Light: LightIClimate{
-							Min:     prepareInt(getFloatFrom2Bytes(d1Response[30], d1Response[29]), 0, 1),
-							Enabled: getBoolFromByte(d1Response[5], 4),
-							Page:    false,
-						},
-						PowerFail: PowerFailIClimate{
-							Enabled: getBoolFromByte(d1Response[5], 2),
-							Page:    false,
-						},
-						FailSafeAlarms: FailSafeAlarmsIClimate{
-							Enabled: getBoolFromByte(d1Response[4], 4),
-							Page:    true,
-						},
-						Detent: d1Response[9],
-						CO2: CO2IClimate{
-							Min:     prepareByte(d1Response[27], 0, 1) * 25,
-							Max:     prepareByte(d1Response[28], 0, 1) * 25,
-							Target:  prepareInt(getFloatFrom2Bytes(d1Response[26], d1Response[25]), 0, 1),
-							Enabled: getBoolFromByte(d1Response[5], 5),
-							Page:    false,
-						},
-						IntruderAlarm: IntruderAlarmIClimate{
-							Enabled: getBoolFromByte(d1Response[5], 3),
-							Page:    false,
-						},
-					},
-					Statistics: StatisticsIClimate{
-						Lights: prepareInt(getFloatFrom2Bytes(d1Response[35], d1Response[34]), 1, 100),
-						CO2:    prepareInt(getFloatFrom2Bytes(d0Response[41], d0Response[40]), 0, 1),
-					},
-					SetPoints: extractSetPointArray(d1Response),
-					Status: []StatusStatusIClimate{
-						{
-							Active:    getBoolFromByte(d0Response[43], 7),
-							Enabled:   getBoolFromByte(d1Response[6], 7),
-							ForceOn:   getBoolFromByte(d1Response[6], 6),
-							Function:  fan1Function,
-							Installed: getBoolFromByte(d1Response[2], 7),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 6),
-							Enabled:   getBoolFromByte(d1Response[6], 5),
-							ForceOn:   getBoolFromByte(d1Response[6], 4),
-							Function:  fan2Function,
-							Installed: getBoolFromByte(d1Response[2], 6),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 6),
-							Enabled:   getBoolFromByte(d1Response[6], 5),
-							ForceOn:   getBoolFromByte(d1Response[6], 4),
-							Function:  airConFunction,
-							Installed: getBoolFromByte(d1Response[2], 5),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 3),
-							Enabled:   getBoolFromByte(d1Response[5], 1),
-							ForceOn:   false,
-							Function:  co2InjectionFunction,
-							Installed: getBoolFromByte(d1Response[2], 2),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 3),
-							Enabled:   getBoolFromByte(d1Response[5], 1),
-							ForceOn:   true,
-							Function:  co2ExtractFunction,
-							Installed: getBoolFromByte(d1Response[2], 2),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 5),
-							Enabled:   getBoolFromByte(d1Response[6], 3),
-							ForceOn:   getBoolFromByte(d1Response[6], 2),
-							Function:  heaterFunction,
-							Installed: getBoolFromByte(d1Response[2], 4),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 2),
-							Enabled:   getBoolFromByte(d1Response[6], 1),
-							ForceOn:   getBoolFromByte(d1Response[6], 0),
-							Function:  dehumidifierFunction,
-							Installed: getBoolFromByte(d1Response[3], 7),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 4),
-							Enabled:   getBoolFromByte(d1Response[7], 7),
-							ForceOn:   getBoolFromByte(d1Response[7], 6),
-							Function:  humidifierFunction,
-							Installed: getBoolFromByte(d1Response[2], 0),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 1),
-							Enabled:   getBoolFromByte(d1Response[7], 5),
-							ForceOn:   getBoolFromByte(d1Response[7], 4),
-							Function:  lightBank1Function,
-							Installed: getBoolFromByte(d1Response[3], 6),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 0),
-							Enabled:   getBoolFromByte(d1Response[7], 3),
-							ForceOn:   getBoolFromByte(d1Response[7], 2),
-							Function:  lightBank2Function,
-							Installed: getBoolFromByte(d1Response[3], 5),
-						},
-						{
-							Active:    getBoolFromByte(d0Response[43], 4),
-							Enabled:   getBoolFromByte(d1Response[7], 7),
-							ForceOn:   getBoolFromByte(d1Response[7], 6),
-							Function:  foggerFunction,
-							Installed: getBoolFromByte(d1Response[2], 1),
-						},
-						{
-							Active:    false,
-							Enabled:   true,
-							ForceOn:   false,
-							Function:  purgingFunction,
-							Installed: true,
-						},
-					},
-					ModeAlarmHistory: ModeAlarmHistoryIClimate{
-						Mode: []ModeIClimate{
-							{
-								Description: "Unknown",
-								Timestamp:   "16:00:00",
-							},
-						},
-						Alarms: []AlarmsIClimate{
-							{
-								Description: "Unknown",
-								Timestamp:   "16:00:00",
-							},
-						},
-					},
-				},
-				Metrics: MetricsIClimate{
-					AirTemp:        checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[14], d0Response[13]), 1, 100),
-					Rh:             prepareByte(d0Response[17], 0, 1),
-					Vpd:            checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[19], d0Response[18]), 1, 1000),
-					Light:          checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[35], d0Response[34]), 0, 1),
-					PowerFail:      getBoolFromByte(d1Response[2], 1),
-					FailSafeAlarms: getBoolFromByte(d1Response[2], 1),
-					DayNight:       formatDayNightValue(getBoolFromByte(d1Response[4], 4)),
-					Co2:            prepareInt(getFloatFrom2Bytes(d0Response[29], d0Response[28]), 0, 1),
-					Intruder:       getBoolFromByte(d0Response[42], 7),
-					OutsideTemp:    checkIntForNotAvailableValue(getSignedFloatFrom2Bytes(d0Response[37], d0Response[36]), 1, 100),
-					EnviroAirTemp1: checkIntForNotAvailableValue(getSignedFloatFrom2Bytes(d0Response[10], d0Response[9]), 1, 100),
-					EnviroAirTemp2: checkIntForNotAvailableValue(getSignedFloatFrom2Bytes(d0Response[12], d0Response[11]), 1, 100),
-					EnviroCO21:     checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[25], d0Response[24]), 0, 1),
-					EnviroCO22:     checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[27], d0Response[26]), 0, 1),
-					EnviroRH1:      prepareByte(d0Response[15], 0, 1),
-					EnviroRH2:      prepareByte(d0Response[16], 0, 1),
-					EnviroLight1:   checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[31], d0Response[30]), 0, 1),
-					EnviroLight2:   checkIntForNotAvailableValue(getFloatFrom2Bytes(d0Response[33], d0Response[32]), 0, 1),
-				},
-				Device:    name,
-				Timestamp: timestamp,
-				Source:    "Gateway",
-				Connected: true,
-			},
-		},
+	reported := newReportedIClimate(name, timestamp)
+	if err := iClimateLayout.decode([][]byte{d0Response, d1Response, d2Response, d3Response}, &reported); err != nil {
+		tell.Errorf("failed to parse %s: %s", name, err)
 	}
+
+	return iClimateShadow{State: StateIClimate{Reported: reported}}
 }
 
-func extractSetPointArray(d1Response []byte) []SetPointIClimate {
-	d1 := d1Response[2:]
-	return []SetPointIClimate{
-		{
-			LightBank:     getLightBoxTextByInt(int(d1[41])),
-			LightOn:       getFloatFrom2Bytes(d1[43], d1[42]),
-			LightDuration: getFloatFrom2Bytes(d1[45], d1[44]),
-			DayTemp:       prepareInt(getFloatFrom2Bytes(d1[47], d1[46]), 1, 100),
-			NightDropDeg:  prepareInt(getFloatFrom2Bytes(d1[49], d1[48]), 1, 100),
-			RhDay:         getFloatFrom2Bytes(d1[51], d1[50]),
-			RhNight:       getFloatFrom2Bytes(d1[53], d1[52]),
-			RhMax:         int(d1[54]),
-			CO2:           getFloatFrom2Bytes(d1[56], d1[55]),
-		},
-	}
+// extracts and set SetPointIClimate data to array
+func fillSetPointData(bytes *[]byte, iClimate SetPointIClimate) {
+	err := setPointLayout.encode(&iClimate, [][]byte{nil, *bytes}, true)
+	tell.IfErrorf(err, "failed to write set point")
 }
 
-func getBoolFromByte(b byte, bit int) bool {
-	binarystr := strconv.FormatInt(int64(b), 2)
-	out := []rune(binarystr)
-	if len(out) < 8 {
-		for i := len(out); i < 8; i++ {
-			out = append([]rune{'0'}, out...)
-		}
-	}
-	binary := string(out[bit])
-	value, err := strconv.ParseBool(binary)
-	tell.IfErrorf(err, "Error parsing bit value")
-	return value
+func extractSetPointArray(d1Response []byte) []SetPointIClimate {
+	var setPoint SetPointIClimate
+	err := setPointLayout.decode([][]byte{nil, d1Response}, &setPoint)
+	tell.IfErrorf(err, "failed to read set point")
+	return []SetPointIClimate{setPoint}
 }
 
 func getFloatFrom2Bytes(l byte, h byte) int {
@@ -1826,31 +840,10 @@ func toFixed(num float64, precision int) float64 {
 	return float64(round(num*output)) / output
 }
 
-func prepareByte(b byte, n int, d int) float64 {
-	return toFixed(float64(b)/float64(d), n)
-}
-
 func prepareInt(b int, n int, d int) float64 {
 	return toFixed(float64(b)/float64(d), n)
 }
 
-/*
-if value is valueUndefined => value is not available
-*/
-func checkIntForNotAvailableValue(b int, n int, d int) float64 {
-	if math.Abs(float64(b)) == valueUndefined {
-		return valueUndefined
-	}
-	return prepareInt(b, n, d)
-}
-
-func formatDayNightValue(b bool) string {
-	if b {
-		return "Day"
-	}
-	return "Night"
-}
-
 func createCheckSum(bytes *[]byte) {
 	ccittCrc := crc.CalculateCRC(crc.CRC16, (*bytes)[:len(*bytes)-2])
 	h := byte(ccittCrc)
@@ -1859,49 +852,6 @@ func createCheckSum(bytes *[]byte) {
 	(*bytes)[63] = l
 }
 
-func updateByte(oldByte byte, bol bool, pos int) byte {
-	binarystr := strconv.FormatInt(int64(oldByte), 2)
-	out := []rune(binarystr)
-	if len(out) < 8 {
-		for i := len(out); i < 8; i++ {
-			out = append([]rune{'0'}, out...)
-		}
-	}
-	out[pos] = parseBool(bol)
-	binarystr = string(out)
-	i, err := strconv.ParseInt(binarystr, 2, 64)
-	tell.IfErrorf(err, "Error parsing bit value")
-	return byte(i)
-}
-
-func getDefaultValue(b byte, defB byte) byte {
-	if b == 0 {
-		return defB
-	}
-	return b
-}
-
-func parseBool(bol bool) rune {
-	if bol {
-		return '1'
-	}
-	return '0'
-}
-
-func getCo2SensorRangeFromBool(bol bool) string {
-	if bol {
-		return "5000"
-	}
-	return "2000"
-}
-
-func getBoolFromCo2SensorRange(str string) bool {
-	if str == "5000" {
-		return true
-	}
-	return false
-}
-
 func getStatusIClimateFunctionByName(statuses []StatusStatusIClimate, statusName string) StatusStatusIClimate {
 	for _, status := range statuses {
 		if status.Function == statusName {
@@ -1927,179 +877,3 @@ func getStatusIDoseFunctionByName(statuses []StatusStatusIDose, statusName strin
 		Enabled: false,
 	}
 }
-
-func getPHMode(bol bool) string {
-	if bol {
-		return doserRaise
-	}
-	return doserLower
-}
-
-func getBoolFromPHMode(str string) bool {
-	if str == doserRaise {
-		return true
-	}
-	return false
-}
-
-func getPhDosingModeByBool(bolHi bool, bolLo bool) string {
-	if bolHi && bolLo {
-		return doserModeBoth
-	}
-	if bolHi {
-		return doserRaise
-	}
-	if bolLo {
-		return doserLower
-	}
-	return doserModeNone
-}
-
-func getPhDosingBoolByString(mode string) (bool, bool) {
-	switch mode {
-	case doserModeBoth:
-		return true, true
-	case doserRaise:
-		return true, false
-	case doserLower:
-		return false, true
-	default:
-		return false, false
-	}
-}
-
-func getLightBoxTextByInt(mode int) string {
-	switch mode {
-	case 0:
-		return doserModeNone
-	case 1:
-		return "1"
-	case 2:
-		return "2"
-	case 3:
-		return "alt"
-	case 4:
-		return doserModeBoth
-	default:
-		return "error"
-	}
-}
-
-func getLightBoxModeToInt(mode string) int {
-	switch mode {
-	case doserModeNone:
-		return 0
-	case "1":
-		return 1
-	case "2":
-		return 2
-	case "alt":
-		return 3
-	case doserModeBoth:
-		return 4
-	default:
-		return 99
-	}
-}
-
-func getIrrigationMode(sequential bool, independent bool) string {
-	if sequential && independent {
-		return irrigationModeSequential
-	}
-	if independent {
-		return irrigationModeIndependent
-	}
-	return irrigationModeSingle
-}
-
-func getIrrigationStationConfiguration(irrigateTOD bool, irrigateDayOnly bool) string {
-	if irrigateDayOnly {
-		return irrigationModeDuringDayOnly
-	}
-	if irrigateTOD {
-		return irrigationModeSameTime
-	}
-	return irrigationModeDayNight
-}
-
-func getIrrigationStationConfigurationByString(mode string) (bool, bool) {
-	irrigateTOD := false
-	irrigateDayOnly := false
-	if mode == irrigationModeDuringDayOnly {
-		irrigateDayOnly = true
-	}
-	if mode == irrigationModeSameTime {
-		irrigateTOD = true
-	}
-	return irrigateTOD, irrigateDayOnly
-}
-
-func isUSADateFormat(dateFormat string) bool {
-	if dateFormat == dateFormatUSA {
-		return true
-	}
-	return false
-}
-
-func getDateFormat(usaDateFormat bool) string {
-	if usaDateFormat {
-		return dateFormatUSA
-	}
-	return dateFormat
-}
-
-func isTemperatureF(temperature string) bool {
-	if temperature == temperatureF {
-		return true
-	}
-	return false
-}
-
-func getTemperatureF(temperature bool) string {
-	if temperature {
-		return temperatureF
-	}
-	return temperatureC
-}
-
-func getNutrientConfig(nutConfL bool, nutConfH bool) string {
-	if nutConfL {
-		return nutrientConfigCF
-	}
-	if nutConfH {
-		return nutrientConfigTDS
-	}
-	return nutrientConfigEC
-}
-
-func isNutrientConfig(nutConf string) (bool, bool) {
-	switch nutConf {
-	case nutrientConfigCF:
-		return false, true
-	case nutrientConfigTDS:
-		return true, false
-	default:
-		return false, false
-	}
-}
-
-func isDehumidifyBy(nutConf string) (bool, bool) {
-	switch nutConf {
-	case dehumidifyAirCon:
-		return false, true
-	case dehumidifyPurge:
-		return true, false
-	default:
-		return false, false
-	}
-}
-
-func getDehumidifyBy(purge bool, ac bool) string {
-	if purge {
-		return dehumidifyPurge
-	}
-	if ac {
-		return dehumidifyAirCon
-	}
-	return dehumidifyNone
-}
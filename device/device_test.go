@@ -0,0 +1,163 @@
+package device
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+// fakeHID is a HID device that answers each request written to it with the
+// reports returned by respond
+type fakeHID struct {
+	reports  chan []byte
+	requests [][]byte
+	respond  func(request []byte) [][]byte
+}
+
+func newFakeHID(respond func(request []byte) [][]byte) *fakeHID {
+	return &fakeHID{reports: make(chan []byte, 16), respond: respond}
+}
+
+func (f *fakeHID) Close()                {}
+func (f *fakeHID) ReadCh() <-chan []byte { return f.reports }
+func (f *fakeHID) ReadError() error      { return nil }
+func (f *fakeHID) Overflows() uint64     { return 0 }
+
+func (f *fakeHID) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case report := <-f.reports:
+		return report, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *fakeHID) GetFeatureReport(id byte, buf []byte) (int, error) {
+	return 0, hid.ErrNoFeatureReports
+}
+
+func (f *fakeHID) SendFeatureReport(data []byte) error {
+	return hid.ErrNoFeatureReports
+}
+
+func (f *fakeHID) Write(data []byte) error {
+	f.requests = append(f.requests, data)
+	for _, report := range f.respond(data) {
+		f.reports <- report
+	}
+	return nil
+}
+
+func newTestDevice(impl *fakeHID) *Device {
+	d := NewDevice("test", IntelliDoseDeviceType, "IntelliDose", hid.DeviceInfo{})
+	d.hidDevice.hidDeviceImpl = impl
+	d.IsOpen = true
+	d.requestTimeout = 50 * time.Millisecond
+	return d
+}
+
+func TestSentRequestDropsStaleReports(t *testing.T) {
+	impl := newFakeHID(func(request []byte) [][]byte {
+		return [][]byte{testFrame("D0"), testFrame(string(request[1:3]))}
+	})
+
+	// a late answer to an earlier request that is still queued
+	impl.reports <- testFrame("D2")
+
+	d := newTestDevice(impl)
+	frame, err := d.sentRequest(context.Background(), d1Request)
+	if err != nil {
+		t.Fatalf("expected a response, got %s", err)
+	}
+
+	if Frame(frame).Command() != "D1" {
+		t.Errorf("expected the response to D1, got %s", Frame(frame).Command())
+	}
+
+	if len(impl.requests) != 1 {
+		t.Errorf("expected 1 request, got %d", len(impl.requests))
+	}
+
+	if stats := d.Stats.Snapshot(); stats.UnexpectedCommands != 1 || stats.Frames != 1 {
+		t.Errorf("expected 1 stale report and 1 frame, got %+v", stats)
+	}
+}
+
+func TestSentRequestRetries(t *testing.T) {
+	attempts := 0
+	impl := newFakeHID(func(request []byte) [][]byte {
+		attempts++
+		switch attempts {
+		case 1:
+			return nil
+		case 2:
+			corrupt := testFrame("D1")
+			corrupt[10] ^= 0x01
+			return [][]byte{corrupt}
+		}
+		return [][]byte{testFrame("D1")}
+	})
+
+	d := newTestDevice(impl)
+	if _, err := d.sentRequest(context.Background(), d1Request); err != nil {
+		t.Fatalf("expected a response after retrying, got %s", err)
+	}
+
+	expected := FrameStats{Frames: 1, BadCRCs: 1, Timeouts: 1}
+	if stats := d.Stats.Snapshot(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestSentRequestTimeout(t *testing.T) {
+	impl := newFakeHID(func(request []byte) [][]byte { return nil })
+
+	d := newTestDevice(impl)
+	d.requestRetries = 1
+
+	if _, err := d.sentRequest(context.Background(), d1Request); err != ErrNoResponse {
+		t.Errorf("expected %s, got %v", ErrNoResponse, err)
+	}
+
+	if len(impl.requests) != 2 {
+		t.Errorf("expected the request to be sent twice, got %d", len(impl.requests))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := d.sentRequest(ctx, d1Request); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestPollSkipsWhileRunning(t *testing.T) {
+	impl := newFakeHID(func(request []byte) [][]byte { return nil })
+	d := newTestDevice(impl)
+
+	*d.polling = 1
+	d.poll(context.Background(), time.Second)
+
+	if len(impl.requests) != 0 {
+		t.Errorf("expected no requests while a poll is running, got %d", len(impl.requests))
+	}
+}
+
+func TestSentRequestSizedToOutputReport(t *testing.T) {
+	impl := newFakeHID(func(request []byte) [][]byte {
+		return [][]byte{testFrame(string(request[1:3]))}
+	})
+
+	d := newTestDevice(impl)
+	d.hidDevice.hidDevice.OutputReportLength = 80
+
+	if _, err := d.sentRequest(context.Background(), d1Request); err != nil {
+		t.Fatalf("expected a response, got %s", err)
+	}
+
+	if len(impl.requests[0]) != 81 {
+		t.Errorf("expected the request to be padded to 81 bytes, got %d", len(impl.requests[0]))
+	}
+}
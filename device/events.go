@@ -0,0 +1,290 @@
+package device
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// callbackBuffer is the number of events queued for callbacks like OnUpdate
+const callbackBuffer = 64
+
+// EventType is the type of something that happened to a device
+type EventType string
+
+// the types of event published on the bus
+const (
+	// DeviceAttached is published when a device is found, or comes back
+	// after going away, in which case Reconnected is set
+	DeviceAttached EventType = "attached"
+
+	// DeviceDetached is published when a device goes away, and again with
+	// Removed set once it has been gone longer than the reattach grace
+	DeviceDetached EventType = "detached"
+
+	// ShadowUpdated is published whenever the shadow of a device changes
+	ShadowUpdated EventType = "shadow_updated"
+
+	// PollFailed is published when the state couldn't be read from a device
+	PollFailed EventType = "poll_failed"
+
+	// WriteApplied is published when a patch has been written to a device
+	WriteApplied EventType = "write_applied"
+
+	// AlarmRaised is published when an alarm goes off on a device
+	AlarmRaised EventType = "alarm_raised"
+
+	// HealthChanged is published when the health of a device changes
+	HealthChanged EventType = "health_changed"
+)
+
+// Event is something that happened to a device
+type Event struct {
+	Type     EventType `json:"type"`
+	DeviceID string    `json:"device_id"`
+	Time     time.Time `json:"time"`
+
+	// Shadow is the shadow of the device when the event happened
+	Shadow interface{} `json:"shadow,omitempty"`
+
+	// Patch is the patch written by a WriteApplied event
+	Patch json.RawMessage `json:"patch,omitempty"`
+
+	// Alarm is the name of the alarm of an AlarmRaised event
+	Alarm string `json:"alarm,omitempty"`
+
+	// Error is why a poll failed
+	Error string `json:"error,omitempty"`
+
+	// Transition is the change in health of a HealthChanged event
+	Transition *HealthTransition `json:"transition,omitempty"`
+
+	Reconnected bool `json:"reconnected,omitempty"`
+	Removed     bool `json:"removed,omitempty"`
+
+	// Device is a copy of the device the event happened to, taken when the
+	// event was published
+	Device Device `json:"-"`
+}
+
+// Policy decides what is done with an event for a subscriber whose queue is
+// full
+type Policy int
+
+const (
+	// Drop throws the event away and counts it, so a slow subscriber never
+	// holds up the devices
+	Drop Policy = iota
+
+	// Block waits for the subscriber to make room for the event, holding up
+	// the devices and every other subscriber until it does
+	Block
+)
+
+// Bus delivers the events of the devices to any number of subscribers.
+// Events are queued for every subscriber in the order they are published, so
+// each subscriber sees the events of a device in the order they happened.
+type Bus struct {
+	mutex  *sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewBus returns a bus with no subscribers
+func NewBus() *Bus {
+	return &Bus{
+		mutex: new(sync.Mutex),
+		subs:  map[*Subscription]struct{}{},
+	}
+}
+
+// Subscription receives the events published on a bus until it is
+// unsubscribed
+type Subscription struct {
+	bus     *Bus
+	ch      chan Event
+	policy  Policy
+	done    chan struct{}
+	once    *sync.Once
+	dropped uint64
+}
+
+// Subscribe returns a subscription that queues up to size events, following
+// the policy when its queue is full
+func (b *Bus) Subscribe(size int, policy Policy) *Subscription {
+	s := &Subscription{
+		bus:    b,
+		ch:     make(chan Event, size),
+		policy: policy,
+		done:   make(chan struct{}),
+		once:   new(sync.Once),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		s.stop()
+		close(s.ch)
+		return s
+	}
+
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish queues the event for every subscriber
+func (b *Bus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for s := range b.subs {
+		s.deliver(ev)
+	}
+}
+
+// Close unsubscribes all the subscribers, closing their channels
+func (b *Bus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for s := range b.subs {
+		s.stop()
+		close(s.ch)
+		delete(b.subs, s)
+	}
+}
+
+// deliver queues the event, which must be done holding the bus lock
+func (s *Subscription) deliver(ev Event) {
+	select {
+	case s.ch <- ev:
+		return
+	default:
+	}
+
+	if s.policy == Block {
+		select {
+		case s.ch <- ev:
+			return
+		case <-s.done:
+		}
+	}
+
+	atomic.AddUint64(&s.dropped, 1)
+}
+
+// Events returns the channel the events are received on, which is closed
+// when the subscription is unsubscribed
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events dropped because the queue was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops the subscription and closes its channel
+func (s *Subscription) Unsubscribe() {
+	// wake up a publish blocked on this subscriber before waiting for the
+	// bus, as it holds the lock while it is blocked
+	s.stop()
+
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+}
+
+func (s *Subscription) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// onEvent calls the callback with each event received by the subscription,
+// one at a time and in order
+func onEvent(sub *Subscription, callback func(Event)) {
+	go func() {
+		for ev := range sub.Events() {
+			callback(ev)
+		}
+	}()
+}
+
+// publish publishes an event about the device on its bus
+func (d *Device) publish(ev Event) {
+	d.events.Publish(d.event(ev))
+}
+
+// event fills in the device the event happened to
+func (d *Device) event(ev Event) Event {
+	ev.DeviceID = d.ID
+	ev.Device = d.Snapshot()
+	return ev
+}
+
+// publishAlarms publishes an AlarmRaised event for each alarm in the shadow
+// that wasn't going off in the last one
+func (d *Device) publishAlarms(shadow interface{}) {
+	active := map[string]bool{}
+	for _, alarm := range alarms(shadow) {
+		active[alarm] = true
+		if !d.alarms[alarm] {
+			d.publish(Event{Type: AlarmRaised, Alarm: alarm, Shadow: shadow})
+		}
+	}
+	d.alarms = active
+}
+
+// alarms returns the names of the alarms going off in the shadow
+func alarms(shadow interface{}) []string {
+	var active []string
+
+	switch s := shadow.(type) {
+	case iClimateShadow:
+		metrics := s.State.Reported.Metrics
+		if metrics.FailSafeAlarms {
+			active = append(active, "fail_safe")
+		}
+		if metrics.PowerFail {
+			active = append(active, "power_fail")
+		}
+		if metrics.Intruder {
+			active = append(active, "intruder")
+		}
+	case iDoseShadow:
+		metrics := s.State.Reported.Metrics
+		limits := s.State.Reported.Status.Nutrient
+		active = outOfRange(active, "ec", limits.Ec.Enabled, metrics.Ec, limits.Ec.Min, limits.Ec.Max)
+		active = outOfRange(active, "ph", limits.Ph.Enabled, metrics.PH, limits.Ph.Min, limits.Ph.Max)
+		active = outOfRange(active, "nut_temp", limits.NutTemp.Enabled, metrics.NutTemp, limits.NutTemp.Min, limits.NutTemp.Max)
+	}
+
+	return active
+}
+
+// outOfRange adds a low or high alarm for a reading outside of its enabled
+// alarm limits.  A reading of an absent sensor never goes off.
+func outOfRange(active []string, name string, enabled bool, value, min, max float64) []string {
+	switch {
+	case !enabled, value == valueUndefined:
+	case value < min:
+		active = append(active, name+"_low")
+	case value > max:
+		active = append(active, name+"_high")
+	}
+	return active
+}
@@ -0,0 +1,177 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+// nextEvent returns the next event that isn't of the skipped type, or an empty
+// event once the subscription is closed
+func nextEvent(sub *Subscription, skip EventType) Event {
+	for ev := range sub.Events() {
+		if ev.Type != skip {
+			return ev
+		}
+	}
+	return Event{}
+}
+
+func TestBusOrderAndDrop(t *testing.T) {
+	bus := NewBus()
+	ordered := bus.Subscribe(10, Block)
+	dropping := bus.Subscribe(2, Drop)
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: ShadowUpdated, DeviceID: "dose-1", Shadow: i})
+	}
+
+	for i := 0; i < 5; i++ {
+		if ev := <-ordered.Events(); ev.Shadow != i {
+			t.Fatalf("expected event %d, got %v", i, ev.Shadow)
+		}
+	}
+
+	if dropping.Dropped() != 3 || len(dropping.Events()) != 2 {
+		t.Errorf("expected 3 events to be dropped, got %d with %d queued", dropping.Dropped(), len(dropping.Events()))
+	}
+
+	if ev := <-dropping.Events(); ev.Shadow != 0 || ev.Time.IsZero() {
+		t.Errorf("expected the oldest event to be kept with a time, got %+v", ev)
+	}
+}
+
+func TestBusUnsubscribeWakesPublish(t *testing.T) {
+	bus := NewBus()
+	blocked := bus.Subscribe(1, Block)
+	other := bus.Subscribe(10, Drop)
+
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(Event{Type: PollFailed})
+		bus.Publish(Event{Type: PollFailed})
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatalf("expected publish to block on the full subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	blocked.Unsubscribe()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatalf("expected unsubscribing to unblock publish")
+	}
+
+	if len(other.Events()) != 2 {
+		t.Errorf("expected the other subscriber to get both events, got %d", len(other.Events()))
+	}
+
+	// the blocked subscriber's channel is closed after what it had queued
+	<-blocked.Events()
+	if _, ok := <-blocked.Events(); ok {
+		t.Errorf("expected the channel to be closed")
+	}
+
+	bus.Close()
+	if _, ok := <-bus.Subscribe(1, Drop).Events(); ok {
+		t.Errorf("expected subscribing to a closed bus to return a closed subscription")
+	}
+}
+
+func TestAlarmRaisedOnce(t *testing.T) {
+	d := NewDevice("climate-1", IntelliClimateDeviceType, IntelliClimateDeviceNameLinux, hid.DeviceInfo{})
+	sub := d.Events().Subscribe(10, Drop)
+
+	var shadow iClimateShadow
+	shadow.State.Reported.Metrics.PowerFail = true
+	d.report(shadow)
+	d.report(shadow)
+
+	shadow.State.Reported.Metrics.PowerFail = false
+	d.report(shadow)
+	shadow.State.Reported.Metrics.PowerFail = true
+	d.report(shadow)
+
+	raised := 0
+	for len(sub.Events()) > 0 {
+		ev := <-sub.Events()
+		if ev.Type == AlarmRaised {
+			raised++
+			if ev.Alarm != "power_fail" || ev.DeviceID != "climate-1" {
+				t.Errorf("unexpected alarm %s from %s", ev.Alarm, ev.DeviceID)
+			}
+		}
+	}
+
+	if raised != 2 {
+		t.Errorf("expected the alarm to be raised each time it went off, got %d", raised)
+	}
+}
+
+func TestDoseAlarms(t *testing.T) {
+	var shadow iDoseShadow
+	shadow.State.Reported.Metrics.Ec = 2.5
+	shadow.State.Reported.Metrics.PH = 5
+	shadow.State.Reported.Status.Nutrient.Ec = EcIDose{Enabled: true, Min: 1, Max: 2}
+	shadow.State.Reported.Status.Nutrient.Ph = PhIDose{Enabled: false, Min: 5.5, Max: 6.5}
+
+	got := alarms(shadow)
+	if len(got) != 1 || got[0] != "ec_high" {
+		t.Errorf("expected only the enabled ec alarm, got %v", got)
+	}
+}
+
+func TestDoseAlarmsSkipAbsentSensors(t *testing.T) {
+	var shadow iDoseShadow
+	shadow.State.Reported.Metrics = MetricsIDose{Ec: valueUndefined, PH: valueUndefined, NutTemp: valueUndefined}
+	shadow.State.Reported.Status.Nutrient.Ec = EcIDose{Enabled: true, Min: 1, Max: 2}
+	shadow.State.Reported.Status.Nutrient.Ph = PhIDose{Enabled: true, Min: 5.5, Max: 6.5}
+	shadow.State.Reported.Status.Nutrient.NutTemp = NutTempIDose{Enabled: true, Min: 15, Max: 25}
+
+	if got := alarms(shadow); len(got) != 0 {
+		t.Errorf("expected no alarms from unplugged sensors, got %v", got)
+	}
+}
+
+func TestManagerEvents(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithReattachGrace(time.Minute))
+	sub := mgr.Subscribe(10, Block)
+
+	dose := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.discover()
+
+	backend.Unplug(dose.Info.Path)
+	mgr.discover()
+
+	back := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.hotplug(hid.Event{Action: hid.Add, Path: back.Info.Path, Info: &back.Info})
+
+	expected := []Event{
+		{Type: DeviceAttached},
+		{Type: DeviceDetached},
+		{Type: DeviceAttached, Reconnected: true},
+	}
+
+	for _, want := range expected {
+		ev := nextEvent(sub, HealthChanged)
+		if ev.Type != want.Type || ev.Reconnected != want.Reconnected || ev.DeviceID != "dose-1" {
+			t.Errorf("expected %s (reconnected %v) from dose-1, got %s (reconnected %v) from %s", want.Type, want.Reconnected, ev.Type, ev.Reconnected, ev.DeviceID)
+		}
+	}
+
+	mgr.shutdown()
+	if ev := nextEvent(sub, HealthChanged); ev.Type != DeviceDetached || !ev.Removed {
+		t.Errorf("expected the device to be removed on shutdown, got %s", ev.Type)
+	}
+
+	if ev := nextEvent(sub, HealthChanged); ev.Type != "" {
+		t.Errorf("expected the subscription to be closed on shutdown")
+	}
+}
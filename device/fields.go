@@ -0,0 +1,508 @@
+package device
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// field describes where a single value of a reported document is kept in the
+// state packets of a device.  The same description is used to parse the D
+// packets read from the device and to build the S packets written back to it.
+type field struct {
+	// path is the JSON path of the value in the reported document.  List
+	// elements are picked by index or by function name, for example
+	// status.status[ph].force_on or status.set_points[0].co2
+	path string
+
+	packet int // index of the D packet the value is kept in
+	offset int // offset of the lowest byte in the packet
+	bit    int // lowest bit for values narrower than a byte, 0 being the least significant
+	width  int // width of the value in bits, a byte when zero
+
+	signed    bool    // the raw value is two's complement
+	scale     float64 // the raw value is the value multiplied by scale, 1 when zero
+	precision int     // decimal places kept when parsing the value
+
+	enum      []string // names of the raw values of an enumerated field
+	undefined bool     // a raw value of 0x8000 means the sensor isn't available
+	readOnly  bool     // the value is measured or derived and never written to the device
+
+	// spread lists where the pieces of the value are kept, lowest first,
+	// when they aren't next to each other.  Each piece is a single bit for
+	// values narrower than a byte, and a whole byte otherwise.
+	spread []location
+}
+
+// location is a byte, or a bit within it, in one of the state packets
+type location struct {
+	packet int
+	offset int
+	bit    int
+}
+
+// layout is the field table of a device type along with the fix ups for the
+// few values that don't fit in a single field
+type layout struct {
+	fields []field
+
+	// decoded is called after the fields have been parsed into the reported
+	// document and encoding is called before they are written to the packets
+	decoded  func(p [][]byte, reported interface{})
+	encoding func(p [][]byte, reported interface{})
+
+	// shared are the paths of the read only fields that encoding writes
+	// through the function they share an output with
+	shared []string
+}
+
+func (f field) bits() int {
+	if f.width == 0 {
+		return 8
+	}
+	return f.width
+}
+
+func (f field) factor() float64 {
+	if f.scale == 0 {
+		return 1
+	}
+	return f.scale
+}
+
+// fits checks that every byte of the field is inside the packets
+func (f field) fits(p [][]byte) bool {
+	locations := f.spread
+	if len(locations) == 0 {
+		n := f.bits() / 8
+		if n == 0 {
+			n = 1
+		}
+		locations = []location{{f.packet, f.offset + n - 1, 0}}
+	}
+
+	for _, l := range locations {
+		if l.packet >= len(p) || l.offset >= len(p[l.packet]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// raw reads the unscaled value of the field from the packets
+func (f field) raw(p [][]byte) int {
+	width := f.bits()
+
+	var raw int
+	switch {
+	case len(f.spread) > 0 && width < 8:
+		for i, l := range f.spread {
+			raw |= int(p[l.packet][l.offset]>>uint(l.bit)&1) << uint(i)
+		}
+	case len(f.spread) > 0:
+		for i, l := range f.spread {
+			raw |= int(p[l.packet][l.offset]) << uint(8*i)
+		}
+	case width < 8:
+		raw = int(p[f.packet][f.offset]>>uint(f.bit)) & (1<<uint(width) - 1)
+	default:
+		for i := 0; i < width/8; i++ {
+			raw |= int(p[f.packet][f.offset+i]) << uint(8*i)
+		}
+	}
+
+	if f.signed && raw&(1<<uint(width-1)) != 0 {
+		raw -= 1 << uint(width)
+	}
+
+	return raw
+}
+
+// setRaw writes the unscaled value of the field into the packets, leaving the
+// other bits of the bytes it shares untouched
+func (f field) setRaw(p [][]byte, raw int) {
+	width := f.bits()
+
+	switch {
+	case len(f.spread) > 0 && width < 8:
+		for i, l := range f.spread {
+			setBits(&p[l.packet][l.offset], l.bit, 1, raw>>uint(i))
+		}
+	case len(f.spread) > 0:
+		for i, l := range f.spread {
+			p[l.packet][l.offset] = byte(raw >> uint(8*i))
+		}
+	case width < 8:
+		setBits(&p[f.packet][f.offset], f.bit, width, raw)
+	default:
+		for i := 0; i < width/8; i++ {
+			p[f.packet][f.offset+i] = byte(raw >> uint(8*i))
+		}
+	}
+}
+
+func setBits(b *byte, bit, width, value int) {
+	mask := byte(1<<uint(width)-1) << uint(bit)
+	*b = *b&^mask | byte(value<<uint(bit))&mask
+}
+
+// text returns the bytes of a fixed width string field
+func (f field) text(p [][]byte) []byte {
+	return p[f.packet][f.offset : f.offset+f.bits()/8]
+}
+
+// value scales the raw value of the field
+func (f field) value(raw int) float64 {
+	if f.undefined && math.Abs(float64(raw)) == valueUndefined {
+		return valueUndefined
+	}
+	return toFixed(float64(raw)/f.factor(), f.precision)
+}
+
+// rawValue is the reverse of value
+func (f field) rawValue(value float64) int {
+	if f.undefined && value == valueUndefined {
+		return int(valueUndefined)
+	}
+	return round(value * f.factor())
+}
+
+// name returns the name of a raw enumerated value, or the number itself when
+// the table doesn't know it so it can still be written back
+func (f field) name(raw int) string {
+	if raw >= 0 && raw < len(f.enum) {
+		return f.enum[raw]
+	}
+	return strconv.Itoa(raw)
+}
+
+func (f field) index(name string) (int, error) {
+	for i, n := range f.enum {
+		if n == name {
+			return i, nil
+		}
+	}
+
+	if raw, err := strconv.Atoi(name); err == nil && raw >= 0 && raw < 1<<uint(f.bits()) {
+		return raw, nil
+	}
+
+	return 0, &PatchError{fmt.Errorf("%q is not a valid value for %s, expected one of %s", name, f.path, strings.Join(f.enum, ", "))}
+}
+
+// decode parses the field from the packets into v
+func (f field) decode(p [][]byte, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		if f.enum == nil {
+			v.SetString(strings.TrimRight(string(f.text(p)), "\x00"))
+		} else {
+			v.SetString(f.name(f.raw(p)))
+		}
+	case reflect.Bool:
+		v.SetBool(f.raw(p) != 0)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(f.value(f.raw(p)))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(f.value(f.raw(p))))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(f.value(f.raw(p))))
+	default:
+		return fmt.Errorf("%s: can't parse into %s", f.path, v.Kind())
+	}
+
+	return nil
+}
+
+// encode writes v into the field in the packets
+func (f field) encode(v reflect.Value, p [][]byte) error {
+	switch v.Kind() {
+	case reflect.String:
+		if f.enum == nil {
+			b := f.text(p)
+			n := copy(b, v.String())
+			for i := n; i < len(b); i++ {
+				b[i] = 0
+			}
+			return nil
+		}
+
+		raw, err := f.index(v.String())
+		if err != nil {
+			return err
+		}
+		f.setRaw(p, raw)
+	case reflect.Bool:
+		raw := 0
+		if v.Bool() {
+			raw = 1
+		}
+		f.setRaw(p, raw)
+	case reflect.Float32, reflect.Float64:
+		f.setRaw(p, f.rawValue(v.Float()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.setRaw(p, f.rawValue(float64(v.Int())))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.setRaw(p, f.rawValue(float64(v.Uint())))
+	default:
+		return fmt.Errorf("%s: can't write a %s", f.path, v.Kind())
+	}
+
+	return nil
+}
+
+// decode parses every field from the packets into the reported document
+// pointed to by v
+func (l *layout) decode(p [][]byte, v interface{}) error {
+	rv := reflect.ValueOf(v).Elem()
+
+	for _, f := range l.fields {
+		if !f.fits(p) {
+			return fmt.Errorf("%s: packet D%d is too short", f.path, f.packet)
+		}
+
+		fv, err := lookup(rv, f.path)
+		if err != nil {
+			return err
+		}
+
+		if err := f.decode(p, fv); err != nil {
+			return err
+		}
+	}
+
+	if l.decoded != nil {
+		l.decoded(p, v)
+	}
+
+	return nil
+}
+
+// encode writes the reported document pointed to by v into the packets.  Read
+// only fields are skipped unless all is set.
+func (l *layout) encode(v interface{}, p [][]byte, all bool) error {
+	if l.encoding != nil {
+		l.encoding(p, v)
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+
+	for _, f := range l.fields {
+		if f.readOnly && !all {
+			continue
+		}
+
+		if !f.fits(p) {
+			return fmt.Errorf("%s: packet D%d is too short", f.path, f.packet)
+		}
+
+		fv, err := lookup(rv, f.path)
+		if err != nil {
+			return err
+		}
+
+		if err := f.encode(fv, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requests builds the S packets that write the reported document pointed to
+// by v to the device.  Each S packet starts out as a copy of the D packet it
+// mirrors so that the bytes the layout doesn't know about are kept.
+func (l *layout) requests(state [][]byte, v interface{}) ([][]byte, error) {
+	p := make([][]byte, len(state))
+	for i := range state {
+		p[i] = copyState(state[i])
+	}
+
+	if err := l.encode(v, p, false); err != nil {
+		return nil, err
+	}
+
+	requests := make([][]byte, 0, len(p)-1)
+	for i := 1; i < len(p); i++ {
+		p[i][0], p[i][1] = 'S', byte('0'+i-1)
+		p[i][61] = state[0][61]
+		createCheckSum(&p[i])
+		requests = append(requests, p[i])
+	}
+
+	return requests, nil
+}
+
+// validate checks that every value of the partial reported document can be
+// written to the device and would be read back the same, so that a desired
+// state made of them can be reported by the device
+func (l *layout) validate(doc map[string]interface{}) error {
+	return l.validateValue("", doc)
+}
+
+func (l *layout) validateValue(path string, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		for k, el := range value {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+
+			if err := l.validateValue(p, el); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		if !allObjects(value) {
+			break
+		}
+
+		// elements are picked by function name where they have one, as in
+		// the paths of the fields
+		for i, el := range value {
+			obj := copyDocument(el.(map[string]interface{}))
+			sel := strconv.Itoa(i)
+			if fn, ok := obj["function"].(string); ok {
+				sel = fn
+				delete(obj, "function")
+			}
+
+			if err := l.validateValue(fmt.Sprintf("%s[%s]", path, sel), obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, ok := l.writable(path)
+	if !ok {
+		return &PatchError{fmt.Errorf("%s can't be written to the device", path)}
+	}
+
+	return f.check(v)
+}
+
+// writable finds the field at the path if it is written to the device
+func (l *layout) writable(path string) (field, bool) {
+	for _, f := range l.fields {
+		if f.path != path {
+			continue
+		}
+
+		if !f.readOnly {
+			return f, true
+		}
+
+		for _, shared := range l.shared {
+			if shared == path {
+				return f, true
+			}
+		}
+		return f, false
+	}
+
+	return field{}, false
+}
+
+// check returns why the value can't be kept in the field as it is, because it
+// doesn't fit or has more decimal places than the field keeps
+func (f field) check(v interface{}) error {
+	switch value := v.(type) {
+	case string:
+		if f.enum != nil {
+			_, err := f.index(value)
+			return err
+		}
+
+		if len(value) > f.bits()/8 {
+			return &PatchError{fmt.Errorf("%s is longer than the %d characters it can hold", f.path, f.bits()/8)}
+		}
+	case float64:
+		raw := f.rawValue(value)
+		min, max := 0, 1<<uint(f.bits())-1
+		if f.signed {
+			min, max = -1<<uint(f.bits()-1), 1<<uint(f.bits()-1)-1
+		}
+
+		if raw < min || raw > max {
+			return &PatchError{fmt.Errorf("%v is out of range for %s, expected %v to %v", value, f.path, f.value(min), f.value(max))}
+		}
+
+		if f.value(raw) != value {
+			return &PatchError{fmt.Errorf("%v can't be kept by %s, which would read back as %v", value, f.path, f.value(raw))}
+		}
+	}
+
+	return nil
+}
+
+// lookup finds the value at the JSON path in v
+func lookup(v reflect.Value, path string) (reflect.Value, error) {
+	for _, part := range strings.Split(path, ".") {
+		name, sel := part, ""
+		if i := strings.IndexByte(part, '['); i >= 0 && strings.HasSuffix(part, "]") {
+			name, sel = part[:i], part[i+1:len(part)-1]
+		}
+
+		v = structField(v, name)
+		if !v.IsValid() {
+			return v, fmt.Errorf("%s: no such field %q", path, name)
+		}
+
+		if sel == "" {
+			continue
+		}
+
+		if v.Kind() != reflect.Slice {
+			return reflect.Value{}, fmt.Errorf("%s: %q is not a list", path, name)
+		}
+
+		v = element(v, sel)
+		if !v.IsValid() {
+			return v, fmt.Errorf("%s: no element %q in %q", path, sel, name)
+		}
+	}
+
+	return v, nil
+}
+
+// structField returns the field of the struct with the given JSON name
+func structField(v reflect.Value, name string) reflect.Value {
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == name {
+			return v.Field(i)
+		}
+	}
+
+	return reflect.Value{}
+}
+
+// element returns the list element at the index, or with the given function
+func element(list reflect.Value, sel string) reflect.Value {
+	if i, err := strconv.Atoi(sel); err == nil {
+		if i < 0 || i >= list.Len() {
+			return reflect.Value{}
+		}
+		return list.Index(i)
+	}
+
+	for i := 0; i < list.Len(); i++ {
+		if fn := structField(list.Index(i), "function"); fn.IsValid() && fn.String() == sel {
+			return list.Index(i)
+		}
+	}
+
+	return reflect.Value{}
+}
@@ -0,0 +1,328 @@
+package device
+
+var (
+	co2SensorRanges = []string{"2000", "5000"}
+	dehumidifyModes = []string{dehumidifyNone, dehumidifyAirCon, dehumidifyPurge, dehumidifyPurge}
+	dayNight        = []string{"Night", "Day"}
+	lightBankModes  = []string{doserModeNone, "1", "2", "alt", doserModeBoth}
+)
+
+// iClimateLayout describes where each value of an IntelliClimate shadow is
+// kept in the D0, D1, D2 and D3 packets
+var iClimateLayout = &layout{
+	fields:   append(iClimateFields, prefixed("status.set_points[0].", setPointFields)...),
+	encoding: iClimateEncoding,
+	shared: []string{
+		"status.status[air_conditioner].enabled",
+		"status.status[air_conditioner].force_on",
+		"status.status[co2_extraction].enabled",
+		"status.status[pulsed_fogger].enabled",
+		"status.status[pulsed_fogger].force_on",
+	},
+}
+
+// setPointLayout describes a single IntelliClimate set point in the D1 packet
+var setPointLayout = &layout{
+	fields: setPointFields,
+}
+
+var setPointFields = []field{
+	{path: "light_bank", packet: 1, offset: 43, enum: lightBankModes},
+	{path: "light_on", packet: 1, offset: 44, width: 16},
+	{path: "light_duration", packet: 1, offset: 46, width: 16},
+	{path: "day_temp", packet: 1, offset: 48, width: 16, scale: 100, precision: 1},
+	{path: "night_drop_deg", packet: 1, offset: 50, width: 16, scale: 100, precision: 1},
+	{path: "rh_day", packet: 1, offset: 52, width: 16},
+	{path: "rh_night", packet: 1, offset: 54, width: 16},
+	{path: "rh_max", packet: 1, offset: 56},
+	{path: "co2", packet: 1, offset: 57, width: 16},
+}
+
+var iClimateFields = []field{
+	// config
+	{path: "config.units.date_format", packet: 1, offset: 4, bit: 1, width: 1, enum: dateFormats},
+	{path: "config.units.temperature", packet: 1, offset: 4, bit: 0, width: 1, enum: temperatureUnits},
+
+	{path: "config.functions.fan_1", packet: 1, offset: 2, bit: 0, width: 1},
+	{path: "config.functions.fan_2", packet: 1, offset: 2, bit: 1, width: 1},
+	{path: "config.functions.air_conditioner", packet: 1, offset: 2, bit: 2, width: 1},
+	{path: "config.functions.heater", packet: 1, offset: 2, bit: 3, width: 1},
+	{path: "config.functions.co2_sensor", packet: 1, offset: 2, bit: 4, width: 1},
+	{path: "config.functions.co2_injection", packet: 1, offset: 2, bit: 5, width: 1},
+	{path: "config.functions.pulsed_fogger", packet: 1, offset: 2, bit: 6, width: 1},
+	{path: "config.functions.humidifier", packet: 1, offset: 2, bit: 7, width: 1},
+	{path: "config.functions.co2_sensor_range", packet: 2, offset: 2, bit: 7, width: 1, enum: co2SensorRanges},
+	{path: "config.functions.co2_extraction", packet: 2, offset: 2, bit: 6, width: 1},
+	{path: "config.functions.dehumidifier", packet: 1, offset: 3, bit: 0, width: 1},
+	{path: "config.functions.light_bank_1", packet: 1, offset: 3, bit: 1, width: 1},
+	{path: "config.functions.light_bank_2", packet: 1, offset: 3, bit: 2, width: 1},
+	{path: "config.functions.outside_temp_sensor", packet: 1, offset: 3, bit: 3, width: 1},
+	{path: "config.functions.second_enviro_sensor", packet: 1, offset: 3, bit: 4, width: 1},
+	{path: "config.functions.intruder_alarm", packet: 1, offset: 3, bit: 5, width: 1},
+	{path: "config.functions.lights_air_colored", packet: 1, offset: 3, bit: 7, width: 1},
+	{path: "config.functions.lamp_over_temp_shutdown_sensors", packet: 1, offset: 5, bit: 7, width: 1},
+	{path: "config.functions.dehumidify_by", packet: 1, offset: 4, bit: 6, width: 2, enum: dehumidifyModes},
+	{path: "config.functions.mute_buzzer", packet: 1, offset: 4, bit: 5, width: 1},
+
+	{path: "config.advanced.switching_offsets.heater_on", packet: 3, offset: 3, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.switching_offsets.heater_off", packet: 3, offset: 5, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.switching_offsets.fans_on", packet: 3, offset: 7, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.switching_offsets.fans_off", packet: 3, offset: 9, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.switching_offsets.air_conditioner_on", packet: 3, offset: 11, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.switching_offsets.air_conditioner_off", packet: 3, offset: 13, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.switching_offsets.humidifier_on", packet: 3, offset: 15, width: 16, signed: true, precision: 1},
+	{path: "config.advanced.switching_offsets.humidifier_off", packet: 3, offset: 17, width: 16, signed: true, precision: 1},
+	{path: "config.advanced.switching_offsets.dehumidifier_on", packet: 3, offset: 19, width: 16, signed: true, precision: 1},
+	{path: "config.advanced.switching_offsets.dehumidifier_off", packet: 3, offset: 21, width: 16, signed: true, precision: 1},
+	{path: "config.advanced.switching_offsets.co2_on", packet: 3, offset: 23, width: 16, signed: true, precision: 1},
+	{path: "config.advanced.switching_offsets.co2_off", packet: 3, offset: 25, width: 16, signed: true, precision: 1},
+
+	{path: "config.advanced.rules.minimum_air_change_rules.every_day_mins", packet: 2, offset: 41, width: 16},
+	{path: "config.advanced.rules.minimum_air_change_rules.every_night_mins", packet: 2, offset: 43, width: 16},
+	{path: "config.advanced.rules.minimum_air_change_rules.day_secs", packet: 2, offset: 45, width: 16},
+	{path: "config.advanced.rules.minimum_air_change_rules.night_secs", packet: 2, offset: 47, width: 16},
+	{path: "config.advanced.rules.humidify_temp_rules.lower_cooling_temp", packet: 2, offset: 24, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.rules.humidify_temp_rules.raise_heating_temp", packet: 2, offset: 27, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.rules.humidify_temp_rules.rh_low_then_raise", packet: 2, offset: 29, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.rules.humidify_temp_rules.prevent_heater", packet: 2, offset: 19},
+	{path: "config.advanced.rules.humidify_temp_rules.heating_offset", packet: 3, offset: 27, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.rules.allow_air_con", packet: 2, offset: 2, bit: 1, width: 1},
+	{path: "config.advanced.rules.setpoint_ramping.ramp_setpoints", packet: 2, offset: 18},
+	{path: "config.advanced.rules.air_con.force_air_con", packet: 2, offset: 2, bit: 4, width: 1},
+	{path: "config.advanced.rules.air_con.auto_change_air_con", packet: 2, offset: 39, width: 16, scale: 100, precision: 1},
+	{path: "config.advanced.rules.air_con.start_before", packet: 2, offset: 23},
+	{path: "config.advanced.rules.air_con.auto_start_air_con", packet: 2, offset: 21, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.rules.co2_rules.co2_injection_allowed", packet: 2, offset: 2, bit: 2, width: 1},
+	{path: "config.advanced.rules.co2_rules.inject_if_light_greater", packet: 2, offset: 49, width: 16, precision: 1},
+	{path: "config.advanced.rules.co2_rules.co2_injection_avoid", packet: 2, offset: 2, bit: 0, width: 1},
+	{path: "config.advanced.rules.co2_rules.co2_cycling", packet: 2, offset: 51, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.rules.co2_rules.rise_vent_temp", packet: 2, offset: 53, width: 16, signed: true, scale: 100, precision: 1},
+	{path: "config.advanced.rules.co2_rules.inject_time_min", packet: 2, offset: 55},
+	{path: "config.advanced.rules.co2_rules.inject_time_max", packet: 2, offset: 56},
+	{path: "config.advanced.rules.co2_rules.wait_time_min", packet: 2, offset: 57},
+	{path: "config.advanced.rules.co2_rules.wait_time_max", packet: 2, offset: 58},
+	{path: "config.advanced.rules.co2_rules.vent_time_min", packet: 2, offset: 59},
+	{path: "config.advanced.rules.co2_rules.vent_time_max", packet: 2, offset: 60},
+	{path: "config.advanced.rules.humidification.change_humidification", packet: 2, offset: 20},
+	{path: "config.advanced.rules.humidification.allow_humidification", packet: 2, offset: 2, bit: 5, width: 1},
+	{path: "config.advanced.rules.lighting.lamp_cool_down_time", packet: 2, offset: 15},
+	{path: "config.advanced.rules.lighting.sw_on_next_light_bank", packet: 2, offset: 17},
+	{path: "config.advanced.rules.fogging_rules.fog_to_cool", packet: 2, offset: 26},
+	{path: "config.advanced.rules.fogging_rules.fog_to_achieve_rh", packet: 2, offset: 34, width: 16, scale: 100, precision: 1},
+	{path: "config.advanced.rules.fogging_rules.fog_times", width: 16, spread: []location{{2, 36, 0}, {3, 29, 0}}},
+	{path: "config.advanced.rules.fogging_rules.fog_time_min", packet: 2, offset: 37},
+	{path: "config.advanced.rules.fogging_rules.fog_time_max", packet: 2, offset: 38},
+	{path: "config.advanced.rules.purging_rules.purge_mins", packet: 2, offset: 31},
+	{path: "config.advanced.rules.purging_rules.purge_min", packet: 2, offset: 32},
+	{path: "config.advanced.rules.purging_rules.purge_max", packet: 2, offset: 33},
+
+	{path: "config.advanced.fail_safe_settings.air_con_override.sw_all_exhaust_fans", packet: 2, offset: 3, width: 16, scale: 100, precision: 1},
+	{path: "config.advanced.fail_safe_settings.fan_fail_override.sw_off_light_temp_exceed", packet: 2, offset: 5, width: 16, scale: 100, precision: 1},
+	{path: "config.advanced.fail_safe_settings.fan_fail_override.sw_off_lights_temp_exceed", packet: 2, offset: 7, width: 16, scale: 100, precision: 1},
+	{path: "config.advanced.fail_safe_settings.dehumidifier_override.sw_on_fans_rh_exceed", packet: 2, offset: 9},
+	{path: "config.advanced.fail_safe_settings.dehumidifier_override.sw_ac_rh_exceed", packet: 2, offset: 10},
+	{path: "config.advanced.fail_safe_settings.co2_fail_safe.sw_on_fans_co2_exceed", packet: 2, offset: 11, width: 16},
+	{path: "config.advanced.fail_safe_settings.co2_injection_override.revert_fans_co2_falls", packet: 2, offset: 13, width: 16},
+	{path: "config.advanced.fail_safe_settings.power_failure.sw_lights_after_cool_down", packet: 2, offset: 16},
+	{path: "config.advanced.fail_safe_settings.light_falls_alarm_minimum.light_falls_alarm_minimum", packet: 2, offset: 2, bit: 3, width: 1},
+
+	{path: "config.general.device_name", packet: 1, offset: 33, width: 80},
+	{path: "config.general.firmware", packet: 0, offset: 7, width: 16, signed: true, scale: 100, precision: 2, readOnly: true},
+
+	// status
+	{path: "status.readings.air_temp.cool", packet: 1, offset: 10, width: 16, scale: 100, precision: 1},
+	{path: "status.readings.air_temp.min", packet: 1, offset: 12, width: 16, scale: 100, precision: 1},
+	{path: "status.readings.air_temp.max", packet: 1, offset: 14, width: 16, scale: 100, precision: 1},
+	{path: "status.readings.air_temp.heat", packet: 1, offset: 59, width: 16, scale: 100, precision: 1},
+	{path: "status.readings.air_temp.enabled", packet: 1, offset: 5, bit: 0, width: 1},
+	{path: "status.readings.rh.target", packet: 1, offset: 16},
+	{path: "status.readings.rh.min", packet: 1, offset: 17},
+	{path: "status.readings.rh.max", packet: 1, offset: 18},
+	{path: "status.readings.rh.enabled", packet: 1, offset: 5, bit: 1, width: 1},
+	{path: "status.readings.co2.target", packet: 1, offset: 25, width: 16},
+	{path: "status.readings.co2.min", packet: 1, offset: 27, scale: 1.0 / 25},
+	{path: "status.readings.co2.max", packet: 1, offset: 28, scale: 1.0 / 25},
+	{path: "status.readings.co2.enabled", packet: 1, offset: 5, bit: 2, width: 1},
+	{path: "status.readings.light.min", packet: 1, offset: 29, width: 16},
+	{path: "status.readings.light.enabled", packet: 1, offset: 5, bit: 3, width: 1},
+	{path: "status.readings.intruder.enabled", packet: 1, offset: 5, bit: 4, width: 1},
+	{path: "status.readings.power_fail.enabled", packet: 1, offset: 5, bit: 5, width: 1},
+	{path: "status.readings.fail_safe_alarms.enabled", packet: 1, offset: 4, bit: 3, width: 1},
+	{path: "status.readings.detent", packet: 1, offset: 9},
+
+	// the statistics overlap the device name, so are never written
+	{path: "status.statistics.lights", packet: 1, offset: 34, width: 16, scale: 100, precision: 1, readOnly: true},
+	{path: "status.statistics.CO2", packet: 0, offset: 40, width: 16, readOnly: true},
+
+	{path: "status.status[fan_1].active", packet: 0, offset: 43, bit: 0, width: 1, readOnly: true},
+	{path: "status.status[fan_1].enabled", packet: 1, offset: 6, bit: 0, width: 1},
+	{path: "status.status[fan_1].force_on", packet: 1, offset: 6, bit: 1, width: 1},
+	{path: "status.status[fan_1].installed", packet: 1, offset: 2, bit: 0, width: 1, readOnly: true},
+	{path: "status.status[fan_2].active", packet: 0, offset: 43, bit: 1, width: 1, readOnly: true},
+	{path: "status.status[fan_2].enabled", packet: 1, offset: 6, bit: 2, width: 1},
+	{path: "status.status[fan_2].force_on", packet: 1, offset: 6, bit: 3, width: 1},
+	{path: "status.status[fan_2].installed", packet: 1, offset: 2, bit: 1, width: 1, readOnly: true},
+	// the air conditioner is switched by the second fan output
+	{path: "status.status[air_conditioner].active", packet: 0, offset: 43, bit: 1, width: 1, readOnly: true},
+	{path: "status.status[air_conditioner].enabled", packet: 1, offset: 6, bit: 2, width: 1, readOnly: true},
+	{path: "status.status[air_conditioner].force_on", packet: 1, offset: 6, bit: 3, width: 1, readOnly: true},
+	{path: "status.status[air_conditioner].installed", packet: 1, offset: 2, bit: 2, width: 1, readOnly: true},
+	{path: "status.status[co2_injection].active", packet: 0, offset: 43, bit: 4, width: 1, readOnly: true},
+	{path: "status.status[co2_injection].enabled", packet: 1, offset: 5, bit: 6, width: 1},
+	{path: "status.status[co2_injection].installed", packet: 1, offset: 2, bit: 5, width: 1, readOnly: true},
+	// extraction shares the output of injection
+	{path: "status.status[co2_extraction].active", packet: 0, offset: 43, bit: 4, width: 1, readOnly: true},
+	{path: "status.status[co2_extraction].enabled", packet: 1, offset: 5, bit: 6, width: 1, readOnly: true},
+	{path: "status.status[co2_extraction].installed", packet: 1, offset: 2, bit: 5, width: 1, readOnly: true},
+	{path: "status.status[heater].active", packet: 0, offset: 43, bit: 2, width: 1, readOnly: true},
+	{path: "status.status[heater].enabled", packet: 1, offset: 6, bit: 4, width: 1},
+	{path: "status.status[heater].force_on", packet: 1, offset: 6, bit: 5, width: 1},
+	{path: "status.status[heater].installed", packet: 1, offset: 2, bit: 3, width: 1, readOnly: true},
+	{path: "status.status[dehumidifier].active", packet: 0, offset: 43, bit: 5, width: 1, readOnly: true},
+	{path: "status.status[dehumidifier].enabled", packet: 1, offset: 6, bit: 6, width: 1},
+	{path: "status.status[dehumidifier].force_on", packet: 1, offset: 6, bit: 7, width: 1},
+	{path: "status.status[dehumidifier].installed", packet: 1, offset: 3, bit: 0, width: 1, readOnly: true},
+	{path: "status.status[humidifier].active", packet: 0, offset: 43, bit: 3, width: 1, readOnly: true},
+	{path: "status.status[humidifier].enabled", packet: 1, offset: 7, bit: 0, width: 1},
+	{path: "status.status[humidifier].force_on", packet: 1, offset: 7, bit: 1, width: 1},
+	{path: "status.status[humidifier].installed", packet: 1, offset: 2, bit: 7, width: 1, readOnly: true},
+	{path: "status.status[light_bank_1].active", packet: 0, offset: 43, bit: 6, width: 1, readOnly: true},
+	{path: "status.status[light_bank_1].enabled", packet: 1, offset: 7, bit: 2, width: 1},
+	{path: "status.status[light_bank_1].force_on", packet: 1, offset: 7, bit: 3, width: 1},
+	{path: "status.status[light_bank_1].installed", packet: 1, offset: 3, bit: 1, width: 1, readOnly: true},
+	{path: "status.status[light_bank_2].active", packet: 0, offset: 43, bit: 7, width: 1, readOnly: true},
+	{path: "status.status[light_bank_2].enabled", packet: 1, offset: 7, bit: 4, width: 1},
+	{path: "status.status[light_bank_2].force_on", packet: 1, offset: 7, bit: 5, width: 1},
+	{path: "status.status[light_bank_2].installed", packet: 1, offset: 3, bit: 2, width: 1, readOnly: true},
+	// the pulsed fogger is switched by the humidifier output
+	{path: "status.status[pulsed_fogger].active", packet: 0, offset: 43, bit: 3, width: 1, readOnly: true},
+	{path: "status.status[pulsed_fogger].enabled", packet: 1, offset: 7, bit: 0, width: 1, readOnly: true},
+	{path: "status.status[pulsed_fogger].force_on", packet: 1, offset: 7, bit: 1, width: 1, readOnly: true},
+	{path: "status.status[pulsed_fogger].installed", packet: 1, offset: 2, bit: 6, width: 1, readOnly: true},
+	{path: "status.status[purge].enabled", packet: 1, offset: 7, bit: 6, width: 1},
+	{path: "status.status[purge].force_on", packet: 1, offset: 7, bit: 7, width: 1},
+
+	// metrics
+	{path: "metrics.enviro_air_temp_1", packet: 0, offset: 9, width: 16, signed: true, scale: 100, precision: 1, undefined: true, readOnly: true},
+	{path: "metrics.enviro_air_temp_2", packet: 0, offset: 11, width: 16, signed: true, scale: 100, precision: 1, undefined: true, readOnly: true},
+	{path: "metrics.air_temp", packet: 0, offset: 13, width: 16, scale: 100, precision: 1, undefined: true, readOnly: true},
+	{path: "metrics.enviro_rh_1", packet: 0, offset: 15, readOnly: true},
+	{path: "metrics.enviro_rh_2", packet: 0, offset: 16, readOnly: true},
+	{path: "metrics.rh", packet: 0, offset: 17, readOnly: true},
+	{path: "metrics.vpd", packet: 0, offset: 18, width: 16, scale: 1000, precision: 1, undefined: true, readOnly: true},
+	{path: "metrics.enviro_co2_1", packet: 0, offset: 24, width: 16, undefined: true, readOnly: true},
+	{path: "metrics.enviro_co2_2", packet: 0, offset: 26, width: 16, undefined: true, readOnly: true},
+	{path: "metrics.co2", packet: 0, offset: 28, width: 16, readOnly: true},
+	{path: "metrics.enviro_light_1", packet: 0, offset: 30, width: 16, undefined: true, readOnly: true},
+	{path: "metrics.enviro_light_2", packet: 0, offset: 32, width: 16, undefined: true, readOnly: true},
+	{path: "metrics.light", packet: 0, offset: 34, width: 16, undefined: true, readOnly: true},
+	{path: "metrics.outside_temp_sensor", packet: 0, offset: 36, width: 16, signed: true, scale: 100, precision: 1, undefined: true, readOnly: true},
+	{path: "metrics.intruder_alarm", packet: 0, offset: 42, bit: 0, width: 1, readOnly: true},
+	{path: "metrics.power_fail", packet: 1, offset: 2, bit: 6, width: 1, readOnly: true},
+	{path: "metrics.fail_safe_alarms", packet: 1, offset: 2, bit: 6, width: 1, readOnly: true},
+	{path: "metrics.day_night", packet: 1, offset: 4, bit: 3, width: 1, enum: dayNight, readOnly: true},
+}
+
+// prefixed returns a copy of the fields with the prefix added to their paths
+func prefixed(prefix string, fields []field) []field {
+	out := make([]field, len(fields))
+	for i, f := range fields {
+		f.path = prefix + f.path
+		out[i] = f
+	}
+	return out
+}
+
+// newReportedIClimate returns a reported document holding the values that
+// aren't kept in the packets, ready for the fields to be parsed into
+func newReportedIClimate(name string, timestamp int64) ReportedIClimate {
+	return ReportedIClimate{
+		Config: ConfigIClimate{
+			Functions: FunctionsIClimate{
+				Setup: "Manual",
+			},
+			Advanced: AdvancedIClimate{
+				SwitchingOffsets: SwitchingOffsetsIClimate{
+					PulsedFoggerOn:  10,
+					PulsedFoggerOff: 12,
+				},
+			},
+		},
+		Status: StatusIClimate{
+			Readings: ReadingsIClimate{
+				FailSafeAlarms: FailSafeAlarmsIClimate{
+					Page: true,
+				},
+			},
+			ModeAlarmHistory: ModeAlarmHistoryIClimate{
+				Mode: []ModeIClimate{
+					{
+						Description: "Unknown",
+						Timestamp:   "16:00:00",
+					},
+				},
+				Alarms: []AlarmsIClimate{
+					{
+						Description: "Unknown",
+						Timestamp:   "16:00:00",
+					},
+				},
+			},
+			SetPoints: []SetPointIClimate{{}},
+			Status: []StatusStatusIClimate{
+				{Function: fan1Function},
+				{Function: fan2Function},
+				{Function: airConFunction},
+				{Function: co2InjectionFunction},
+				{Function: co2ExtractFunction, ForceOn: true},
+				{Function: heaterFunction},
+				{Function: dehumidifierFunction},
+				{Function: humidifierFunction},
+				{Function: lightBank1Function},
+				{Function: lightBank2Function},
+				{Function: foggerFunction},
+				{Function: purgingFunction, Installed: true},
+			},
+		},
+		Device:    name,
+		Timestamp: timestamp,
+		Source:    "Gateway",
+		Connected: true,
+	}
+}
+
+// iClimateEncoding writes the status of the function that is actually
+// installed to the outputs that are shared between two functions
+func iClimateEncoding(p [][]byte, v interface{}) {
+	reported := v.(*ReportedIClimate)
+	functions := reported.Config.Functions
+
+	statuses := append([]StatusStatusIClimate{}, reported.Status.Status...)
+	share := func(to, from string) {
+		src := getStatusIClimateFunctionByName(statuses, from)
+		for i := range statuses {
+			if statuses[i].Function == to {
+				statuses[i].Enabled, statuses[i].ForceOn = src.Enabled, src.ForceOn
+			}
+		}
+	}
+
+	if !functions.Fan2 {
+		share(fan2Function, airConFunction)
+	}
+
+	if !functions.Humidifier {
+		share(humidifierFunction, foggerFunction)
+	}
+
+	if !functions.Co2Injection {
+		extraction := getStatusIClimateFunctionByName(statuses, co2ExtractFunction)
+		for i := range statuses {
+			if statuses[i].Function == co2InjectionFunction {
+				statuses[i].Enabled = extraction.Enabled
+			}
+		}
+	}
+
+	reported.Status.Status = statuses
+}
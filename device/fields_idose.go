@@ -0,0 +1,208 @@
+package device
+
+var (
+	phDosingModes          = []string{doserModeNone, doserRaise, doserLower, doserModeBoth}
+	phModes                = []string{doserLower, doserRaise}
+	irrigationModes        = []string{irrigationModeSingle, irrigationModeIndependent, irrigationModeSingle, irrigationModeSequential}
+	irrigationStationModes = []string{irrigationModeDayNight, irrigationModeSameTime, irrigationModeDuringDayOnly, irrigationModeDuringDayOnly}
+	dateFormats            = []string{dateFormat, dateFormatUSA}
+	temperatureUnits       = []string{temperatureC, temperatureF}
+	nutrientUnits          = []string{nutrientConfigEC, nutrientConfigCF, nutrientConfigTDS, nutrientConfigCF}
+
+	// irrigationInstalled is the bit that is set when there are any irrigation stations
+	irrigationInstalled = location{packet: 1, offset: 4, bit: 4}
+)
+
+const defaultNutrientsParts = 1
+
+// iDoseLayout describes where each value of an IntelliDose shadow is kept in
+// the D0, D1 and D2 packets
+var iDoseLayout = &layout{
+	fields:   iDoseFields,
+	decoded:  iDoseDecoded,
+	encoding: iDoseEncoding,
+	shared: []string{
+		"status.status[irrigation].enabled",
+		"status.status[irrigation].force_on",
+	},
+}
+
+var iDoseFields = []field{
+	// config
+	{path: "config.units.date_format", packet: 1, offset: 4, bit: 3, width: 1, enum: dateFormats},
+	{path: "config.units.temperature", packet: 1, offset: 4, bit: 0, width: 1, enum: temperatureUnits},
+	{path: "config.units.ec", packet: 1, offset: 4, bit: 1, width: 2, enum: nutrientUnits},
+	{path: "config.units.tds_conversation_standart", packet: 1, offset: 53, width: 16},
+	{path: "config.times.day_start", packet: 1, offset: 38, scale: 1.0 / 6},
+	{path: "config.times.day_end", packet: 1, offset: 39, scale: 1.0 / 6},
+	{path: "config.functions.nutrients_parts", packet: 1, offset: 40},
+	{path: "config.functions.ph_dosing", packet: 1, offset: 3, bit: 6, width: 2, enum: phDosingModes},
+	{path: "config.functions.irrigation_mode", width: 2, enum: irrigationModes, spread: []location{{1, 59, 0}, {1, 58, 0}}},
+	{path: "config.functions.irrigation_stations", packet: 1, offset: 60},
+	{path: "config.functions.separate_pump_output", packet: 1, offset: 5, bit: 6, width: 1},
+	{path: "config.functions.use_water", packet: 1, offset: 4, bit: 5, width: 1},
+	{path: "config.functions.external_alarm", packet: 1, offset: 2, bit: 5, width: 1},
+	{path: "config.functions.day_night_ec", packet: 1, offset: 3, bit: 5, width: 1},
+	{path: "config.functions.irrigation_station_1", width: 2, enum: irrigationStationModes, spread: []location{{1, 3, 4}, {1, 2, 0}}},
+	{path: "config.functions.irrigation_station_2", packet: 1, offset: 57, bit: 4, width: 2, enum: irrigationStationModes},
+	{path: "config.functions.irrigation_station_3", packet: 1, offset: 58, bit: 4, width: 2, enum: irrigationStationModes},
+	{path: "config.functions.irrigation_station_4", packet: 1, offset: 59, bit: 4, width: 2, enum: irrigationStationModes},
+	{path: "config.functions.mute_buzzer", packet: 1, offset: 5, bit: 3, width: 1},
+	{path: "config.advanced.proportinal_dosing", packet: 1, offset: 2, bit: 7, width: 1},
+	{path: "config.advanced.sequential_dosing", packet: 1, offset: 2, bit: 6, width: 1},
+	{path: "config.advanced.disable_ec", packet: 1, offset: 5, bit: 4, width: 1},
+	{path: "config.advanced.disable_ph", packet: 1, offset: 5, bit: 5, width: 1},
+	{path: "config.general.device_name", packet: 2, offset: 2, width: 80},
+	{path: "config.general.firmware", packet: 0, offset: 7, width: 16, signed: true, scale: 100, precision: 2, readOnly: true},
+
+	// status
+	{path: "status.nutrient.detent", packet: 1, offset: 6},
+	{path: "status.nutrient.ec.min", packet: 1, offset: 8, scale: 0.1, precision: 1},
+	{path: "status.nutrient.ec.max", packet: 1, offset: 7, scale: 0.1, precision: 1},
+	{path: "status.nutrient.ec.enabled", packet: 1, offset: 5, bit: 0, width: 1},
+	{path: "status.nutrient.ph.min", packet: 1, offset: 10, scale: 10, precision: 1},
+	{path: "status.nutrient.ph.max", packet: 1, offset: 9, scale: 10, precision: 1},
+	{path: "status.nutrient.ph.enabled", packet: 1, offset: 5, bit: 1, width: 1},
+	{path: "status.nutrient.nut_temp.min", packet: 1, offset: 13, width: 16, scale: 100, precision: 1},
+	{path: "status.nutrient.nut_temp.max", packet: 1, offset: 11, width: 16, scale: 100, precision: 1},
+	{path: "status.nutrient.nut_temp.enabled", packet: 1, offset: 5, bit: 2, width: 1},
+
+	{path: "status.status[Nutrient Dosing].active", packet: 0, offset: 15, bit: 0, width: 1, readOnly: true},
+	{path: "status.status[Nutrient Dosing].enabled", packet: 1, offset: 2, bit: 3, width: 1},
+	{path: "status.status[Nutrient Dosing].force_on", packet: 1, offset: 3, bit: 0, width: 1},
+	{path: "status.status[ph].active", packet: 0, offset: 15, bit: 1, width: 1, readOnly: true},
+	{path: "status.status[ph].enabled", packet: 1, offset: 5, bit: 7, width: 1},
+	{path: "status.status[ph].force_on", packet: 1, offset: 3, bit: 1, width: 1},
+	// the single irrigation output shares its bits with the first station
+	{path: "status.status[irrigation].active", packet: 0, offset: 17, bit: 0, width: 1, readOnly: true},
+	{path: "status.status[irrigation].enabled", packet: 1, offset: 2, bit: 2, width: 1, readOnly: true},
+	{path: "status.status[irrigation].force_on", packet: 1, offset: 3, bit: 3, width: 1, readOnly: true},
+	{path: "status.status[Irrigation Station 1].active", packet: 0, offset: 17, bit: 0, width: 1, readOnly: true},
+	{path: "status.status[Irrigation Station 1].enabled", packet: 1, offset: 2, bit: 2, width: 1},
+	{path: "status.status[Irrigation Station 1].force_on", packet: 1, offset: 3, bit: 3, width: 1},
+	{path: "status.status[Irrigation Station 2].active", packet: 0, offset: 17, bit: 1, width: 1, readOnly: true},
+	{path: "status.status[Irrigation Station 2].enabled", packet: 1, offset: 57, bit: 7, width: 1},
+	{path: "status.status[Irrigation Station 2].force_on", packet: 1, offset: 57, bit: 3, width: 1},
+	{path: "status.status[Irrigation Station 3].active", packet: 0, offset: 17, bit: 2, width: 1, readOnly: true},
+	{path: "status.status[Irrigation Station 3].enabled", packet: 1, offset: 58, bit: 7, width: 1},
+	{path: "status.status[Irrigation Station 3].force_on", packet: 1, offset: 58, bit: 3, width: 1},
+	{path: "status.status[Irrigation Station 4].active", packet: 0, offset: 17, bit: 3, width: 1, readOnly: true},
+	{path: "status.status[Irrigation Station 4].enabled", packet: 1, offset: 59, bit: 7, width: 1},
+	{path: "status.status[Irrigation Station 4].force_on", packet: 1, offset: 59, bit: 3, width: 1},
+	{path: "status.status[Water].active", packet: 0, offset: 15, bit: 3, width: 1, readOnly: true},
+	{path: "status.status[Water].enabled", packet: 1, offset: 2, bit: 1, width: 1},
+	{path: "status.status[Water].force_on", packet: 1, offset: 3, bit: 2, width: 1},
+
+	{path: "status.set_points.nutrient", packet: 1, offset: 15, width: 16},
+	{path: "status.set_points.nutrient_night", packet: 1, offset: 17, width: 16},
+	{path: "status.set_points.ph_dosing", packet: 1, offset: 2, bit: 4, width: 1, enum: phModes},
+	{path: "status.set_points.ph", packet: 1, offset: 19, scale: 10, precision: 1},
+
+	{path: "status.general.nutrient_dose_time", packet: 1, offset: 21},
+	{path: "status.general.max_nutrient_dose_time", packet: 1, offset: 20},
+	{path: "status.general.dose_interval", packet: 1, offset: 28},
+	{path: "status.general.water_on_time", packet: 1, offset: 37},
+	{path: "status.general.irrigation_interval_1.day", packet: 1, offset: 31, width: 16},
+	{path: "status.general.irrigation_interval_1.night", packet: 1, offset: 33, width: 16},
+	{path: "status.general.irrigation_interval_1.every", packet: 1, offset: 35, width: 16},
+	{path: "status.general.irrigation_interval_2.day", packet: 2, offset: 23, width: 16},
+	{path: "status.general.irrigation_interval_2.night", packet: 2, offset: 25, width: 16},
+	{path: "status.general.irrigation_interval_2.every", packet: 2, offset: 27, width: 16},
+	{path: "status.general.irrigation_interval_3.day", packet: 2, offset: 31, width: 16},
+	{path: "status.general.irrigation_interval_3.night", packet: 2, offset: 33, width: 16},
+	{path: "status.general.irrigation_interval_3.every", packet: 2, offset: 35, width: 16},
+	{path: "status.general.irrigation_interval_4.day", packet: 2, offset: 39, width: 16},
+	{path: "status.general.irrigation_interval_4.night", packet: 2, offset: 41, width: 16},
+	{path: "status.general.irrigation_interval_4.every", packet: 2, offset: 43, width: 16},
+	{path: "status.general.irrigation_duration_1", packet: 1, offset: 29, width: 16},
+	{path: "status.general.irrigation_duration_2", packet: 2, offset: 21, width: 16},
+	{path: "status.general.irrigation_duration_3", packet: 2, offset: 29, width: 16},
+	{path: "status.general.irrigation_duration_4", packet: 2, offset: 37, width: 16},
+	{path: "status.general.mix_1", packet: 1, offset: 22},
+	{path: "status.general.mix_2", packet: 1, offset: 23},
+	{path: "status.general.mix_3", packet: 1, offset: 24},
+	{path: "status.general.mix_4", packet: 1, offset: 48},
+	{path: "status.general.mix_5", packet: 1, offset: 49},
+	{path: "status.general.mix_6", packet: 1, offset: 50},
+	{path: "status.general.mix_7", packet: 1, offset: 51},
+	{path: "status.general.mix_8", packet: 1, offset: 52},
+	{path: "status.general.ph_dose_time", packet: 1, offset: 26},
+	{path: "status.general.max_ph_dose_time", packet: 1, offset: 25},
+
+	// metrics
+	{path: "metrics.ec", packet: 0, offset: 9, width: 16, precision: 1, undefined: true, readOnly: true},
+	{path: "metrics.pH", packet: 0, offset: 11, width: 16, scale: 100, precision: 1, undefined: true, readOnly: true},
+	{path: "metrics.nut_temp", packet: 0, offset: 13, width: 16, scale: 100, precision: 1, undefined: true, readOnly: true},
+}
+
+// newReportedIDose returns a reported document holding the values that aren't
+// kept in the packets, ready for the fields to be parsed into
+func newReportedIDose(name string, timestamp int64) ReportedIDose {
+	return ReportedIDose{
+		Config: ConfigIDose{
+			Advanced: AdvancedIDose{
+				MntnReminderFreq: "weekly",
+			},
+		},
+		Status: StatusIDose{
+			Status: []StatusStatusIDose{
+				{Function: nutrientDosingFunction},
+				{Function: phFunction},
+				{Function: irrigationFunction},
+				{Function: irrigationStation1Function},
+				{Function: irrigationStation2Function},
+				{Function: irrigationStation3Function},
+				{Function: irrigationStation4Function},
+				{Function: waterFunction},
+			},
+		},
+		Device:    name,
+		Timestamp: timestamp,
+		Source:    "Gateway",
+		Connected: true,
+	}
+}
+
+// iDoseDecoded fixes up the number of irrigation stations, which is only
+// meaningful when irrigation is installed, and the number of nutrient parts
+func iDoseDecoded(p [][]byte, v interface{}) {
+	reported := v.(*ReportedIDose)
+	functions := &reported.Config.Functions
+
+	switch {
+	case p[1][irrigationInstalled.offset]>>uint(irrigationInstalled.bit)&1 == 0:
+		functions.IrrigationStations = 0
+	case functions.IrrigationStations == 0:
+		functions.IrrigationStations = 1
+	}
+
+	if functions.NutrientsParts == 0 {
+		functions.NutrientsParts = defaultNutrientsParts
+	}
+}
+
+// iDoseEncoding marks irrigation as installed when there are any stations, and
+// writes the single irrigation output over the first station unless the
+// stations run independently
+func iDoseEncoding(p [][]byte, v interface{}) {
+	reported := v.(*ReportedIDose)
+
+	installed := 0
+	if reported.Config.Functions.IrrigationStations > 0 {
+		installed = 1
+	}
+	setBits(&p[1][irrigationInstalled.offset], irrigationInstalled.bit, 1, installed)
+
+	if reported.Config.Functions.IrrigationMode == irrigationModeIndependent {
+		return
+	}
+
+	statuses := append([]StatusStatusIDose{}, reported.Status.Status...)
+	irrigation := getStatusIDoseFunctionByName(statuses, irrigationFunction)
+	for i := range statuses {
+		if statuses[i].Function == irrigationStation1Function {
+			statuses[i].Enabled, statuses[i].ForceOn = irrigation.Enabled, irrigation.ForceOn
+		}
+	}
+	reported.Status.Status = statuses
+}
@@ -0,0 +1,205 @@
+package device
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// blankPackets returns zeroed state packets that parse into a consistent
+// reported document for the layout
+func blankPackets(l *layout) [][]byte {
+	n := 3
+	if l == iClimateLayout {
+		n = 4
+	}
+
+	p := make([][]byte, n)
+	for i := range p {
+		p[i] = make([]byte, requestLength)
+		p[i][0], p[i][1] = 'D', byte('0'+i)
+	}
+
+	if l == iDoseLayout {
+		// stations are only kept when irrigation is installed, and there is
+		// always at least one nutrient part
+		setBits(&p[1][irrigationInstalled.offset], irrigationInstalled.bit, 1, 1)
+		p[1][40] = defaultNutrientsParts
+		p[1][60] = 1
+	}
+
+	return p
+}
+
+// testValues returns raw values for the field that survive being scaled and
+// rounded to its precision
+func testValues(f field) []int {
+	if f.enum != nil {
+		var values []int
+		for i, name := range f.enum {
+			if i > 0 && indexOf(f.enum, name) == i {
+				values = append(values, i)
+			}
+		}
+		return values
+	}
+
+	width := f.bits()
+	if width < 8 {
+		return []int{1}
+	}
+
+	step := int(math.Ceil(f.factor() / math.Pow(10, float64(f.precision))))
+	if step < 1 {
+		step = 1
+	}
+
+	values := []int{step * 3}
+	if width >= 16 {
+		values = append(values, step*301)
+	}
+	if f.signed {
+		values = append(values, -step*3)
+	}
+	if f.undefined && f.signed {
+		values = append(values, -int(valueUndefined))
+	} else if f.undefined {
+		values = append(values, int(valueUndefined))
+	}
+
+	return values
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func testRoundTrip(t *testing.T, l *layout, newReported func() interface{}) {
+	for _, f := range l.fields {
+		if f.enum == nil && f.bits() > 16 {
+			p := blankPackets(l)
+			copy(f.text(p), "grow room")
+			checkRoundTrip(t, l, f, p, newReported())
+			continue
+		}
+
+		for _, raw := range testValues(f) {
+			p := blankPackets(l)
+			f.setRaw(p, raw)
+			if f.raw(p) != raw {
+				t.Fatalf("%s: wrote %d but read back %d", f.path, raw, f.raw(p))
+			}
+			checkRoundTrip(t, l, f, p, newReported())
+		}
+	}
+}
+
+func checkRoundTrip(t *testing.T, l *layout, f field, p [][]byte, reported interface{}) {
+	if err := l.decode(p, reported); err != nil {
+		t.Fatalf("%s: failed to decode: %s", f.path, err)
+	}
+
+	encoded := blankPackets(l)
+	if err := l.encode(reported, encoded, true); err != nil {
+		t.Fatalf("%s: failed to encode: %s", f.path, err)
+	}
+
+	for i := range p {
+		if !bytes.Equal(p[i], encoded[i]) {
+			t.Errorf("%s: D%d changed after a round trip\nexpected % x\n     got % x", f.path, i, p[i], encoded[i])
+		}
+	}
+}
+
+func TestIDoseFieldsRoundTrip(t *testing.T) {
+	testRoundTrip(t, iDoseLayout, func() interface{} {
+		r := newReportedIDose("test", 0)
+		return &r
+	})
+}
+
+func TestIClimateFieldsRoundTrip(t *testing.T) {
+	testRoundTrip(t, iClimateLayout, func() interface{} {
+		r := newReportedIClimate("test", 0)
+		return &r
+	})
+}
+
+func TestIDosePhForceOn(t *testing.T) {
+	p := blankPackets(iDoseLayout)
+	p[1][3] = 0x02
+
+	shadow := parseByteResponseForIDose(p[0], p[1], p[2], "test", 0)
+	ph := getStatusIDoseFunctionByName(shadow.State.Reported.Status.Status, phFunction)
+	if !ph.ForceOn {
+		t.Errorf("expected pH to be forced on")
+	}
+
+	for _, status := range shadow.State.Reported.Status.Status {
+		if status.Function != phFunction && status.ForceOn {
+			t.Errorf("expected only pH to be forced on, got %+v", status)
+		}
+	}
+}
+
+func TestLayoutRequests(t *testing.T) {
+	state := blankPackets(iDoseLayout)
+	state[0][61] = 0x2a
+	state[1][27] = 0x99 // not described by the layout
+
+	reported := newReportedIDose("test", 0)
+	if err := iDoseLayout.decode(state, &reported); err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+
+	reported.Status.SetPoints.Ph = 6.1
+	reported.Config.General.DeviceName = "tent 2"
+
+	requests, err := iDoseLayout.requests(state, &reported)
+	if err != nil {
+		t.Fatalf("failed to build requests: %s", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+
+	s0, s1 := requests[0], requests[1]
+	if s0[0] != 'S' || s0[1] != '0' || s1[0] != 'S' || s1[1] != '1' {
+		t.Errorf("expected S0 and S1 headers, got %q and %q", s0[:2], s1[:2])
+	}
+
+	if s0[19] != 61 {
+		t.Errorf("expected pH set point of 61, got %d", s0[19])
+	}
+
+	if string(s1[2:8]) != "tent 2" {
+		t.Errorf("expected the device name in S1, got %q", s1[2:12])
+	}
+
+	if s0[27] != 0x99 || s0[61] != 0x2a || s1[61] != 0x2a {
+		t.Errorf("expected unknown bytes to be kept")
+	}
+
+	if state[1][19] != 0 || state[1][0] != 'D' {
+		t.Errorf("expected the state packets to be left alone")
+	}
+
+	sum := append([]byte{}, s0...)
+	createCheckSum(&sum)
+	if !bytes.Equal(sum, s0) {
+		t.Errorf("expected a valid checksum on S0")
+	}
+
+	reported.Config.Functions.PhDosing = "sideways"
+	if _, err := iDoseLayout.requests(state, &reported); err == nil {
+		t.Errorf("expected an error for an unknown pH dosing mode")
+	} else if _, ok := err.(*PatchError); !ok {
+		t.Errorf("expected a patch error, got %T", err)
+	}
+}
@@ -0,0 +1,120 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+
+	"github.com/snksoft/crc"
+)
+
+const (
+	frameLength = requestLength
+	crcOffset   = frameLength - 2
+)
+
+var (
+	// ErrShortFrame is returned when a response from a device is shorter than a full packet
+	ErrShortFrame = errors.New("short frame")
+
+	// ErrUnexpectedCommand is returned when a response from a device doesn't
+	// echo the command of the request it should answer
+	ErrUnexpectedCommand = errors.New("frame has an unexpected command")
+
+	// ErrBadCRC is returned when the checksum of a response from a device
+	// doesn't match its contents
+	ErrBadCRC = errors.New("frame failed its CRC check")
+)
+
+// Frame is a single response packet read from a device.  The first two bytes
+// echo the command it answers (for example D0) and the last two are the
+// CRC16 of the rest of the packet, low byte first.
+type Frame []byte
+
+// NewFrame checks that the data read from a device is a complete, intact
+// response to the given two byte command, and returns it as a frame.
+func NewFrame(data []byte, command []byte) (Frame, error) {
+	f := Frame(data)
+
+	if len(f) < frameLength {
+		return nil, ErrShortFrame
+	}
+
+	if len(command) < 2 || f[0] != command[0] || f[1] != command[1] {
+		return nil, ErrUnexpectedCommand
+	}
+
+	if f.checksum() != f.crc() {
+		return nil, ErrBadCRC
+	}
+
+	return f[:frameLength], nil
+}
+
+// Command returns the command the frame answers, for example "D0"
+func (f Frame) Command() string {
+	return string(f[:2])
+}
+
+// checksum is the CRC sent with the frame
+func (f Frame) checksum() uint16 {
+	return uint16(f[crcOffset]) | uint16(f[crcOffset+1])<<8
+}
+
+// crc is the CRC calculated over the contents of the frame
+func (f Frame) crc() uint16 {
+	return uint16(crc.CalculateCRC(crc.CRC16, f[:crcOffset]))
+}
+
+// isFrameError returns true if the error is from a corrupt response, rather
+// than from failing to talk to the device at all
+func isFrameError(err error) bool {
+	return err == ErrShortFrame || err == ErrUnexpectedCommand || err == ErrBadCRC
+}
+
+// FrameStats counts the responses read from a device, those that were
+// dropped for being corrupt or stale, and the requests that went unanswered
+type FrameStats struct {
+	Frames             uint64 `json:"frames"`
+	ShortFrames        uint64 `json:"short_frames"`
+	UnexpectedCommands uint64 `json:"unexpected_commands"`
+	BadCRCs            uint64 `json:"bad_crcs"`
+	Timeouts           uint64 `json:"timeouts"`
+
+	// Overflows is the number of input reports the HID device has dropped
+	// since it was opened because they weren't read in time
+	Overflows uint64 `json:"overflows"`
+}
+
+// count adds the result of checking a frame to the stats
+func (s *FrameStats) count(err error) {
+	switch err {
+	case nil:
+		atomic.AddUint64(&s.Frames, 1)
+	case ErrShortFrame:
+		atomic.AddUint64(&s.ShortFrames, 1)
+	case ErrUnexpectedCommand:
+		atomic.AddUint64(&s.UnexpectedCommands, 1)
+	case ErrBadCRC:
+		atomic.AddUint64(&s.BadCRCs, 1)
+	}
+}
+
+// Snapshot returns a copy of the stats that is safe to read
+func (s *FrameStats) Snapshot() FrameStats {
+	return FrameStats{
+		Frames:             atomic.LoadUint64(&s.Frames),
+		ShortFrames:        atomic.LoadUint64(&s.ShortFrames),
+		UnexpectedCommands: atomic.LoadUint64(&s.UnexpectedCommands),
+		BadCRCs:            atomic.LoadUint64(&s.BadCRCs),
+		Timeouts:           atomic.LoadUint64(&s.Timeouts),
+		Overflows:          atomic.LoadUint64(&s.Overflows),
+	}
+}
+
+// MarshalJSON encodes a snapshot of the stats
+func (s *FrameStats) MarshalJSON() ([]byte, error) {
+	type stats FrameStats
+	snapshot := stats(s.Snapshot())
+	return json.Marshal(snapshot)
+}
@@ -0,0 +1,58 @@
+package device
+
+import (
+	"testing"
+)
+
+func testFrame(command string) []byte {
+	data := make([]byte, frameLength)
+	copy(data, command)
+	data[10], data[11] = 0x3c, 0x02
+	createCheckSum(&data)
+	return data
+}
+
+func TestNewFrame(t *testing.T) {
+	command := d1Request[1:3]
+
+	f, err := NewFrame(testFrame("D1"), command)
+	if err != nil {
+		t.Fatalf("expected a valid frame, got %s", err)
+	}
+
+	if f.Command() != "D1" {
+		t.Errorf("expected command D1, got %s", f.Command())
+	}
+
+	corrupt := testFrame("D1")
+	corrupt[10] ^= 0x01
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short", testFrame("D1")[:40], ErrShortFrame},
+		{"empty", nil, ErrShortFrame},
+		{"wrong command", testFrame("D2"), ErrUnexpectedCommand},
+		{"corrupt", corrupt, ErrBadCRC},
+	}
+
+	for _, test := range tests {
+		if _, err := NewFrame(test.data, command); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestFrameStats(t *testing.T) {
+	stats := &FrameStats{}
+	for _, err := range []error{nil, nil, ErrBadCRC, ErrShortFrame, ErrUnexpectedCommand, ErrBadCRC} {
+		stats.count(err)
+	}
+
+	expected := FrameStats{Frames: 2, ShortFrames: 1, UnexpectedCommands: 1, BadCRCs: 2}
+	if got := stats.Snapshot(); got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
@@ -0,0 +1,79 @@
+package device
+
+import (
+	"time"
+)
+
+// defaultStaleAfter is the number of polls in a row a device can miss before
+// its shadow is marked as stale
+const defaultStaleAfter = 3
+
+// Freshness says how up to date the reported state in a shadow is
+type Freshness struct {
+	// LastSeen is when the state was read from the device, in milliseconds
+	// since the epoch
+	LastSeen int64 `json:"last_seen"`
+
+	// Sequence goes up by one each time the state is read from the device
+	Sequence uint64 `json:"sequence"`
+
+	// LastError is why the last poll failed, and MissedPolls the number of
+	// polls in a row that have failed since the state was last read
+	LastError   string `json:"last_error,omitempty"`
+	MissedPolls int    `json:"missed_polls"`
+
+	// Stale is set once too many polls have been missed, or the device has
+	// been unplugged, and the state is then no longer current
+	Stale bool `json:"stale"`
+}
+
+// seen records that the state has just been read from the device, which must
+// be done holding the state lock
+func (f *Freshness) seen(now time.Time) {
+	f.LastSeen = now.UnixNano() / int64(time.Millisecond)
+	f.Sequence++
+	f.LastError = ""
+	f.MissedPolls = 0
+	f.Stale = false
+}
+
+// stamp sets the freshness of the reported state in the shadow, marking it
+// as not connected when it is stale.  It must be done holding the state lock.
+func (d *Device) stamp(shadow interface{}) interface{} {
+	switch s := shadow.(type) {
+	case iDoseShadow:
+		s.State.Reported.Freshness = d.freshness
+		s.State.Reported.Connected = !d.freshness.Stale
+		return s
+	case iClimateShadow:
+		s.State.Reported.Freshness = d.freshness
+		s.State.Reported.Connected = !d.freshness.Stale
+		return s
+	}
+
+	return shadow
+}
+
+// missed records that the state couldn't be read from the device, marking
+// the shadow as stale once staleAfter polls have been missed in a row
+func (d *Device) missed(reason string, staleAfter int) {
+	d.state.Lock()
+	d.freshness.LastError = reason
+	d.freshness.MissedPolls++
+	if d.freshness.MissedPolls >= staleAfter {
+		d.freshness.Stale = true
+	}
+	d.state.Unlock()
+
+	d.refresh()
+}
+
+// markStale marks the shadow of a device that has gone away as stale
+func (d *Device) markStale(reason string) {
+	d.state.Lock()
+	d.freshness.LastError = reason
+	d.freshness.Stale = true
+	d.state.Unlock()
+
+	d.refresh()
+}
@@ -0,0 +1,71 @@
+package device
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+// reported returns the reported state in the shadow of an IntelliDose
+func reported(t *testing.T, d *Device) ReportedIDose {
+	shadow, ok := d.shadow().(iDoseShadow)
+	if !ok {
+		t.Fatalf("expected an IntelliDose shadow, got %T", d.shadow())
+	}
+	return shadow.State.Reported
+}
+
+func TestShadowGoesStale(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithRequestTimeout(10*time.Millisecond), WithRequestRetries(0), WithStaleAfter(2))
+
+	packets := blankPackets(iDoseLayout)
+	dose := plugIDose(backend, "dose-1", packets)
+	mgr.discover()
+
+	d, _ := mgr.FindDevice("dose-1")
+	d.open()
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	d.poll(context.Background(), time.Second)
+
+	r := reported(t, d)
+	if !r.Connected || r.Stale || r.Sequence != 1 || r.LastSeen < before {
+		t.Fatalf("expected a fresh first sample seen after %d, got %+v", before, r.Freshness)
+	}
+
+	for _, prefix := range []string{"D0", "D1", "D2"} {
+		dose.Respond([]byte(prefix))
+	}
+
+	d.poll(context.Background(), time.Second)
+	if r := reported(t, d); !r.Connected || r.MissedPolls != 1 || r.LastError != ErrNoResponse.Error() {
+		t.Errorf("expected one missed poll to be tolerated, got %+v", r.Freshness)
+	}
+
+	d.poll(context.Background(), time.Second)
+	if r := reported(t, d); r.Connected || !r.Stale || r.Sequence != 1 {
+		t.Errorf("expected the shadow to be stale after two missed polls, got connected %v %+v", r.Connected, r.Freshness)
+	}
+
+	// answer again
+	for _, packet := range packets {
+		response := append([]byte{}, packet...)
+		createCheckSum(&response)
+		dose.Respond(packet[:2], response)
+	}
+
+	d.poll(context.Background(), time.Second)
+	if r := reported(t, d); !r.Connected || r.Stale || r.Sequence != 2 || r.LastError != "" {
+		t.Errorf("expected the shadow to be fresh again, got connected %v %+v", r.Connected, r.Freshness)
+	}
+
+	backend.Unplug(dose.Info.Path)
+	mgr.hotplug(hid.Event{Action: hid.Remove, Path: dose.Info.Path})
+
+	if r := reported(t, d); r.Connected || !r.Stale || r.LastError != "unplugged" {
+		t.Errorf("expected the shadow of an unplugged device to be stale, got connected %v %+v", r.Connected, r.Freshness)
+	}
+}
@@ -0,0 +1,220 @@
+package device
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/util/tell"
+)
+
+const (
+	defaultDegradeAfter      = 3
+	defaultReconnectDelay    = time.Second
+	defaultReconnectMaxDelay = time.Minute
+
+	// maxHealthTransitions is the number of transitions kept in the history
+	maxHealthTransitions = 10
+)
+
+// Health is the state of the connection to a device
+type Health string
+
+// the states of the connection to a device
+const (
+	// Discovered devices have been found but not opened yet
+	Discovered Health = "discovered"
+
+	// Opening devices are being opened, and haven't been polled since
+	Opening Health = "opening"
+
+	// Online devices are answering polls
+	Online Health = "online"
+
+	// Degraded devices are still open but have failed several polls in a
+	// row, which usually means a flaky USB connection
+	Degraded Health = "degraded"
+
+	// Offline devices can't be opened, or have been unplugged and might come
+	// back
+	Offline Health = "offline"
+
+	// Removed devices have been forgotten by the manager
+	Removed Health = "removed"
+)
+
+// HealthTransition is a change in the health of a device
+type HealthTransition struct {
+	From   Health    `json:"from"`
+	To     Health    `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// HealthStatus is the health of a device, and how it got there
+type HealthStatus struct {
+	State  Health    `json:"state"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+
+	// FailedPolls and FailedOpens count the failures in a row
+	FailedPolls int `json:"failed_polls"`
+	FailedOpens int `json:"failed_opens"`
+
+	// RetryAt is when an offline device will next be opened
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+
+	// Transitions are the latest changes in health, oldest first
+	Transitions []HealthTransition `json:"transitions"`
+}
+
+// newHealthStatus returns the health of a device that has just been found
+func newHealthStatus() HealthStatus {
+	return HealthStatus{State: Discovered, Since: time.Now()}
+}
+
+// copy returns a copy of the status that doesn't share its history
+func (h HealthStatus) copy() HealthStatus {
+	h.Transitions = append([]HealthTransition(nil), h.Transitions...)
+	return h
+}
+
+// transition moves the health to the given state, which must be done holding
+// the state lock.  It returns the transition and true if the state changed.
+func (h *HealthStatus) transition(state Health, reason string) (HealthTransition, bool) {
+	h.Reason = reason
+	if h.State == state {
+		return HealthTransition{}, false
+	}
+
+	t := HealthTransition{From: h.State, To: state, At: time.Now(), Reason: reason}
+	h.State = state
+	h.Since = t.At
+
+	h.Transitions = append(h.Transitions, t)
+	if len(h.Transitions) > maxHealthTransitions {
+		h.Transitions = append([]HealthTransition(nil), h.Transitions[len(h.Transitions)-maxHealthTransitions:]...)
+	}
+
+	return t, true
+}
+
+// setHealth moves the device to the given state, publishing the transition
+func (d *Device) setHealth(state Health, reason string) {
+	if ev, changed := d.healthEvent(state, reason); changed {
+		d.events.Publish(ev)
+	}
+}
+
+// healthEvent moves the device to the given state, returning the event for
+// the transition to be published by the caller, and true if the state changed
+func (d *Device) healthEvent(state Health, reason string) (Event, bool) {
+	d.state.Lock()
+	t, changed := d.Health.transition(state, reason)
+	d.state.Unlock()
+
+	if !changed {
+		return Event{}, false
+	}
+
+	if reason != "" {
+		tell.Infof("device %s is %s: %s", d.ID, state, reason)
+	} else {
+		tell.Infof("device %s is %s", d.ID, state)
+	}
+
+	return d.event(Event{Type: HealthChanged, Transition: &t}), true
+}
+
+// reopen resets the failures of a device that has been plugged back in, so
+// that it is opened straight away
+func (d *Device) reopen() (Event, bool) {
+	d.state.Lock()
+	d.Health.FailedOpens = 0
+	d.Health.FailedPolls = 0
+	d.Health.RetryAt = nil
+	d.state.Unlock()
+
+	return d.healthEvent(Discovered, "reconnected")
+}
+
+// shouldOpen returns true if the device is closed and it is time to try to
+// open it again
+func (d *Device) shouldOpen(now time.Time) bool {
+	d.state.RLock()
+	defer d.state.RUnlock()
+
+	if d.IsOpen || !d.Connected {
+		return false
+	}
+
+	return d.Health.RetryAt == nil || !now.Before(*d.Health.RetryAt)
+}
+
+// connect opens the device, backing off exponentially between the attempts
+// that fail
+func (d *Device) connect(delay, maxDelay time.Duration) error {
+	d.setHealth(Opening, "")
+
+	err := d.open()
+	if err != nil {
+		d.state.Lock()
+		d.Health.FailedOpens++
+		retryAt := time.Now().Add(backoff(delay, maxDelay, d.Health.FailedOpens))
+		d.Health.RetryAt = &retryAt
+		d.state.Unlock()
+
+		d.setHealth(Offline, "failed to open: "+err.Error())
+		return err
+	}
+
+	d.state.Lock()
+	d.Health.FailedOpens = 0
+	d.Health.RetryAt = nil
+	d.state.Unlock()
+	return nil
+}
+
+// polled updates the health of the device and the freshness of its shadow
+// with the outcome of a poll
+func (d *Device) polled(err error) {
+	if err == context.Canceled {
+		return
+	}
+
+	if err == nil {
+		d.state.Lock()
+		d.Health.FailedPolls = 0
+		d.state.Unlock()
+
+		d.setHealth(Online, "")
+		return
+	}
+
+	d.state.Lock()
+	d.Health.FailedPolls++
+	failed := d.Health.FailedPolls
+	open := d.IsOpen
+	d.state.Unlock()
+
+	switch {
+	case !open:
+		d.setHealth(Offline, err.Error())
+	case failed >= d.degradeAfter:
+		d.setHealth(Degraded, err.Error())
+	}
+
+	d.missed(err.Error(), d.staleAfter)
+}
+
+// backoff returns how long to wait before the given attempt, doubling the
+// delay each time up to the max.  Up to half of it is taken off at random so
+// that devices that fail together don't all retry together.
+func backoff(delay, maxDelay time.Duration, attempt int) time.Duration {
+	wait := maxDelay
+	if shifted := delay << uint(attempt-1); attempt < 32 && shifted > 0 && shifted < maxDelay {
+		wait = shifted
+	}
+
+	return wait - time.Duration(rand.Int63n(int64(wait)/2+1))
+}
@@ -0,0 +1,116 @@
+package device
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+func TestHealthFlakyThenUnplugged(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithRequestTimeout(10*time.Millisecond), WithRequestRetries(0), WithDegradeAfter(2))
+
+	dose := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.discover()
+
+	d, _ := mgr.FindDevice("dose-1")
+	if d.Health.State != Discovered {
+		t.Fatalf("expected a new device to be discovered, got %s", d.Health.State)
+	}
+
+	if err := d.connect(time.Millisecond, time.Millisecond); err != nil {
+		t.Fatalf("failed to open the device: %s", err)
+	}
+	d.polled(d.updateShadow(context.Background()))
+
+	if d.Health.State != Online {
+		t.Fatalf("expected the device to be online after a good poll, got %s", d.Health.State)
+	}
+
+	// stop answering polls
+	for _, prefix := range []string{"D0", "D1", "D2"} {
+		dose.Respond([]byte(prefix))
+	}
+
+	d.polled(d.updateShadow(context.Background()))
+	if d.Health.State != Online || d.Health.FailedPolls != 1 {
+		t.Errorf("expected one failed poll to be tolerated, got %s after %d", d.Health.State, d.Health.FailedPolls)
+	}
+
+	d.polled(d.updateShadow(context.Background()))
+	if d.Health.State != Degraded || d.Health.Reason != ErrNoResponse.Error() {
+		t.Errorf("expected the device to be degraded by missed polls, got %s: %s", d.Health.State, d.Health.Reason)
+	}
+
+	backend.Unplug(dose.Info.Path)
+	mgr.discover()
+
+	if d.Health.State != Offline || d.Health.Reason != "unplugged" {
+		t.Errorf("expected the device to be offline because it was unplugged, got %s: %s", d.Health.State, d.Health.Reason)
+	}
+
+	var path []Health
+	for _, tr := range d.Snapshot().Health.Transitions {
+		path = append(path, tr.To)
+	}
+
+	expected := []Health{Opening, Online, Degraded, Offline}
+	if len(path) != len(expected) {
+		t.Fatalf("expected transitions to %v, got %v", expected, path)
+	}
+	for i := range expected {
+		if path[i] != expected[i] {
+			t.Errorf("expected transitions to %v, got %v", expected, path)
+			break
+		}
+	}
+}
+
+func TestHealthOpenBackoff(t *testing.T) {
+	d := NewDevice("dose-1", IntelliDoseDeviceType, IntelliDoseDeviceNameLinux, hid.DeviceInfo{Path: "missing"})
+	d.backend = hid.NewFakeBackend()
+	sub := d.Events().Subscribe(10, Drop)
+
+	before := time.Now()
+	if err := d.connect(time.Second, time.Minute); err == nil {
+		t.Fatalf("expected opening a missing device to fail")
+	}
+
+	if d.Health.State != Offline || d.Health.FailedOpens != 1 || d.Health.RetryAt == nil {
+		t.Fatalf("expected the device to be offline with a retry, got %+v", d.Health)
+	}
+
+	wait := d.Health.RetryAt.Sub(before)
+	if wait < 500*time.Millisecond || wait > time.Second+100*time.Millisecond {
+		t.Errorf("expected the first retry in half a second to a second, got %s", wait)
+	}
+
+	if d.shouldOpen(time.Now()) || !d.shouldOpen(time.Now().Add(time.Second)) {
+		t.Errorf("expected the device to be opened again only once the backoff has passed")
+	}
+
+	if ev := <-sub.Events(); ev.Type != HealthChanged || ev.Transition.To != Opening {
+		t.Errorf("expected the device to be opening, got %+v", ev)
+	}
+
+	if ev := <-sub.Events(); ev.Transition == nil || ev.Transition.To != Offline || ev.Device.Health.State != Offline {
+		t.Errorf("expected the device to go offline, got %+v", ev)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 100; attempt++ {
+		wait := backoff(time.Second, time.Minute, attempt)
+
+		max := time.Minute
+		if attempt < 7 {
+			max = time.Second << uint(attempt-1)
+		}
+
+		if wait < max/2 || wait > max {
+			t.Fatalf("expected attempt %d to wait between %s and %s, got %s", attempt, max/2, max, wait)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package device
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,31 +12,180 @@ import (
 	"github.com/AutogrowSystems/go-intelli/util/tell"
 )
 
+const (
+	defaultReconcileRetries  = 5
+	defaultReconcileInterval = 5 * time.Second
+	defaultReattachGrace     = 30 * time.Second
+
+	// hotplugEnumerateInterval is how often all the devices are enumerated
+	// when hotplug events are being watched, in case any were missed
+	hotplugEnumerateInterval = time.Minute
+)
+
+// Option configures optional settings on a Manager
+type Option func(*Manager)
+
+// WithReconcileRetries sets how many times the manager will try to write the
+// desired state to a device before giving up
+func WithReconcileRetries(retries int) Option {
+	return func(mgr *Manager) {
+		mgr.reconcileRetries = retries
+	}
+}
+
+// WithReconcileInterval sets how often the manager checks a device against
+// its desired state, and the base delay between failed attempts to reconcile
+func WithReconcileInterval(interval time.Duration) Option {
+	return func(mgr *Manager) {
+		mgr.reconcileInterval = interval
+	}
+}
+
+// WithRequestTimeout sets how long to wait for a device to answer a request
+// before trying it again
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(mgr *Manager) {
+		mgr.requestTimeout = timeout
+	}
+}
+
+// WithRequestRetries sets how many times a request that a device didn't
+// answer, or answered with a corrupt response, is sent again
+func WithRequestRetries(retries int) Option {
+	return func(mgr *Manager) {
+		mgr.requestRetries = retries
+	}
+}
+
+// WithReattachGrace sets how long a device that has gone away is kept for,
+// so that it carries on as the same device with the same shadow if it comes
+// back in time.  A grace of zero removes devices as soon as they go away.
+func WithReattachGrace(grace time.Duration) Option {
+	return func(mgr *Manager) {
+		mgr.reattachGrace = grace
+	}
+}
+
+// WithDegradeAfter sets how many polls in a row a device has to fail before
+// it is marked as degraded
+func WithDegradeAfter(polls int) Option {
+	return func(mgr *Manager) {
+		mgr.degradeAfter = polls
+	}
+}
+
+// WithStaleAfter sets how many polls in a row a device has to miss before its
+// shadow is marked as stale and no longer connected
+func WithStaleAfter(polls int) Option {
+	return func(mgr *Manager) {
+		mgr.staleAfter = polls
+	}
+}
+
+// WithReconnectBackoff sets how long to wait before opening a device again
+// after failing to open it, which doubles after each failure up to the max
+func WithReconnectBackoff(delay, maxDelay time.Duration) Option {
+	return func(mgr *Manager) {
+		mgr.reconnectDelay = delay
+		mgr.reconnectMaxDelay = maxDelay
+	}
+}
+
+// WithBackend sets the backend used to find and open devices, instead of the
+// HID devices attached to this machine
+func WithBackend(backend hid.Backend) Option {
+	return func(mgr *Manager) {
+		mgr.backend = backend
+	}
+}
+
+// WithStreamHistory sets how many of the latest events are kept for the
+// event streams of the API to resume from
+func WithStreamHistory(size int) Option {
+	return func(mgr *Manager) {
+		mgr.streamHistory = size
+	}
+}
+
 // NewManager will return a new device manager with the given intervals
-func NewManager(enumerateInterval, updateInterval int) *Manager {
+func NewManager(enumerateInterval, updateInterval int, opts ...Option) *Manager {
 	mgr := &Manager{
 		mutex:             new(sync.RWMutex),
 		enumerateInterval: time.Duration(enumerateInterval) * time.Second,
 		updateInterval:    time.Duration(updateInterval) * time.Second,
-		devices:           []*Device{},
-		deviceUpdatedFunc: func(d Device) {},
+		reconcileRetries:  defaultReconcileRetries,
+		reconcileInterval: defaultReconcileInterval,
+		backend:           hid.System,
+		requestTimeout:    defaultRequestTimeout,
+		requestRetries:    defaultRequestRetries,
+		reattachGrace:     defaultReattachGrace,
+		degradeAfter:      defaultDegradeAfter,
+		staleAfter:        defaultStaleAfter,
+		reconnectDelay:    defaultReconnectDelay,
+		reconnectMaxDelay: defaultReconnectMaxDelay,
+		devices:           map[string]*Device{},
+		tasks:             new(sync.WaitGroup),
+		events:            NewBus(),
+		streamHistory:     defaultStreamHistory,
 	}
 
+	for _, opt := range opts {
+		opt(mgr)
+	}
+
+	mgr.history = newHistory(mgr.streamHistory)
+	mgr.history.record(mgr.events.Subscribe(callbackBuffer, Block))
+
 	return mgr
 }
 
 // Manager represents a manager of attached Intelli devices
 type Manager struct {
-	devices           []*Device
+	// devices holds the devices keyed by their ID, guarded by the mutex
+	devices           map[string]*Device
 	enumerateInterval time.Duration
 	updateInterval    time.Duration
+	reconcileRetries  int
+	reconcileInterval time.Duration
+	backend           hid.Backend
+	requestTimeout    time.Duration
+	requestRetries    int
+	reattachGrace     time.Duration
+	degradeAfter      int
+	staleAfter        int
+	reconnectDelay    time.Duration
+	reconnectMaxDelay time.Duration
 	mutex             *sync.RWMutex
-	deviceUpdatedFunc func(Device)
+	tasks             *sync.WaitGroup
+	events            *Bus
+	streamHistory     int
+	history           *history
+}
+
+// Subscribe returns a subscription to the events of all the devices, see
+// Bus.Subscribe.  The subscription is closed when Run returns.
+func (mgr *Manager) Subscribe(size int, policy Policy) *Subscription {
+	return mgr.events.Subscribe(size, policy)
 }
 
-// OnDeviceUpdated allows a callback to be fired whenever a device is updated
+// OnDeviceUpdated adds a callback to be fired, in order, whenever a device is
+// updated
 func (mgr *Manager) OnDeviceUpdated(callback func(Device)) {
-	mgr.deviceUpdatedFunc = callback
+	onEvent(mgr.Subscribe(callbackBuffer, Block), func(ev Event) {
+		if ev.Type == ShadowUpdated {
+			callback(ev.Device)
+		}
+	})
+}
+
+// OnDeviceReconnected adds a callback to be fired whenever a device that
+// went away comes back, which may be at a different path
+func (mgr *Manager) OnDeviceReconnected(callback func(Device)) {
+	onEvent(mgr.Subscribe(callbackBuffer, Block), func(ev Event) {
+		if ev.Type == DeviceAttached && ev.Reconnected {
+			callback(ev.Device)
+		}
+	})
 }
 
 // AttachAPI attaches a GIN API engine to the manager so it's internals can be inspected
@@ -42,73 +193,302 @@ func (mgr *Manager) OnDeviceUpdated(callback func(Device)) {
 func (mgr *Manager) AttachAPI(r *gin.Engine) {
 
 	r.GET("/devices/count", func(c *gin.Context) {
-		count := len(mgr.devices)
+		count := mgr.Count()
 		c.JSON(200, struct {
 			Count int `json:"count"`
 		}{count})
 	})
 
 	r.GET("/devices", func(c *gin.Context) {
-		mgr.mutex.RLock()
-		defer mgr.mutex.RUnlock()
+		devices := mgr.Devices()
+		if len(devices) == 0 {
+			c.AbortWithStatus(404)
+			return
+		}
+
+		c.JSON(200, devices)
+	})
+
+	// apply a partial reported document to the device and return the state
+	// that was read back after writing it
+	applyConfig := func(c *gin.Context) {
+		d, found := mgr.FindDevice(c.Param("serial"))
+
+		if !found {
+			c.AbortWithStatus(404)
+			return
+		}
 
-		if len(mgr.devices) == 0 {
+		patch, err := c.GetRawData()
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		shadow, err := d.ApplyConfig(c.Request.Context(), patch)
+		switch err {
+		case nil:
+		case ErrNotOpen, ErrNoState:
+			c.AbortWithStatusJSON(503, gin.H{"error": err.Error()})
+			return
+		case ErrUnsupportedDevice:
+			c.AbortWithStatusJSON(501, gin.H{"error": err.Error()})
+			return
+		default:
+			if _, ok := err.(*PatchError); ok {
+				c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			tell.Errorf("failed to write config to %s: %s", d.SerialNumber, err)
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, shadow)
+	}
+
+	r.PUT("/devices/:serial/config", applyConfig)
+	r.PATCH("/devices/:serial/config", applyConfig)
+
+	// merge a partial reported document into the desired state of the device
+	// and leave it to the reconciler to write it
+	setDesired := func(c *gin.Context) {
+		d, found := mgr.FindDevice(c.Param("serial"))
+
+		if !found {
+			c.AbortWithStatus(404)
+			return
+		}
+
+		patch, err := c.GetRawData()
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		switch err := d.SetDesired(patch); err.(type) {
+		case nil:
+		case *PatchError:
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		default:
+			c.AbortWithStatusJSON(501, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(202, d.shadow())
+	}
+
+	r.PUT("/devices/:serial/desired", setDesired)
+	r.PATCH("/devices/:serial/desired", setDesired)
+
+	r.DELETE("/devices/:serial/desired", func(c *gin.Context) {
+		d, found := mgr.FindDevice(c.Param("serial"))
+
+		if !found {
 			c.AbortWithStatus(404)
 			return
 		}
 
-		c.JSON(200, mgr.devices)
+		d.ClearDesired()
+		c.JSON(200, d.shadow())
 	})
 
+	mgr.attachV1(r)
+	mgr.attachStreams(r)
+}
+
+// Run discovers devices and interrogates them until the context is done.
+// It then stops polling the devices, gives them a chance to write any of
+// their desired state still waiting to be written, and closes them before
+// returning the context's error.
+func (mgr *Manager) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		mgr.discoverUntil(ctx.Done())
+	}()
+
+	go func() {
+		defer wg.Done()
+		mgr.interrogateUntil(ctx)
+	}()
+
+	wg.Wait()
+	mgr.shutdown()
+	return ctx.Err()
+}
+
+// shutdown stops the reconcilers, letting them flush their pending writes,
+// waits for the polls still running and closes all the devices
+func (mgr *Manager) shutdown() {
+	// taken along with emptying the map so that a device expiring in the
+	// meantime is either stopped here or by the expiry, not by both
+	mgr.mutex.Lock()
+	devices := make([]*Device, 0, len(mgr.devices))
+	for _, d := range mgr.devices {
+		devices = append(devices, d)
+	}
+	mgr.devices = map[string]*Device{}
+	mgr.mutex.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+
+	for _, d := range devices {
+		d.stopReconciling()
+	}
+
+	mgr.tasks.Wait()
+
+	for _, d := range devices {
+		d.close()
+		tell.Infof("closed device %s", d.ID)
+		d.setHealth(Removed, "shutting down")
+		d.publish(Event{Type: DeviceDetached, Removed: true, Shadow: d.shadow()})
+	}
+
+	mgr.events.Close()
 }
 
 // Interrogate will interrogate discovered devices for their readings and
-// update their local shadow.
+// update their local shadow.  It loops forever, use Run to be able to stop
+// it.
 func (mgr *Manager) Interrogate() {
+	mgr.interrogateUntil(context.Background())
+}
+
+// interrogateUntil interrogates the devices every update interval until the
+// context is done
+func (mgr *Manager) interrogateUntil(ctx context.Context) {
 	for {
-		for _, device := range mgr.devices {
-			if !device.IsOpen {
-				if err := device.open(); err != nil {
-					tell.Errorf("%s", err)
-					continue
-				}
+		mgr.interrogate(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mgr.updateInterval):
+		}
+	}
+}
+
+// interrogate opens any closed devices that are due to be retried and starts
+// polling each of the open devices once
+func (mgr *Manager) interrogate(ctx context.Context) {
+	now := time.Now()
+	for _, device := range mgr.Devices() {
+		if device.shouldOpen(now) {
+			if err := device.connect(mgr.reconnectDelay, mgr.reconnectMaxDelay); err != nil {
+				tell.Errorf("%s", err)
 			}
+		}
 
-			go device.updateShadow()
+		if !device.isOpen() {
+			continue
 		}
 
-		time.Sleep(mgr.updateInterval)
+		mgr.tasks.Add(1)
+		go func(device *Device) {
+			defer mgr.tasks.Done()
+			device.poll(ctx, mgr.updateInterval)
+		}(device)
 	}
 }
 
 // Discover will continuously try to discover devices attached via USB and add
-// them to the internal slice of devices.  It will rediscover every time the
+// them to the internal slice of devices, use Run to be able to stop it.  If the backend reports hotplug
+// events devices are added and removed as soon as they are plugged in or
+// unplugged, and enumerating all the devices is only a fallback done every
+// hotplugEnumerateInterval.  Otherwise it will rediscover every time the
 // enumerateInterval setting on the manager is passed.
 func (mgr *Manager) Discover() {
+	mgr.discoverUntil(nil)
+}
+
+// discoverUntil discovers devices until the stop channel is closed
+func (mgr *Manager) discoverUntil(stop <-chan struct{}) {
+	var events <-chan hid.Event
+	if h, ok := mgr.backend.(hid.Hotplugger); ok {
+		var err error
+		if events, err = h.Hotplug(stop); err != nil && err != hid.ErrHotplugUnsupported {
+			tell.Errorf("failed to watch for hotplugged devices, falling back to polling: %s", err)
+		}
+	}
+
 	for {
-		devicesInfo, err := hid.Devices()
-		if err != nil {
+		wait := mgr.enumerateInterval
+		if events != nil && hotplugEnumerateInterval > wait {
+			wait = hotplugEnumerateInterval
+		}
+
+		if err := mgr.discover(); err != nil {
 			tell.IfErrorf(err, "failed to enumerate devices")
-			time.Sleep(5 * time.Second)
-			continue
+			wait = 5 * time.Second
 		}
 
-		mgr.addDevices(devicesInfo)
+		timeout := time.After(wait)
+		for waiting := true; waiting; {
+			select {
+			case <-stop:
+				return
+			case <-timeout:
+				waiting = false
+			case ev, ok := <-events:
+				if !ok {
+					tell.Warnf("stopped receiving hotplug events, falling back to polling")
+					events = nil
+					waiting = false
+					continue
+				}
 
-		if len(mgr.devices) == 0 {
-			tell.Warnf("No Autogrow device is connected")
+				mgr.hotplug(ev)
+			}
 		}
+	}
+}
+
+// hotplug adds or removes the device in the hotplug event
+func (mgr *Manager) hotplug(ev hid.Event) {
+	switch ev.Action {
+	case hid.Add:
+		if ev.Info != nil {
+			mgr.addDevices([]*hid.DeviceInfo{ev.Info})
+		}
+	case hid.Remove:
+		mgr.disconnectDevices(func(d *Device) bool {
+			return d.HID.Path == ev.Path
+		})
+	case hid.Lost:
+		tell.IfErrorf(mgr.discover(), "failed to enumerate devices after missing hotplug events")
+	}
+}
 
-		mgr.purgeDevices(devicesInfo)
+// discover enumerates the devices once, adding new ones and purging those
+// that have gone away
+func (mgr *Manager) discover() error {
+	devicesInfo, err := mgr.backend.Devices()
+	if err != nil {
+		return err
+	}
+
+	mgr.addDevices(devicesInfo)
 
-		time.Sleep(mgr.enumerateInterval)
+	if mgr.Count() == 0 {
+		tell.Warnf("No Autogrow device is connected")
 	}
+
+	mgr.purgeDevices(devicesInfo)
+	return nil
 }
 
 func (mgr *Manager) addDevices(devicesInfo []*hid.DeviceInfo) {
 	mgr.mutex.Lock()
-	defer mgr.mutex.Unlock()
 
+	var attached []Event
 	for _, info := range devicesInfo {
 		name := info.Product
 		sn := info.SerialNumber
@@ -118,13 +498,19 @@ func (mgr *Manager) addDevices(devicesInfo []*hid.DeviceInfo) {
 			continue
 		}
 
-		tell.Debugf("found device %s %s", name, sn)
-
-		if _, found := mgr.FindDevice(info.SerialNumber); found {
-			// 	d.hidDevice = &HIDDevice{
-			// 		hidDevice: *info,
-			// 	}
-			//
+		tell.Debugf("found device %s %s at %s", name, info.Identity(), info.Path)
+
+		// a device that was unplugged and plugged back in can come back at a
+		// different path, and carries on with the shadow it had
+		if d, found := mgr.devices[info.Identity()]; found {
+			if moved := d.rebind(*info); moved || !d.connected() {
+				d.setConnected(true)
+				tell.Infof("reconnected device %s at %s", d.ID, info.Path)
+				attached = append(attached, d.event(Event{Type: DeviceAttached, Reconnected: true, Shadow: d.shadow()}))
+				if ev, changed := d.reopen(); changed {
+					attached = append(attached, ev)
+				}
+			}
 			continue
 		}
 
@@ -137,46 +523,127 @@ func (mgr *Manager) addDevices(devicesInfo []*hid.DeviceInfo) {
 		}
 
 		newdev := NewDevice(sn, deviceType, name, *info)
-		newdev.OnUpdate(mgr.deviceUpdatedFunc)
+		newdev.events = mgr.events
+
+		mgr.devices[newdev.ID] = newdev
+		newdev.backend = mgr.backend
+		newdev.requestTimeout = mgr.requestTimeout
+		newdev.requestRetries = mgr.requestRetries
+		newdev.degradeAfter = mgr.degradeAfter
+		newdev.staleAfter = mgr.staleAfter
+		attached = append(attached, newdev.event(Event{Type: DeviceAttached}))
+
+		mgr.tasks.Add(1)
+		go func() {
+			defer mgr.tasks.Done()
+			newdev.reconcile(newdev.stopReconcile, mgr.reconcileRetries, mgr.reconcileInterval)
+		}()
+
+		tell.Infof("connected device %s", newdev.ID)
+	}
 
-		mgr.devices = append(mgr.devices, newdev)
+	mgr.mutex.Unlock()
 
-		tell.Infof("connected device %s", sn)
+	// publish once unlocked so that subscribers can use the manager
+	for _, ev := range attached {
+		mgr.events.Publish(ev)
 	}
 }
 
+// purgeDevices disconnects the devices that aren't in the given list
 func (mgr *Manager) purgeDevices(devicesInfo []*hid.DeviceInfo) {
+	mgr.disconnectDevices(func(d *Device) bool {
+		for _, info := range devicesInfo {
+			if d.ID == info.Identity() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// disconnectDevices closes the devices the gone function returns true for,
+// and removes those that have been gone for longer than the reattach grace
+// period
+func (mgr *Manager) disconnectDevices(gone func(*Device) bool) {
+	var detached []Event
+	var lost []*Device
+	defer func() {
+		for _, ev := range detached {
+			mgr.events.Publish(ev)
+		}
+		for _, d := range lost {
+			d.markStale("unplugged")
+		}
+	}()
+
 	mgr.mutex.Lock()
 	defer mgr.mutex.Unlock()
 
-	if len(mgr.devices) > 0 {
-		return
-	}
+	now := time.Now()
+	for id, d := range mgr.devices {
+		if !gone(d) {
+			continue
+		}
 
-	for i, d := range mgr.devices {
-		found := false
-		for _, info := range devicesInfo {
-			if d.SerialNumber == info.SerialNumber {
-				found = true
+		if d.connected() {
+			d.setConnected(false)
+			d.disconnectedAt = now
+			d.close()
+			detached = append(detached, d.event(Event{Type: DeviceDetached, Shadow: d.shadow()}))
+			if ev, changed := d.healthEvent(Offline, "unplugged"); changed {
+				detached = append(detached, ev)
+			}
+			lost = append(lost, d)
+
+			if mgr.reattachGrace > 0 {
+				tell.Infof("lost device %s, waiting %s for it to come back", d.ID, mgr.reattachGrace)
+				time.AfterFunc(mgr.reattachGrace, mgr.expireDevices)
 			}
 		}
 
-		if !found {
-			d.close()
-			mgr.devices = append(mgr.devices[:i], mgr.devices[i+1:]...)
+		if now.Sub(d.disconnectedAt) < mgr.reattachGrace {
+			continue
+		}
+
+		delete(mgr.devices, id)
+		d.stopReconciling()
+		tell.Infof("disconnected device %s", d.ID)
+		if ev, changed := d.healthEvent(Removed, "unplugged"); changed {
+			detached = append(detached, ev)
 		}
+		detached = append(detached, d.event(Event{Type: DeviceDetached, Removed: true, Shadow: d.shadow()}))
 	}
 }
 
-// FindDevice returns the device by the given serial number and true, or else it will
-// return nil device and false.
-func (mgr *Manager) FindDevice(sn string) (*Device, bool) {
-	if len(mgr.devices) == 0 {
-		return nil, false
+// expireDevices removes the devices that have been gone for longer than the
+// reattach grace period
+func (mgr *Manager) expireDevices() {
+	mgr.disconnectDevices(func(d *Device) bool {
+		return !d.connected()
+	})
+}
+
+// FindDevice returns the device with the given ID and true, or else it will
+// return nil device and false.  The ID of a device is its serial number if it
+// has one, see hid.DeviceInfo.Identity.
+func (mgr *Manager) FindDevice(id string) (*Device, bool) {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+
+	d, found := mgr.devices[id]
+	return d, found
+}
+
+// FindDeviceBySubject returns the device with the given ID, or else the one
+// whose ID has the given subject token, see SubjectToken
+func (mgr *Manager) FindDeviceBySubject(token string) (*Device, bool) {
+	if d, found := mgr.FindDevice(token); found {
+		return d, true
 	}
 
-	for _, d := range mgr.devices {
-		if d.SerialNumber == sn {
+	for _, d := range mgr.Devices() {
+		if SubjectToken(d.ID) == token {
 			return d, true
 		}
 	}
@@ -189,3 +656,27 @@ func (mgr *Manager) HasDevice(serialNumber string) bool {
 	_, found := mgr.FindDevice(serialNumber)
 	return found
 }
+
+// Devices returns the devices sorted by their ID.  The list is a snapshot
+// that can be used while devices are added and removed.
+func (mgr *Manager) Devices() []*Device {
+	mgr.mutex.RLock()
+	devices := make([]*Device, 0, len(mgr.devices))
+	for _, d := range mgr.devices {
+		devices = append(devices, d)
+	}
+	mgr.mutex.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices
+}
+
+// Count returns the number of devices
+func (mgr *Manager) Count() int {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+
+	return len(mgr.devices)
+}
@@ -0,0 +1,468 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/capture"
+	"github.com/AutogrowSystems/go-intelli/hid"
+	"github.com/AutogrowSystems/go-intelli/simulator"
+)
+
+// plugIDose attaches a fake IntelliDose that answers D requests with the
+// given state packets
+func plugIDose(backend *hid.FakeBackend, sn string, state [][]byte) *hid.FakeDevice {
+	dev := backend.Plug(hid.DeviceInfo{Product: IntelliDoseDeviceNameLinux, SerialNumber: sn})
+	for _, packet := range state {
+		response := append([]byte{}, packet...)
+		createCheckSum(&response)
+		dev.Respond(packet[:2], response)
+	}
+	return dev
+}
+
+func TestManagerDiscoverAndPurge(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithReattachGrace(0))
+
+	dose := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	backend.Plug(hid.DeviceInfo{Product: "Keyboard", SerialNumber: "kb"})
+
+	if err := mgr.discover(); err != nil {
+		t.Fatalf("failed to discover devices: %s", err)
+	}
+
+	if !mgr.HasDevice("dose-1") || mgr.HasDevice("kb") {
+		t.Fatalf("expected only the IntelliDose to be found, got %d devices", len(mgr.devices))
+	}
+
+	second := plugIDose(backend, "dose-2", blankPackets(iDoseLayout))
+	mgr.discover()
+	if len(mgr.devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(mgr.devices))
+	}
+
+	backend.Unplug(dose.Info.Path)
+	mgr.discover()
+
+	if mgr.HasDevice("dose-1") || !mgr.HasDevice("dose-2") {
+		t.Errorf("expected only the unplugged device to be purged")
+	}
+
+	backend.Unplug(second.Info.Path)
+	mgr.discover()
+
+	if len(mgr.devices) != 0 {
+		t.Errorf("expected all devices to be purged, got %d", len(mgr.devices))
+	}
+}
+
+func TestManagerPoll(t *testing.T) {
+	backend := hid.NewFakeBackend()
+
+	state := blankPackets(iDoseLayout)
+	copy(state[2][2:12], "tent 1")
+	plugIDose(backend, "dose-1", state)
+
+	updated := make(chan Device, 1)
+	mgr := NewManager(1, 1, WithBackend(backend), WithRequestTimeout(100*time.Millisecond))
+	mgr.OnDeviceUpdated(func(d Device) {
+		select {
+		case updated <- d:
+		default:
+		}
+	})
+
+	mgr.discover()
+	mgr.interrogate(context.Background())
+
+	select {
+	case d := <-updated:
+		shadow, ok := d.Shadow.(iDoseShadow)
+		if !ok {
+			t.Fatalf("expected an IntelliDose shadow, got %T", d.Shadow)
+		}
+
+		if name := shadow.State.Reported.Config.General.DeviceName; name != "tent 1" {
+			t.Errorf("expected device name tent 1, got %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the device to be polled")
+	}
+}
+
+func TestManagerWithSimulator(t *testing.T) {
+	backend, err := simulator.NewBackend("dose=1,climate=1")
+	if err != nil {
+		t.Fatalf("failed to simulate devices: %s", err)
+	}
+
+	mgr := NewManager(1, 1, WithBackend(backend))
+	mgr.discover()
+
+	if len(mgr.devices) != 2 {
+		t.Fatalf("expected 2 simulated devices, got %d", len(mgr.devices))
+	}
+
+	for _, d := range mgr.devices {
+		if err := d.open(); err != nil {
+			t.Fatalf("failed to open %s: %s", d.SerialNumber, err)
+		}
+		d.poll(context.Background(), 5*time.Second)
+	}
+
+	dose, _ := mgr.FindDevice("SIMID00001")
+	shadow, ok := dose.Shadow.(iDoseShadow)
+	if !ok {
+		t.Fatalf("expected an IntelliDose shadow, got %T", dose.Shadow)
+	}
+
+	if name := shadow.State.Reported.Config.General.DeviceName; name != "SIMID00001" {
+		t.Errorf("expected the simulated device name, got %q", name)
+	}
+
+	if _, err := dose.ApplyConfig(context.Background(), []byte(`{"status": {"set_points": {"ph": 5.8}}}`)); err != nil {
+		t.Fatalf("failed to apply config: %s", err)
+	}
+
+	if ph := dose.Shadow.(iDoseShadow).State.Reported.Status.SetPoints.Ph; ph != 5.8 {
+		t.Errorf("expected the simulator to keep the pH set point, got %v", ph)
+	}
+
+	climate, _ := mgr.FindDevice("SIMIC00001")
+	if _, ok := climate.Shadow.(iClimateShadow); !ok {
+		t.Fatalf("expected an IntelliClimate shadow, got %T", climate.Shadow)
+	}
+}
+
+func TestManagerReplay(t *testing.T) {
+	sim, _ := simulator.NewBackend("climate=1")
+
+	buf := new(bytes.Buffer)
+	recorder := NewManager(1, 1, WithBackend(capture.NewRecordingBackend(sim, capture.NewPcapngWriter(buf))))
+	recorder.discover()
+	recorded := recorder.Devices()[0]
+	recorded.open()
+	recorded.poll(context.Background(), 5*time.Second)
+
+	records, err := capture.ReadPcapng(buf)
+	if err != nil {
+		t.Fatalf("failed to read capture: %s", err)
+	}
+
+	mgr := NewManager(1, 1, WithBackend(capture.NewReplayBackend(records)))
+	mgr.discover()
+
+	replayed, found := mgr.FindDevice(recorded.SerialNumber)
+	if !found {
+		t.Fatalf("expected the captured device to be found")
+	}
+
+	replayed.open()
+	replayed.poll(context.Background(), 5*time.Second)
+
+	expected := recorded.Shadow.(iClimateShadow).State.Reported
+	got := replayed.Shadow.(iClimateShadow).State.Reported
+	got.Timestamp = expected.Timestamp
+	got.LastSeen = expected.LastSeen
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected the replayed shadow to match the recorded one\nexpected %+v\n     got %+v", expected, got)
+	}
+}
+
+func TestManagerHotplug(t *testing.T) {
+	backend := hid.NewFakeBackend()
+
+	// enumerating is left to the hotplug events
+	mgr := NewManager(3600, 1, WithBackend(backend), WithReattachGrace(0))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		mgr.discoverUntil(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	dose := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	waitFor("the plugged in device to be added", func() bool { return mgr.HasDevice("dose-1") })
+
+	backend.Unplug(dose.Info.Path)
+	waitFor("the unplugged device to be removed", func() bool { return !mgr.HasDevice("dose-1") })
+}
+
+func TestManagerHotplugLost(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend))
+
+	// plugged in while the events were being missed
+	plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.hotplug(hid.Event{Action: hid.Lost})
+
+	if !mgr.HasDevice("dose-1") {
+		t.Errorf("expected the devices to be enumerated after missing events")
+	}
+}
+
+func TestManagerIdentity(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend))
+
+	// two units without serial numbers are told apart by their USB port
+	first := backend.Plug(hid.DeviceInfo{Product: IntelliDoseDeviceNameLinux, PortPath: "1-1.2"})
+	backend.Plug(hid.DeviceInfo{Product: IntelliDoseDeviceNameLinux, PortPath: "1-1.3"})
+	mgr.discover()
+
+	if !mgr.HasDevice("usb-1-1.2:0") || !mgr.HasDevice("usb-1-1.3:0") {
+		t.Fatalf("expected both devices to be found by port, got %d devices", len(mgr.devices))
+	}
+
+	d, _ := mgr.FindDevice("usb-1-1.2:0")
+	if bySubject, found := mgr.FindDeviceBySubject("usb-1-1_2:0"); !found || bySubject != d {
+		t.Errorf("expected the device to be found by the subject token of its ID")
+	}
+
+	if err := d.open(); err != nil {
+		t.Fatalf("failed to open device: %s", err)
+	}
+
+	// plugged back into the same port between enumerations, it comes back
+	// at a new path
+	backend.Unplug(first.Info.Path)
+	moved := backend.Plug(hid.DeviceInfo{Product: IntelliDoseDeviceNameLinux, PortPath: "1-1.2"})
+	mgr.discover()
+
+	if len(mgr.devices) != 2 {
+		t.Fatalf("expected the moved device to be matched, got %d devices", len(mgr.devices))
+	}
+
+	if again, _ := mgr.FindDevice("usb-1-1.2:0"); again != d || d.HID.Path != moved.Info.Path || d.IsOpen {
+		t.Errorf("expected the device to be closed and rebound to %s, got %s", moved.Info.Path, d.HID.Path)
+	}
+
+	if err := d.open(); err != nil {
+		t.Errorf("expected the device to open at its new path, got %s", err)
+	}
+}
+
+func TestManagerReattach(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithReattachGrace(time.Minute))
+
+	reconnected := make(chan Device, 1)
+	mgr.OnDeviceReconnected(func(d Device) { reconnected <- d })
+
+	dose := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.discover()
+
+	d, _ := mgr.FindDevice("dose-1")
+	d.Shadow = "last shadow"
+	d.open()
+
+	mgr.hotplug(hid.Event{Action: hid.Remove, Path: dose.Info.Path})
+	backend.Unplug(dose.Info.Path)
+	mgr.discover()
+
+	if !mgr.HasDevice("dose-1") || d.Connected || d.IsOpen {
+		t.Fatalf("expected the unplugged device to be kept closed while it might come back")
+	}
+
+	back := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.hotplug(hid.Event{Action: hid.Add, Path: back.Info.Path, Info: &back.Info})
+
+	select {
+	case got := <-reconnected:
+		if got.ID != "dose-1" || got.HID.Path != back.Info.Path {
+			t.Errorf("expected dose-1 to reconnect at %s, got %s at %s", back.Info.Path, got.ID, got.HID.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a reconnected callback")
+	}
+
+	if again, _ := mgr.FindDevice("dose-1"); again != d || d.Shadow != "last shadow" || !d.Connected {
+		t.Errorf("expected the same device to carry on with its shadow")
+	}
+}
+
+func TestManagerReattachExpires(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithReattachGrace(20*time.Millisecond))
+
+	dose := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+	mgr.discover()
+
+	backend.Unplug(dose.Info.Path)
+	mgr.discover()
+
+	deadline := time.Now().Add(time.Second)
+	for mgr.HasDevice("dose-1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the device to be removed once the grace period passed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerRun(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	dose := plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+
+	// the reconciler never writes, so the desired state is left for the
+	// shutdown to flush
+	mgr := NewManager(1, 1, WithBackend(backend), WithReconcileRetries(0),
+		WithRequestTimeout(50*time.Millisecond), WithRequestRetries(0))
+
+	updated := make(chan struct{}, 1)
+	mgr.OnDeviceUpdated(func(d Device) {
+		select {
+		case updated <- struct{}{}:
+		default:
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- mgr.Run(ctx) }()
+
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the device to be polled")
+	}
+
+	d, _ := mgr.FindDevice("dose-1")
+
+	if err := d.SetDesired([]byte(`{"status":{"set_points":{"ph":6.1}}}`)); err != nil {
+		t.Fatalf("failed to set desired state: %s", err)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected %s, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the manager to stop")
+	}
+
+	if d.IsOpen || len(mgr.devices) != 0 {
+		t.Errorf("expected the devices to be closed and forgotten")
+	}
+
+	flushed := false
+	for _, report := range dose.Written() {
+		flushed = flushed || bytes.HasPrefix(report, []byte("\x00S"))
+	}
+
+	if !flushed {
+		t.Errorf("expected the desired state to be flushed to the device")
+	}
+}
+
+func TestManagerShutdownAfterExpiry(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	plugIDose(backend, "dose-1", blankPackets(iDoseLayout))
+
+	mgr := NewManager(1, 1, WithBackend(backend))
+	mgr.discover()
+
+	// the reattach grace running out while shutting down stops the
+	// reconciler of a device that shutdown has already taken
+	d, _ := mgr.FindDevice("dose-1")
+	d.stopReconciling()
+
+	mgr.shutdown()
+
+	if d.IsOpen || len(mgr.devices) != 0 {
+		t.Errorf("expected the devices to be closed and forgotten")
+	}
+}
+
+func TestManagerHotplugChurn(t *testing.T) {
+	backend := hid.NewFakeBackend()
+	mgr := NewManager(1, 1, WithBackend(backend), WithReattachGrace(5*time.Millisecond), WithRequestTimeout(20*time.Millisecond))
+	events := mgr.Subscribe(16, Drop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- mgr.Run(ctx) }()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// read the registry and the devices while they are plugged and polled
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			devices := mgr.Devices()
+			if _, err := json.Marshal(devices); err != nil {
+				t.Errorf("failed to encode devices: %s", err)
+			}
+			mgr.FindDevice("dose-0")
+			mgr.Count()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-events.Events():
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		dose := plugIDose(backend, fmt.Sprintf("dose-%d", i%3), blankPackets(iDoseLayout))
+		mgr.interrogate(ctx)
+		time.Sleep(time.Millisecond)
+		backend.Unplug(dose.Info.Path)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mgr.Count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := mgr.Count(); n != 0 {
+		t.Errorf("expected the unplugged devices to be removed, got %d", n)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected %s, got %v", context.Canceled, err)
+	}
+}
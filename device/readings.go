@@ -0,0 +1,112 @@
+package device
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// the units of the metrics that are given by the settings of the device
+const (
+	temperatureUnit = "temperature"
+	nutrientUnit    = "nutrient"
+)
+
+// metricUnits are the units of the metrics, leaving out those without one
+var metricUnits = map[string]string{
+	"ec":                  nutrientUnit,
+	"pH":                  "pH",
+	"nut_temp":            temperatureUnit,
+	"air_temp":            temperatureUnit,
+	"outside_temp_sensor": temperatureUnit,
+	"enviro_air_temp_1":   temperatureUnit,
+	"enviro_air_temp_2":   temperatureUnit,
+	"rh":                  "%",
+	"enviro_rh_1":         "%",
+	"enviro_rh_2":         "%",
+	"vpd":                 "kPa",
+	"co2":                 "ppm",
+	"enviro_co2_1":        "ppm",
+	"enviro_co2_2":        "ppm",
+}
+
+// Metric is a single reading of a device
+type Metric struct {
+	Name string `json:"name"`
+
+	// Value is a number, a bool or a string
+	Value interface{} `json:"value"`
+	Unit  string      `json:"unit,omitempty"`
+}
+
+// FunctionStatus is the state of one of the functions of a device
+type FunctionStatus struct {
+	Function string `json:"function"`
+	Active   bool   `json:"active"`
+	Enabled  bool   `json:"enabled"`
+	ForceOn  bool   `json:"force_on"`
+}
+
+// Readings is what was read from a device in a shadow, broken down for the
+// consumers that only want part of it
+type Readings struct {
+	// Metrics are sorted by name, leaving out the sensors that aren't
+	// available
+	Metrics   []Metric
+	Functions []FunctionStatus
+	Freshness
+}
+
+// ReadingsOf returns the readings in the shadow, and false if it isn't the
+// shadow of a device
+func ReadingsOf(shadow interface{}) (Readings, bool) {
+	var readings Readings
+	var metrics interface{}
+	units := map[string]string{}
+
+	switch s := shadow.(type) {
+	case iDoseShadow:
+		r := s.State.Reported
+		metrics = r.Metrics
+		readings.Freshness = r.Freshness
+		units[temperatureUnit] = r.Config.Units.Temperature
+		units[nutrientUnit] = r.Config.Units.Ec
+		for _, f := range r.Status.Status {
+			readings.Functions = append(readings.Functions, FunctionStatus{f.Function, f.Active, f.Enabled, f.ForceOn})
+		}
+	case iClimateShadow:
+		r := s.State.Reported
+		metrics = r.Metrics
+		readings.Freshness = r.Freshness
+		units[temperatureUnit] = r.Config.Units.Temperature
+		for _, f := range r.Status.Status {
+			readings.Functions = append(readings.Functions, FunctionStatus{f.Function, f.Active, f.Enabled, f.ForceOn})
+		}
+	default:
+		return readings, false
+	}
+
+	// go through the metrics by their JSON names so that they are named the
+	// same as in the shadow
+	var values map[string]interface{}
+	data, _ := json.Marshal(metrics)
+	json.Unmarshal(data, &values)
+
+	for name, value := range values {
+		if value == valueUndefined {
+			continue
+		}
+
+		unit := metricUnits[name]
+		if setting, ok := units[unit]; ok {
+			unit = setting
+		}
+
+		readings.Metrics = append(readings.Metrics, Metric{Name: name, Value: value, Unit: unit})
+	}
+
+	sort.Slice(readings.Metrics, func(i, j int) bool {
+		return readings.Metrics[i].Name < readings.Metrics[j].Name
+	})
+
+	return readings, true
+}
@@ -0,0 +1,53 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestReadingsOf(t *testing.T) {
+	var shadow iDoseShadow
+	reported := &shadow.State.Reported
+	reported.Config.Units.Temperature = temperatureF
+	reported.Config.Units.Ec = nutrientConfigCF
+	reported.Metrics = MetricsIDose{Ec: 1.8, NutTemp: valueUndefined, PH: 6.1}
+	reported.Status.Status = []StatusStatusIDose{{Function: phFunction, Active: true, Enabled: true}}
+	reported.Sequence = 3
+
+	readings, ok := ReadingsOf(shadow)
+	if !ok {
+		t.Fatalf("expected the readings of an IntelliDose")
+	}
+
+	expected := []Metric{{"ec", 1.8, nutrientConfigCF}, {"pH", 6.1, "pH"}}
+	if len(readings.Metrics) != len(expected) {
+		t.Fatalf("expected the metrics %v without the missing sensor, got %v", expected, readings.Metrics)
+	}
+	for i := range expected {
+		if readings.Metrics[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], readings.Metrics[i])
+		}
+	}
+
+	if len(readings.Functions) != 1 || readings.Functions[0] != (FunctionStatus{phFunction, true, true, false}) {
+		t.Errorf("expected the pH function, got %v", readings.Functions)
+	}
+
+	if readings.Sequence != 3 {
+		t.Errorf("expected the freshness of the shadow, got %+v", readings.Freshness)
+	}
+
+	var climate iClimateShadow
+	climate.State.Reported.Config.Units.Temperature = temperatureC
+	climate.State.Reported.Metrics.AirTemp = 24.5
+
+	readings, _ = ReadingsOf(climate)
+	for _, metric := range readings.Metrics {
+		if metric.Name == "air_temp" && (metric.Value != 24.5 || metric.Unit != temperatureC) {
+			t.Errorf("expected the air temperature in the unit of the device, got %v", metric)
+		}
+	}
+
+	if _, ok := ReadingsOf(nil); ok {
+		t.Errorf("expected no readings without a shadow")
+	}
+}
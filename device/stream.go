@@ -0,0 +1,321 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultStreamHistory = 1024
+
+	// streamKeepalive is how often an idle stream is pinged so that proxies
+	// don't close it
+	streamKeepalive = 15 * time.Second
+
+	// streamWriteTimeout is how long a WebSocket client has to take a message
+	streamWriteTimeout = 10 * time.Second
+)
+
+// streamTypes are the types of event streamed when no types are asked for
+var streamTypes = []EventType{ShadowUpdated, DeviceAttached, DeviceDetached, AlarmRaised}
+
+// StreamEvent is an event numbered in the order it was published, so that a
+// stream can be resumed after the last event received
+type StreamEvent struct {
+	ID uint64 `json:"id"`
+	Event
+}
+
+// history keeps the latest events published on the bus for the streams to
+// follow and resume from
+type history struct {
+	mutex  *sync.Mutex
+	events []StreamEvent
+	size   int
+	last   uint64
+	closed bool
+
+	// wake is closed and replaced whenever an event is added
+	wake chan struct{}
+}
+
+func newHistory(size int) *history {
+	return &history{
+		mutex: new(sync.Mutex),
+		size:  size,
+		wake:  make(chan struct{}),
+	}
+}
+
+// record adds the events received by the subscription until it is closed
+func (h *history) record(sub *Subscription) {
+	go func() {
+		for ev := range sub.Events() {
+			h.add(ev)
+		}
+		h.close()
+	}()
+}
+
+func (h *history) add(ev Event) {
+	// the copy of the device isn't streamed, so don't keep it around
+	ev.Device = Device{}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.last++
+	h.events = append(h.events, StreamEvent{ID: h.last, Event: ev})
+	if len(h.events) > h.size {
+		h.events = append([]StreamEvent(nil), h.events[len(h.events)-h.size:]...)
+	}
+
+	close(h.wake)
+	h.wake = make(chan struct{})
+}
+
+func (h *history) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.closed {
+		h.closed = true
+		close(h.wake)
+	}
+}
+
+// latest returns the ID of the last event added
+func (h *history) latest() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.last
+}
+
+// since returns the events kept after the given ID, along with a channel
+// that is closed when another is added, and false once the history is closed
+func (h *history) since(id uint64) ([]StreamEvent, <-chan struct{}, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var events []StreamEvent
+	for _, ev := range h.events {
+		if ev.ID > id {
+			events = append(events, ev)
+		}
+	}
+
+	return events, h.wake, !h.closed
+}
+
+// follow calls send with each event after the given ID that the filter
+// matches, and ping when no event has been sent for a while, until the
+// context is done, the history is closed or either of them fails
+func (h *history) follow(ctx context.Context, after uint64, filter streamFilter, send func(StreamEvent) error, ping func() error) error {
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		events, wake, open := h.since(after)
+		for _, ev := range events {
+			after = ev.ID
+			if !filter.match(ev.Event) {
+				continue
+			}
+
+			if err := send(ev); err != nil {
+				return err
+			}
+		}
+
+		if !open {
+			return nil
+		}
+
+		select {
+		case <-wake:
+		case <-keepalive.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// streamFilter picks the events a stream is interested in
+type streamFilter struct {
+	serials map[string]bool
+	types   map[EventType]bool
+}
+
+// newStreamFilter returns the filter given by the comma separated serial and
+// type query parameters, streaming the default types of event of all the
+// devices when they are left out
+func newStreamFilter(c *gin.Context) streamFilter {
+	filter := streamFilter{serials: map[string]bool{}, types: map[EventType]bool{}}
+
+	for _, serial := range splitList(c.Query("serial")) {
+		filter.serials[serial] = true
+	}
+
+	for _, typ := range splitList(c.Query("type")) {
+		filter.types[EventType(typ)] = true
+	}
+
+	if len(filter.types) == 0 {
+		for _, typ := range streamTypes {
+			filter.types[typ] = true
+		}
+	}
+
+	return filter
+}
+
+func (f streamFilter) match(ev Event) bool {
+	if len(f.serials) > 0 && !f.serials[ev.DeviceID] {
+		return false
+	}
+
+	return f.types[ev.Type]
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// resumeFrom returns the ID of the last event the client received, given by
+// the Last-Event-ID header or the last_event_id query parameter, or the ID of
+// the latest event when the stream is new
+func (mgr *Manager) resumeFrom(c *gin.Context) (uint64, error) {
+	last := c.Request.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = c.Query("last_event_id")
+	}
+
+	latest := mgr.history.latest()
+	if last == "" {
+		return latest, nil
+	}
+
+	after, err := strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	// the events are numbered from the start again when the gateway is
+	// restarted, and the client hasn't seen any of them
+	if after > latest {
+		return 0, nil
+	}
+
+	return after, nil
+}
+
+// attachStreams adds the SSE and WebSocket streams of the device events
+func (mgr *Manager) attachStreams(r *gin.Engine) {
+	r.GET("/v1/events", mgr.streamSSE)
+	r.GET("/v1/ws", mgr.streamWebSocket)
+}
+
+// streamSSE streams the events as Server-Sent Events
+func (mgr *Manager) streamSSE(c *gin.Context) {
+	after, err := mgr.resumeFrom(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": "bad last event ID: " + err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	send := func(ev StreamEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	ping := func() error {
+		if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	mgr.history.follow(c.Request.Context(), after, newStreamFilter(c), send, ping)
+}
+
+// upgrader upgrades the WebSocket stream, only allowing pages from the same
+// origin as the API like the rest of it
+var upgrader = websocket.Upgrader{}
+
+// streamWebSocket streams the events as JSON messages over a WebSocket
+func (mgr *Manager) streamWebSocket(c *gin.Context) {
+	after, err := mgr.resumeFrom(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": "bad last event ID: " + err.Error()})
+		return
+	}
+
+	filter := newStreamFilter(c)
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// read until the client goes away, which is needed to handle its close
+	// and ping messages
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(ev StreamEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(ev)
+	}
+
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+	}
+
+	if mgr.history.follow(ctx, after, filter, send, ping) == nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(streamWriteTimeout))
+	}
+}
@@ -0,0 +1,144 @@
+package device
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// streamServer serves the API of a manager that events can be published on
+func streamServer(t *testing.T) (*Manager, *httptest.Server) {
+	gin.SetMode(gin.TestMode)
+
+	mgr := NewManager(1, 1, WithStreamHistory(3))
+	r := gin.New()
+	mgr.AttachAPI(r)
+
+	return mgr, httptest.NewServer(r)
+}
+
+// publish publishes the events and waits for them to be kept in the history
+func publish(t *testing.T, mgr *Manager, events ...Event) {
+	want := mgr.history.latest() + uint64(len(events))
+	for _, ev := range events {
+		mgr.events.Publish(ev)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for mgr.history.latest() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events in the history, got %d", want, mgr.history.latest())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHistoryKeepsLatest(t *testing.T) {
+	h := newHistory(2)
+	for i := 0; i < 3; i++ {
+		h.add(Event{Type: ShadowUpdated, Shadow: i})
+	}
+
+	events, wake, open := h.since(0)
+	if len(events) != 2 || events[0].ID != 2 || events[1].Shadow != 2 || !open {
+		t.Fatalf("expected the last 2 events, got %+v", events)
+	}
+
+	h.close()
+	select {
+	case <-wake:
+	default:
+		t.Errorf("expected closing the history to wake its followers")
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	mgr, srv := streamServer(t)
+	defer srv.Close()
+
+	publish(t, mgr,
+		Event{Type: ShadowUpdated, DeviceID: "dose-1"},
+		Event{Type: ShadowUpdated, DeviceID: "dose-2"},
+		Event{Type: PollFailed, DeviceID: "dose-1"},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/events?serial=dose-1", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("failed to open the stream: %s", err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", ct)
+	}
+
+	lines := bufio.NewScanner(res.Body)
+	next := func() string {
+		var event []string
+		for lines.Scan() && lines.Text() != "" {
+			event = append(event, lines.Text())
+		}
+		return strings.Join(event, "\n")
+	}
+
+	if ev := next(); !strings.HasPrefix(ev, "id: 1\nevent: shadow_updated\ndata: {\"id\":1,\"type\":\"shadow_updated\",\"device_id\":\"dose-1\"") {
+		t.Errorf("expected the first update of dose-1 to be replayed, got %q", ev)
+	}
+
+	// the failed poll and dose-2 are filtered out
+	publish(t, mgr, Event{Type: AlarmRaised, DeviceID: "dose-1", Alarm: "ph_low"})
+	if ev := next(); !strings.HasPrefix(ev, "id: 4\nevent: alarm_raised\n") {
+		t.Errorf("expected the alarm to be streamed, got %q", ev)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	mgr, srv := streamServer(t)
+	defer srv.Close()
+
+	publish(t, mgr,
+		Event{Type: ShadowUpdated, DeviceID: "dose-1"},
+		Event{Type: DeviceDetached, DeviceID: "dose-1"},
+		Event{Type: ShadowUpdated, DeviceID: "dose-2"},
+	)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/ws?last_event_id=1&type=shadow_updated"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to open the WebSocket: %s", err)
+	}
+	defer conn.Close()
+
+	var ev StreamEvent
+	if err := conn.ReadJSON(&ev); err != nil || ev.ID != 3 || ev.DeviceID != "dose-2" {
+		t.Fatalf("expected to resume with the update of dose-2, got %+v (%v)", ev, err)
+	}
+
+	// a stream resuming from before a restart gets all the events kept
+	old, _, err := websocket.DefaultDialer.Dial(strings.Replace(url, "last_event_id=1", "last_event_id=100", 1), nil)
+	if err != nil {
+		t.Fatalf("failed to open the WebSocket: %s", err)
+	}
+	defer old.Close()
+
+	if err := old.ReadJSON(&ev); err != nil || ev.ID != 1 {
+		t.Errorf("expected to get the events from the start, got %+v (%v)", ev, err)
+	}
+
+	mgr.events.Close()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected the stream to be closed when the manager shuts down, got %v", err)
+	}
+}
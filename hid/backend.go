@@ -0,0 +1,23 @@
+package hid
+
+// Backend enumerates and opens HID devices
+type Backend interface {
+	// Devices returns the info of the devices that are currently attached.
+	Devices() ([]*DeviceInfo, error)
+
+	// Open opens the device described by the info for reading and writing.
+	Open(info *DeviceInfo) (Device, error)
+}
+
+// System is the backend for the HID devices attached to this machine
+var System Backend = systemBackend{}
+
+type systemBackend struct{}
+
+func (systemBackend) Devices() ([]*DeviceInfo, error) {
+	return Devices()
+}
+
+func (systemBackend) Open(info *DeviceInfo) (Device, error) {
+	return info.Open()
+}
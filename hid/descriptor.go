@@ -0,0 +1,382 @@
+package hid
+
+import (
+	"errors"
+)
+
+// ErrBadDescriptor is returned when a report descriptor can't be parsed
+var ErrBadDescriptor = errors.New("malformed report descriptor")
+
+// ReportType is the type of a report
+type ReportType string
+
+// the types of report a device can have
+const (
+	InputReport   ReportType = "input"
+	OutputReport  ReportType = "output"
+	FeatureReport ReportType = "feature"
+)
+
+// item types
+const (
+	itemMain   = 0
+	itemGlobal = 1
+	itemLocal  = 2
+)
+
+// main item tags
+const (
+	tagInput         = 0x8
+	tagOutput        = 0x9
+	tagCollection    = 0xa
+	tagFeature       = 0xb
+	tagEndCollection = 0xc
+)
+
+// global item tags
+const (
+	tagUsagePage       = 0x0
+	tagLogicalMinimum  = 0x1
+	tagLogicalMaximum  = 0x2
+	tagPhysicalMinimum = 0x3
+	tagPhysicalMaximum = 0x4
+	tagUnitExponent    = 0x5
+	tagUnit            = 0x6
+	tagReportSize      = 0x7
+	tagReportID        = 0x8
+	tagReportCount     = 0x9
+	tagPush            = 0xa
+	tagPop             = 0xb
+)
+
+// local item tags
+const (
+	tagUsage        = 0x0
+	tagUsageMinimum = 0x1
+	tagUsageMaximum = 0x2
+)
+
+// longItemPrefix starts an item with a size and tag in the following bytes
+const longItemPrefix = 0xfe
+
+// Descriptor is a parsed report descriptor, describing the reports a device
+// sends and receives
+type Descriptor struct {
+	Collections []*Collection `json:"collections"`
+	Reports     []*Report     `json:"reports"`
+}
+
+// Collection groups the fields of reports that belong together, like the
+// keys of a keyboard
+type Collection struct {
+	// Type is 0 for a physical collection, 1 for an application collection,
+	// 2 for a logical collection and so on
+	Type      uint8         `json:"type"`
+	UsagePage uint16        `json:"usage_page"`
+	Usage     uint16        `json:"usage"`
+	Fields    []*Field      `json:"fields,omitempty"`
+	Children  []*Collection `json:"children,omitempty"`
+}
+
+// Report is a report with its fields in the order they are sent
+type Report struct {
+	ID     uint8      `json:"id"`
+	Type   ReportType `json:"type"`
+	Fields []*Field   `json:"fields"`
+}
+
+// Field is a run of values of the same size in a report, described by a
+// single input, output or feature item
+type Field struct {
+	// Flags are the bits of the main item, for example bit 0 is set for
+	// constant padding and bit 1 for variables rather than arrays
+	Flags uint32 `json:"flags"`
+
+	UsagePage    uint16   `json:"usage_page"`
+	Usages       []uint32 `json:"usages,omitempty"`
+	UsageMinimum uint32   `json:"usage_minimum,omitempty"`
+	UsageMaximum uint32   `json:"usage_maximum,omitempty"`
+
+	// Size is the number of bits in each value
+	Size  uint32 `json:"size"`
+	Count uint32 `json:"count"`
+
+	LogicalMinimum  int32  `json:"logical_minimum"`
+	LogicalMaximum  int32  `json:"logical_maximum"`
+	PhysicalMinimum int32  `json:"physical_minimum"`
+	PhysicalMaximum int32  `json:"physical_maximum"`
+	Unit            uint32 `json:"unit,omitempty"`
+	UnitExponent    int32  `json:"unit_exponent,omitempty"`
+}
+
+// Bits returns the number of bits in the report, not counting its ID
+func (r *Report) Bits() int {
+	bits := 0
+	for _, f := range r.Fields {
+		bits += int(f.Size * f.Count)
+	}
+	return bits
+}
+
+// Length returns the number of bytes in the report, including the report ID
+// in front of it if it has one
+func (r *Report) Length() int {
+	n := (r.Bits() + 7) / 8
+	if r.ID != 0 {
+		n++
+	}
+	return n
+}
+
+// Report returns the report of the given type and ID, or nil if there isn't one
+func (d *Descriptor) Report(typ ReportType, id uint8) *Report {
+	for _, r := range d.Reports {
+		if r.Type == typ && r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// ReportLength returns the length of the longest report of the given type
+func (d *Descriptor) ReportLength(typ ReportType) int {
+	length := 0
+	for _, r := range d.Reports {
+		if r.Type == typ && r.Length() > length {
+			length = r.Length()
+		}
+	}
+	return length
+}
+
+// setDescriptor sets the descriptor of the device, taking its usage from the
+// first top level collection and its report lengths from the longest reports
+func (d *DeviceInfo) setDescriptor(desc *Descriptor) {
+	d.Descriptor = desc
+
+	if len(desc.Collections) > 0 {
+		d.UsagePage = desc.Collections[0].UsagePage
+		d.Usage = desc.Collections[0].Usage
+	}
+
+	d.InputReportLength = uint16(desc.ReportLength(InputReport))
+	d.OutputReportLength = uint16(desc.ReportLength(OutputReport))
+}
+
+// globals is the state kept by global items
+type globals struct {
+	usagePage       uint16
+	logicalMinimum  int32
+	logicalMaximum  int32
+	physicalMinimum int32
+	physicalMaximum int32
+	unit            uint32
+	unitExponent    int32
+	reportSize      uint32
+	reportID        uint8
+	reportCount     uint32
+}
+
+// locals is the state kept by local items, which is reset after each main item
+type locals struct {
+	usages       []uint32
+	usageMinimum uint32
+	usageMaximum uint32
+}
+
+// ParseDescriptor parses a report descriptor
+func ParseDescriptor(b []byte) (*Descriptor, error) {
+	d := &Descriptor{}
+
+	var g globals
+	var l locals
+	var stack []globals
+	var open []*Collection
+
+	for len(b) > 0 {
+		if b[0] == longItemPrefix {
+			// long items are reserved, so are skipped
+			if len(b) < 3 || len(b) < 3+int(b[1]) {
+				return nil, ErrBadDescriptor
+			}
+			b = b[3+int(b[1]):]
+			continue
+		}
+
+		size := int(b[0] & 0x03)
+		if size == 3 {
+			size = 4
+		}
+		typ := (b[0] >> 2) & 0x03
+		tag := (b[0] >> 4) & 0x0f
+		if len(b) < 1+size {
+			return nil, ErrBadDescriptor
+		}
+
+		data := b[1 : 1+size]
+		b = b[1+size:]
+
+		value := unsignedValue(data)
+		signed := signedValue(data)
+
+		switch typ {
+		case itemMain:
+			switch tag {
+			case tagInput, tagOutput, tagFeature:
+				f := &Field{
+					Flags:           value,
+					UsagePage:       g.usagePage,
+					Usages:          l.usages,
+					UsageMinimum:    l.usageMinimum,
+					UsageMaximum:    l.usageMaximum,
+					Size:            g.reportSize,
+					Count:           g.reportCount,
+					LogicalMinimum:  g.logicalMinimum,
+					LogicalMaximum:  g.logicalMaximum,
+					PhysicalMinimum: g.physicalMinimum,
+					PhysicalMaximum: g.physicalMaximum,
+					Unit:            g.unit,
+					UnitExponent:    g.unitExponent,
+				}
+
+				r := d.report(reportTypes[tag], g.reportID)
+				r.Fields = append(r.Fields, f)
+				if len(open) > 0 {
+					c := open[len(open)-1]
+					c.Fields = append(c.Fields, f)
+				}
+
+			case tagCollection:
+				c := &Collection{Type: uint8(value), UsagePage: g.usagePage}
+				if len(l.usages) > 0 {
+					c.UsagePage, c.Usage = splitUsage(l.usages[0], g.usagePage)
+				}
+
+				if len(open) > 0 {
+					parent := open[len(open)-1]
+					parent.Children = append(parent.Children, c)
+				} else {
+					d.Collections = append(d.Collections, c)
+				}
+				open = append(open, c)
+
+			case tagEndCollection:
+				if len(open) == 0 {
+					return nil, ErrBadDescriptor
+				}
+				open = open[:len(open)-1]
+			}
+
+			l = locals{}
+
+		case itemGlobal:
+			switch tag {
+			case tagUsagePage:
+				g.usagePage = uint16(value)
+			case tagLogicalMinimum:
+				g.logicalMinimum = signed
+			case tagLogicalMaximum:
+				g.logicalMaximum = signed
+				// a maximum that only fits unsigned is meant to be unsigned
+				if g.logicalMaximum < g.logicalMinimum {
+					g.logicalMaximum = int32(value)
+				}
+			case tagPhysicalMinimum:
+				g.physicalMinimum = signed
+			case tagPhysicalMaximum:
+				g.physicalMaximum = signed
+				if g.physicalMaximum < g.physicalMinimum {
+					g.physicalMaximum = int32(value)
+				}
+			case tagUnitExponent:
+				g.unitExponent = signed
+			case tagUnit:
+				g.unit = value
+			case tagReportSize:
+				g.reportSize = value
+			case tagReportID:
+				if value == 0 || value > 0xff {
+					return nil, ErrBadDescriptor
+				}
+				g.reportID = uint8(value)
+			case tagReportCount:
+				g.reportCount = value
+			case tagPush:
+				stack = append(stack, g)
+			case tagPop:
+				if len(stack) == 0 {
+					return nil, ErrBadDescriptor
+				}
+				g = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+
+		case itemLocal:
+			// usages of 4 bytes carry their own usage page in the top half,
+			// otherwise they use the current usage page
+			usage := value
+			if size < 4 {
+				usage |= uint32(g.usagePage) << 16
+			}
+
+			switch tag {
+			case tagUsage:
+				l.usages = append(l.usages, usage)
+			case tagUsageMinimum:
+				l.usageMinimum = usage
+			case tagUsageMaximum:
+				l.usageMaximum = usage
+			}
+		}
+	}
+
+	if len(open) > 0 {
+		return nil, ErrBadDescriptor
+	}
+
+	return d, nil
+}
+
+var reportTypes = map[byte]ReportType{
+	tagInput:   InputReport,
+	tagOutput:  OutputReport,
+	tagFeature: FeatureReport,
+}
+
+// report returns the report of the given type and ID, adding it if needed
+func (d *Descriptor) report(typ ReportType, id uint8) *Report {
+	if r := d.Report(typ, id); r != nil {
+		return r
+	}
+
+	r := &Report{ID: id, Type: typ}
+	d.Reports = append(d.Reports, r)
+	return r
+}
+
+// splitUsage splits an extended usage into its usage page and usage
+func splitUsage(usage uint32, page uint16) (uint16, uint16) {
+	if usage>>16 != 0 {
+		page = uint16(usage >> 16)
+	}
+	return page, uint16(usage)
+}
+
+func unsignedValue(data []byte) uint32 {
+	var v uint32
+	for i, b := range data {
+		v |= uint32(b) << (8 * uint(i))
+	}
+	return v
+}
+
+func signedValue(data []byte) int32 {
+	v := unsignedValue(data)
+	switch len(data) {
+	case 1:
+		return int32(int8(v))
+	case 2:
+		return int32(int16(v))
+	}
+	return int32(v)
+}
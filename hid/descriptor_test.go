@@ -0,0 +1,138 @@
+package hid
+
+import (
+	"testing"
+)
+
+// vendorDescriptor is the descriptor of a vendor defined device with 64 byte
+// input and output reports and no report IDs, like the IntelliDose
+var vendorDescriptor = []byte{
+	0x06, 0x00, 0xff, // usage page (vendor defined 0xff00)
+	0x09, 0x01, // usage (1)
+	0xa1, 0x01, // collection (application)
+	0x15, 0x00, //   logical minimum (0)
+	0x26, 0xff, 0x00, //   logical maximum (255)
+	0x75, 0x08, //   report size (8)
+	0x95, 0x40, //   report count (64)
+	0x09, 0x01, //   usage (1)
+	0x81, 0x02, //   input (data, variable, absolute)
+	0x09, 0x01, //   usage (1)
+	0x91, 0x02, //   output (data, variable, absolute)
+	0xc0, // end collection
+}
+
+// numberedDescriptor has several reports with IDs, nested collections and
+// signed logical ranges
+var numberedDescriptor = []byte{
+	0x05, 0x01, // usage page (generic desktop)
+	0x09, 0x02, // usage (mouse)
+	0xa1, 0x01, // collection (application)
+	0x85, 0x01, //   report ID (1)
+	0x09, 0x01, //   usage (pointer)
+	0xa1, 0x00, //   collection (physical)
+	0x05, 0x09, //     usage page (buttons)
+	0x19, 0x01, //     usage minimum (1)
+	0x29, 0x03, //     usage maximum (3)
+	0x15, 0x00, //     logical minimum (0)
+	0x25, 0x01, //     logical maximum (1)
+	0x95, 0x03, //     report count (3)
+	0x75, 0x01, //     report size (1)
+	0x81, 0x02, //     input (data, variable, absolute)
+	0x95, 0x01, //     report count (1)
+	0x75, 0x05, //     report size (5)
+	0x81, 0x01, //     input (constant)
+	0xa4,       //     push
+	0x05, 0x01, //     usage page (generic desktop)
+	0x09, 0x30, //     usage (x)
+	0x09, 0x31, //     usage (y)
+	0x15, 0x81, //     logical minimum (-127)
+	0x25, 0x7f, //     logical maximum (127)
+	0x75, 0x08, //     report size (8)
+	0x95, 0x02, //     report count (2)
+	0x81, 0x06, //     input (data, variable, relative)
+	0xb4,       //     pop
+	0xc0,       //   end collection
+	0x85, 0x02, //   report ID (2)
+	0x09, 0x01, //   usage (1)
+	0xb1, 0x02, //   feature (data, variable, absolute)
+	0xc0, // end collection
+}
+
+func TestParseVendorDescriptor(t *testing.T) {
+	desc, err := ParseDescriptor(vendorDescriptor)
+	if err != nil {
+		t.Fatalf("failed to parse descriptor: %s", err)
+	}
+
+	if len(desc.Collections) != 1 || desc.Collections[0].UsagePage != 0xff00 || desc.Collections[0].Usage != 1 {
+		t.Fatalf("expected a single vendor defined collection, got %+v", desc.Collections)
+	}
+
+	if len(desc.Reports) != 2 {
+		t.Fatalf("expected an input and an output report, got %d reports", len(desc.Reports))
+	}
+
+	for _, typ := range []ReportType{InputReport, OutputReport} {
+		if n := desc.ReportLength(typ); n != 64 {
+			t.Errorf("expected a 64 byte %s report, got %d", typ, n)
+		}
+	}
+
+	f := desc.Report(InputReport, 0).Fields[0]
+	if f.LogicalMinimum != 0 || f.LogicalMaximum != 255 || f.Usages[0] != 0xff000001 {
+		t.Errorf("unexpected input field %+v", f)
+	}
+
+	var info DeviceInfo
+	info.setDescriptor(desc)
+	if info.UsagePage != 0xff00 || info.Usage != 1 || info.InputReportLength != 64 || info.OutputReportLength != 64 {
+		t.Errorf("unexpected device info %+v", info)
+	}
+}
+
+func TestParseNumberedDescriptor(t *testing.T) {
+	desc, err := ParseDescriptor(numberedDescriptor)
+	if err != nil {
+		t.Fatalf("failed to parse descriptor: %s", err)
+	}
+
+	app := desc.Collections[0]
+	if app.Usage != 2 || len(app.Children) != 1 || app.Children[0].Type != 0 || len(app.Children[0].Fields) != 3 {
+		t.Fatalf("unexpected collections %+v", app)
+	}
+
+	input := desc.Report(InputReport, 1)
+	if input == nil || input.Bits() != 24 || input.Length() != 4 {
+		t.Fatalf("expected a 3 byte input report with ID 1, got %+v", input)
+	}
+
+	buttons, axes := input.Fields[0], input.Fields[2]
+	if buttons.UsagePage != 9 || buttons.UsageMinimum != 0x90001 || buttons.UsageMaximum != 0x90003 {
+		t.Errorf("unexpected buttons field %+v", buttons)
+	}
+
+	if axes.UsagePage != 1 || axes.LogicalMinimum != -127 || axes.LogicalMaximum != 127 || len(axes.Usages) != 2 {
+		t.Errorf("unexpected axes field %+v", axes)
+	}
+
+	// the pop restores the button usage page and the 5 bit report size
+	feature := desc.Report(FeatureReport, 2)
+	if feature == nil || feature.Fields[0].UsagePage != 9 || feature.Fields[0].Size != 5 {
+		t.Errorf("expected the globals to be popped for feature report 2, got %+v", feature)
+	}
+}
+
+func TestParseBadDescriptors(t *testing.T) {
+	for _, b := range [][]byte{
+		{0xa1, 0x01},       // unterminated collection
+		{0xc0},             // unopened collection
+		{0x26, 0xff},       // truncated item
+		{0xb4},             // pop with nothing pushed
+		{0x85, 0x00},       // report ID of zero
+		{0xfe, 0x04, 0x00}, // truncated long item
+	} {
+		if _, err := ParseDescriptor(b); err != ErrBadDescriptor {
+			t.Errorf("expected %s parsing % x, got %v", ErrBadDescriptor, b, err)
+		}
+	}
+}
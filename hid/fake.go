@@ -0,0 +1,397 @@
+package hid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrDeviceNotFound is returned when opening a device that isn't attached
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrUnplugged is returned when using a device after it was unplugged
+	ErrUnplugged = errors.New("device unplugged")
+
+	// ErrNoReport is returned when getting a feature report the device
+	// doesn't have
+	ErrNoReport = errors.New("no such report")
+)
+
+// fakeEventBuffer is the number of hotplug events buffered for each watcher
+// before they are dropped
+const fakeEventBuffer = 16
+
+// Responder returns the input reports a fake device sends in answer to an
+// output report written to it.  The report number is included in the output
+// report.
+type Responder func(report []byte) [][]byte
+
+// FakeBackend is an in-memory backend of virtual devices that can be plugged
+// in and unplugged at any time, for testing code that uses HID devices
+// without the hardware.
+type FakeBackend struct {
+	mutex    *sync.Mutex
+	devices  []*FakeDevice
+	plugged  int
+	watchers []chan Event
+}
+
+// NewFakeBackend returns a fake backend with no devices attached
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{mutex: new(sync.Mutex)}
+}
+
+// Plug attaches a virtual device with the given info and returns it.  A path
+// is made up for the device if the info doesn't have one.
+func (b *FakeBackend) Plug(info DeviceInfo) *FakeDevice {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.plugged++
+	if info.Path == "" {
+		info.Path = fmt.Sprintf("fake/%d", b.plugged)
+	}
+
+	d := &FakeDevice{
+		Info:     info,
+		mutex:    new(sync.Mutex),
+		canned:   []cannedResponse{},
+		handles:  []*fakeHandle{},
+		features: map[byte][]byte{},
+	}
+
+	b.devices = append(b.devices, d)
+
+	added := info
+	b.notify(Event{Action: Add, Path: info.Path, Info: &added})
+	return d
+}
+
+// Unplug detaches the device at the given path, closing the read channels of
+// anything that has it open.  It returns false if there was no such device.
+func (b *FakeBackend) Unplug(path string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, d := range b.devices {
+		if d.Info.Path != path {
+			continue
+		}
+
+		b.devices = append(b.devices[:i], b.devices[i+1:]...)
+		d.unplug()
+		b.notify(Event{Action: Remove, Path: path})
+		return true
+	}
+
+	return false
+}
+
+// Devices returns the info of the attached virtual devices
+func (b *FakeBackend) Devices() ([]*DeviceInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	infos := make([]*DeviceInfo, len(b.devices))
+	for i, d := range b.devices {
+		info := d.Info
+		infos[i] = &info
+	}
+
+	return infos, nil
+}
+
+// Open opens the attached virtual device with the same path as the info
+func (b *FakeBackend) Open(info *DeviceInfo) (Device, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, d := range b.devices {
+		if d.Info.Path == info.Path {
+			return d.open(), nil
+		}
+	}
+
+	return nil, ErrDeviceNotFound
+}
+
+// Hotplug returns a channel of the devices being plugged in and unplugged
+func (b *FakeBackend) Hotplug(stop <-chan struct{}) (<-chan Event, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	events := make(chan Event, fakeEventBuffer)
+	b.watchers = append(b.watchers, events)
+
+	go func() {
+		<-stop
+
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		for i, w := range b.watchers {
+			if w == events {
+				b.watchers = append(b.watchers[:i], b.watchers[i+1:]...)
+				close(events)
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// notify sends the event to the hotplug watchers, dropping it for any that
+// are full
+func (b *FakeBackend) notify(ev Event) {
+	for _, w := range b.watchers {
+		select {
+		case w <- ev:
+		default:
+		}
+	}
+}
+
+type cannedResponse struct {
+	prefix  []byte
+	reports [][]byte
+}
+
+// FakeDevice is a virtual device attached to a fake backend.  It answers the
+// output reports written to it with canned responses, or by calling its
+// responder when none of them match.
+type FakeDevice struct {
+	// Info is the info the device is enumerated with
+	Info DeviceInfo
+
+	mutex     *sync.Mutex
+	canned    []cannedResponse
+	responder Responder
+	written   [][]byte
+	handles   []*fakeHandle
+	features  map[byte][]byte
+	unplugged bool
+}
+
+// Respond makes the device answer output reports that start with the given
+// prefix, after the report number, with the given input reports.  Later
+// responses take priority over earlier ones with the same prefix.
+func (d *FakeDevice) Respond(prefix []byte, reports ...[]byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.canned = append([]cannedResponse{{prefix, reports}}, d.canned...)
+}
+
+// SetResponder sets the function used to answer output reports that don't
+// have a canned response
+func (d *FakeDevice) SetResponder(responder Responder) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.responder = responder
+}
+
+// Send sends an unsolicited input report to everything that has the device
+// open
+func (d *FakeDevice) Send(report []byte) {
+	d.mutex.Lock()
+	handles := d.openHandles()
+	d.mutex.Unlock()
+
+	send(handles, report)
+}
+
+// Written returns the output reports written to the device so far
+func (d *FakeDevice) Written() [][]byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	written := make([][]byte, len(d.written))
+	copy(written, d.written)
+	return written
+}
+
+// SetFeature sets the feature report with the number in its first byte
+func (d *FakeDevice) SetFeature(report []byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.features[report[0]] = append([]byte{}, report...)
+}
+
+// Feature returns the feature report with the given number, or nil if the
+// device doesn't have it
+func (d *FakeDevice) Feature(id byte) []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	report, ok := d.features[id]
+	if !ok {
+		return nil
+	}
+	return append([]byte{}, report...)
+}
+
+func (d *FakeDevice) getFeature(id byte, buf []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.unplugged {
+		return 0, ErrUnplugged
+	}
+
+	report, ok := d.features[id]
+	if !ok {
+		return 0, ErrNoReport
+	}
+
+	if len(buf) < len(report) {
+		return 0, ErrShortBuffer
+	}
+
+	return copy(buf, report), nil
+}
+
+func (d *FakeDevice) sendFeature(data []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.unplugged {
+		return ErrUnplugged
+	}
+
+	if len(data) == 0 {
+		return ErrShortBuffer
+	}
+
+	d.features[data[0]] = append([]byte{}, data...)
+	return nil
+}
+
+func (d *FakeDevice) open() *fakeHandle {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	h := &fakeHandle{device: d, reports: NewReports(readBuffer)}
+	d.handles = append(d.handles, h)
+	return h
+}
+
+func (d *FakeDevice) unplug() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.unplugged = true
+	for _, h := range d.handles {
+		h.reports.Fail(ErrUnplugged)
+	}
+	d.handles = nil
+}
+
+func (d *FakeDevice) write(data []byte) error {
+	d.mutex.Lock()
+
+	if d.unplugged {
+		d.mutex.Unlock()
+		return ErrUnplugged
+	}
+
+	report := make([]byte, len(data))
+	copy(report, data)
+	d.written = append(d.written, report)
+
+	responses := d.responses(report)
+	handles := d.openHandles()
+	d.mutex.Unlock()
+
+	// the responses are sent without holding the lock, as sending blocks
+	// while a handle that is being read from is full
+	for _, response := range responses {
+		send(handles, response)
+	}
+
+	return nil
+}
+
+func (d *FakeDevice) responses(report []byte) [][]byte {
+	if len(report) > 0 {
+		for _, c := range d.canned {
+			if bytes.HasPrefix(report[1:], c.prefix) {
+				return c.reports
+			}
+		}
+	}
+
+	if d.responder != nil {
+		return d.responder(report)
+	}
+
+	return nil
+}
+
+func (d *FakeDevice) openHandles() []*fakeHandle {
+	return append([]*fakeHandle{}, d.handles...)
+}
+
+// send queues the report on every handle, the same way the hidraw backend
+// does
+func send(handles []*fakeHandle, report []byte) {
+	for _, h := range handles {
+		h.reports.Put(report)
+	}
+}
+
+func (d *FakeDevice) close(h *fakeHandle) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i, handle := range d.handles {
+		if handle == h {
+			d.handles = append(d.handles[:i], d.handles[i+1:]...)
+			return
+		}
+	}
+}
+
+// fakeHandle is an open fake device
+type fakeHandle struct {
+	device  *FakeDevice
+	reports *Reports
+}
+
+func (h *fakeHandle) Close() {
+	h.reports.Close()
+	h.device.close(h)
+}
+
+func (h *fakeHandle) Write(data []byte) error {
+	return h.device.write(data)
+}
+
+func (h *fakeHandle) GetFeatureReport(id byte, buf []byte) (int, error) {
+	return h.device.getFeature(id, buf)
+}
+
+func (h *fakeHandle) SendFeatureReport(data []byte) error {
+	return h.device.sendFeature(data)
+}
+
+func (h *fakeHandle) ReadCh() <-chan []byte {
+	return h.reports.Ch()
+}
+
+func (h *fakeHandle) Read(ctx context.Context) ([]byte, error) {
+	return h.reports.Read(ctx)
+}
+
+func (h *fakeHandle) ReadError() error {
+	return h.reports.Err()
+}
+
+func (h *fakeHandle) Overflows() uint64 {
+	return h.reports.Overflows()
+}
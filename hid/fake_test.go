@@ -0,0 +1,85 @@
+package hid
+
+import (
+	"testing"
+)
+
+func TestFakeBackend(t *testing.T) {
+	b := NewFakeBackend()
+	dev := b.Plug(DeviceInfo{Product: "test", SerialNumber: "1"})
+	dev.Respond([]byte("D0"), []byte("D0 answer"))
+	dev.SetResponder(func(report []byte) [][]byte {
+		return [][]byte{append([]byte("echo "), report[1:]...)}
+	})
+
+	infos, err := b.Devices()
+	if err != nil || len(infos) != 1 || infos[0].Path == "" {
+		t.Fatalf("expected one device with a path, got %v %v", infos, err)
+	}
+
+	h, err := b.Open(infos[0])
+	if err != nil {
+		t.Fatalf("failed to open device: %s", err)
+	}
+
+	h.Write([]byte("\x00D0"))
+	h.Write([]byte("\x00S1"))
+
+	for _, expected := range []string{"D0 answer", "echo S1"} {
+		if got := string(<-h.ReadCh()); got != expected {
+			t.Errorf("expected %q, got %q", expected, got)
+		}
+	}
+
+	if len(dev.Written()) != 2 {
+		t.Errorf("expected 2 written reports, got %d", len(dev.Written()))
+	}
+
+	b.Unplug(dev.Info.Path)
+
+	if _, ok := <-h.ReadCh(); ok {
+		t.Errorf("expected the read channel to close when unplugged")
+	}
+
+	if h.ReadError() != ErrUnplugged {
+		t.Errorf("expected %s, got %v", ErrUnplugged, h.ReadError())
+	}
+
+	if err := h.Write([]byte("\x00D0")); err != ErrUnplugged {
+		t.Errorf("expected %s writing to an unplugged device, got %v", ErrUnplugged, err)
+	}
+
+	if _, err := b.Open(infos[0]); err != ErrDeviceNotFound {
+		t.Errorf("expected %s opening an unplugged device, got %v", ErrDeviceNotFound, err)
+	}
+}
+
+func TestFakeFeatureReports(t *testing.T) {
+	b := NewFakeBackend()
+	dev := b.Plug(DeviceInfo{Product: "test"})
+	dev.SetFeature([]byte{3, 0xaa, 0xbb})
+
+	h, _ := b.Open(&dev.Info)
+
+	buf := make([]byte, 8)
+	n, err := h.GetFeatureReport(3, buf)
+	if err != nil || n != 3 || buf[0] != 3 || buf[2] != 0xbb {
+		t.Errorf("expected feature report 3, got % x %v", buf[:n], err)
+	}
+
+	if _, err := h.GetFeatureReport(3, buf[:2]); err != ErrShortBuffer {
+		t.Errorf("expected %s reading into a short buffer, got %v", ErrShortBuffer, err)
+	}
+
+	if _, err := h.GetFeatureReport(4, buf); err != ErrNoReport {
+		t.Errorf("expected %s, got %v", ErrNoReport, err)
+	}
+
+	if err := h.SendFeatureReport([]byte{4, 0x01}); err != nil {
+		t.Fatalf("failed to send feature report: %s", err)
+	}
+
+	if report := dev.Feature(4); len(report) != 2 || report[1] != 0x01 {
+		t.Errorf("expected the sent feature report to be kept, got % x", report)
+	}
+}
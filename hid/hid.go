@@ -1,6 +1,20 @@
 // Package hid provides access to Human Interface Devices.
 package hid
 
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrNoFeatureReports is returned by devices that don't support feature reports
+	ErrNoFeatureReports = errors.New("device doesn't support feature reports")
+
+	// ErrShortBuffer is returned when a buffer is too short for a report
+	ErrShortBuffer = errors.New("buffer too short for report")
+)
+
 // DeviceInfo provides general information about a device.
 type DeviceInfo struct {
 	// Path contains a platform-specific device path which is used to identify the device.
@@ -18,6 +32,33 @@ type DeviceInfo struct {
 
 	InputReportLength  uint16 `json:"input_report_length"`
 	OutputReportLength uint16 `json:"output_report_length"`
+
+	// BusNumber, PortPath and InterfaceNumber give where a USB device is
+	// plugged in, PortPath being the bus number followed by the port on each
+	// hub like 1-1.3.  They are left empty for other devices.
+	BusNumber       int    `json:"bus_number,omitempty"`
+	PortPath        string `json:"port_path,omitempty"`
+	InterfaceNumber int    `json:"interface_number"`
+
+	// SysfsPath is the directory of the device in sysfs, on Linux
+	SysfsPath string `json:"sysfs_path,omitempty"`
+
+	// Descriptor is the parsed report descriptor, if it could be read
+	Descriptor *Descriptor `json:"descriptor,omitempty"`
+}
+
+// Identity returns an identity for the device that stays the same when it is
+// plugged back in, unlike its path.  This is its serial number if it has one,
+// or else the USB port and interface it is plugged into, and only its path as
+// a last resort.
+func (d *DeviceInfo) Identity() string {
+	switch {
+	case d.SerialNumber != "":
+		return d.SerialNumber
+	case d.PortPath != "":
+		return "usb-" + d.PortPath + ":" + strconv.Itoa(d.InterfaceNumber)
+	}
+	return d.Path
 }
 
 // A Device provides access to a HID device.
@@ -37,4 +78,25 @@ type Device interface {
 	// ReadError returns the read error, if any after the channel returned from
 	// ReadCh has been closed.
 	ReadError() error
+
+	// Read returns the next input report, waiting until one arrives, the
+	// device fails or the context is done.  Once Read has been called input
+	// reports are no longer dropped when nobody is reading them, instead the
+	// device is held up until they are read.
+	Read(ctx context.Context) ([]byte, error)
+
+	// Overflows returns the number of input reports dropped because they
+	// weren't read in time.
+	Overflows() uint64
+
+	// GetFeatureReport reads the feature report with the given number into
+	// buf, which must be big enough to hold it.  The report number is put in
+	// the first byte of buf, and the number of bytes read including it is
+	// returned.
+	GetFeatureReport(id byte, buf []byte) (int, error)
+
+	// SendFeatureReport sends a feature report to the device. The first byte
+	// must be the report number, zero if the device does not use numbered
+	// reports.
+	SendFeatureReport(data []byte) error
 }
@@ -15,10 +15,12 @@ void reportCallback(void *context, IOReturn result, void *sender, IOHIDReportTyp
 import "C"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
 	"runtime"
+	"strconv"
 	"sync"
 	"unsafe"
 )
@@ -145,8 +147,8 @@ type osxDevice struct {
 	closeDM      cleanupDeviceManagerFn
 
 	readSetup    sync.Once
-	readCh       chan []byte
-	readErr      error
+	reading      bool
+	reports      *Reports
 	readBuf      []byte
 	runLoop      C.CFRunLoopRef
 }
@@ -192,6 +194,18 @@ func getIntProp(device C.IOHIDDeviceRef, key C.CFStringRef) int32 {
 	return value
 }
 
+func getDataProp(device C.IOHIDDeviceRef, key C.CFStringRef) []byte {
+	ref := C.IOHIDDeviceGetProperty(device, key)
+	if ref == nil {
+		return nil
+	}
+	if C.CFGetTypeID(ref) != C.CFDataGetTypeID() {
+		return nil
+	}
+	data := C.CFDataRef(ref)
+	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(data)), C.int(C.CFDataGetLength(data)))
+}
+
 func getStringProp(device C.IOHIDDeviceRef, key C.CFStringRef) string {
 	s := C.IOHIDDeviceGetProperty(device, key)
 	return gostring(C.CFStringRef(s))
@@ -231,7 +245,7 @@ func iterateDevices(action func(device C.IOHIDDeviceRef) bool) cleanupDeviceMana
 func Devices() ([]*DeviceInfo, error) {
 	var result []*DeviceInfo
 	iterateDevices(func(device C.IOHIDDeviceRef) bool {
-		result = append(result, &DeviceInfo{
+		info := &DeviceInfo{
 			VendorID:           uint16(getIntProp(device, cfstring(C.kIOHIDVendorIDKey))),
 			ProductID:          uint16(getIntProp(device, cfstring(C.kIOHIDProductIDKey))),
 			VersionNumber:      uint16(getIntProp(device, cfstring(C.kIOHIDVersionNumberKey))),
@@ -243,13 +257,45 @@ func Devices() ([]*DeviceInfo, error) {
 			InputReportLength:  uint16(getIntProp(device, cfstring(C.kIOHIDMaxInputReportSizeKey))),
 			OutputReportLength: uint16(getIntProp(device, cfstring(C.kIOHIDMaxOutputReportSizeKey))),
 			Path:               getPath(device),
-		})
+		}
+		if desc, err := ParseDescriptor(getDataProp(device, cfstring(C.kIOHIDReportDescriptorKey))); err == nil {
+			info.Descriptor = desc
+		}
+		if getStringProp(device, cfstring(C.kIOHIDTransportKey)) == "USB" {
+			info.setLocation(uint32(getIntProp(device, cfstring(C.kIOHIDLocationIDKey))))
+		}
+		result = append(result, info)
 		return true
 	})()
 	return result, nil
 }
 
 
+// setLocation fills in where a USB device is plugged in from its location
+// ID, which has the bus number in the top byte followed by a nibble for the
+// port on each hub
+func (d *DeviceInfo) setLocation(location uint32) {
+	if location == 0 {
+		return
+	}
+
+	d.BusNumber = int(location >> 24)
+	d.PortPath = strconv.Itoa(d.BusNumber)
+	for i := 5; i >= 0; i-- {
+		port := (location >> (4 * uint(i))) & 0xf
+		if port == 0 {
+			break
+		}
+
+		if i == 5 {
+			d.PortPath += "-"
+		} else {
+			d.PortPath += "."
+		}
+		d.PortPath += strconv.Itoa(int(port))
+	}
+}
+
 // ByPath returns device info via it's file path
 func ByPath(path string) (*DeviceInfo, error) {
 	devices, err := Devices()
@@ -273,7 +319,7 @@ func (di *DeviceInfo) Open() (Device, error) {
 			res := C.IOHIDDeviceOpen(device, C.kIOHIDOptionsTypeSeizeDevice)
 			if res == C.kIOReturnSuccess {
 				C.CFRetain(C.CFTypeRef(device))
-				dev = &osxDevice{osDevice: device}
+				dev = &osxDevice{osDevice: device, reports: NewReports(readBuffer)}
 				err = nil
 				deviceCtxMtx.Lock()
 				deviceCtx[device] = dev
@@ -299,12 +345,12 @@ func deviceUnplugged(osdev C.IOHIDDeviceRef, result C.IOReturn, dev unsafe.Point
 	deviceCtxMtx.Lock()
 	od := deviceCtx[C.IOHIDDeviceRef(dev)]
 	deviceCtxMtx.Unlock()
-	od.readErr = errors.New("hid: device unplugged")
+	od.reports.Fail(errors.New("hid: device unplugged"))
 	od.close(true)
 }
 
 func (dev *osxDevice) Close() {
-	dev.readErr = errors.New("hid: device closed")
+	dev.reports.Fail(errors.New("hid: device closed"))
 	dev.close(false)
 }
 
@@ -316,7 +362,7 @@ func (dev *osxDevice) close(disconnected bool) {
 		return
 	}
 
-	if dev.readCh != nil {
+	if dev.reading {
 		if !disconnected {
 			C.IOHIDDeviceRegisterInputReportCallback(dev.osDevice, (*C.uint8_t)(&dev.readBuf[0]), C.CFIndex(len(dev.readBuf)), nil, unsafe.Pointer(dev.osDevice))
 			C.IOHIDDeviceUnscheduleFromRunLoop(dev.osDevice, dev.runLoop, C.kCFRunLoopDefaultMode)
@@ -361,14 +407,60 @@ func (dev *osxDevice) Write(data []byte) error {
 	return dev.setReport(C.kIOHIDReportTypeOutput, data)
 }
 
+func (dev *osxDevice) SendFeatureReport(data []byte) error {
+	if len(data) == 0 {
+		return ErrShortBuffer
+	}
+	return dev.setReport(C.kIOHIDReportTypeFeature, data)
+}
+
+func (dev *osxDevice) GetFeatureReport(id byte, buf []byte) (int, error) {
+	dev.mtx.Lock()
+	defer dev.mtx.Unlock()
+
+	if dev.disconnected {
+		return 0, errors.New("hid: device disconnected")
+	}
+
+	// unnumbered reports are read without the report number in front
+	data := buf
+	if id == 0 && len(data) > 0 {
+		data = data[1:]
+	}
+	if len(data) == 0 {
+		return 0, ErrShortBuffer
+	}
+	buf[0] = id
+
+	length := C.CFIndex(len(data))
+	res := C.IOHIDDeviceGetReport(dev.osDevice, C.kIOHIDReportTypeFeature, C.CFIndex(id), (*C.uint8_t)(&data[0]), &length)
+	if res != C.kIOReturnSuccess {
+		return 0, ioReturnToErr(res)
+	}
+
+	if id == 0 {
+		return int(length) + 1, nil
+	}
+	return int(length), nil
+}
+
 func (dev *osxDevice) ReadCh() <-chan []byte {
 	dev.readSetup.Do(dev.startReadThread)
-	return dev.readCh
+	return dev.reports.Ch()
+}
+
+func (dev *osxDevice) Read(ctx context.Context) ([]byte, error) {
+	dev.readSetup.Do(dev.startReadThread)
+	return dev.reports.Read(ctx)
+}
+
+func (dev *osxDevice) Overflows() uint64 {
+	return dev.reports.Overflows()
 }
 
 func (dev *osxDevice) startReadThread() {
 	dev.mtx.Lock()
-	dev.readCh = make(chan []byte, 30)
+	dev.reading = true
 	dev.mtx.Unlock()
 
 	go func() {
@@ -379,12 +471,12 @@ func (dev *osxDevice) startReadThread() {
 		C.IOHIDDeviceRegisterInputReportCallback(dev.osDevice, (*C.uint8_t)(&dev.readBuf[0]), C.CFIndex(len(dev.readBuf)), (C.IOHIDReportCallback)(unsafe.Pointer(C.reportCallback)), unsafe.Pointer(dev.osDevice))
 		dev.mtx.Unlock()
 		C.CFRunLoopRun()
-		close(dev.readCh)
+		dev.reports.Close()
 	}()
 }
 
 func (dev *osxDevice) ReadError() error {
-	return dev.readErr
+	return dev.reports.Err()
 }
 
 //export reportCallback
@@ -397,10 +489,7 @@ func reportCallback(context unsafe.Pointer, result C.IOReturn, sender unsafe.Poi
 	}
 	data := C.GoBytes(unsafe.Pointer(report), C.int(reportLength))
 
-	// readCh is buffered, drop the data if we can't send to avoid blocking the
-	// run loop
-	select {
-	case dev.readCh <- data:
-	default:
-	}
+	// until Read is called the data is dropped if the queue is full to avoid
+	// blocking the run loop
+	dev.reports.Put(data)
 }
@@ -1,26 +1,48 @@
 package hid
 
-// #include <linux/hidraw.h>
-import "C"
-
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"unsafe"
 
 	"github.com/AutogrowSystems/go-intelli/util/tell"
 )
 
+// hidMaxDescriptorSize is HID_MAX_DESCRIPTOR_SIZE from linux/hid.h
+const hidMaxDescriptorSize = 4096
+
+// hidMaxReportSize is HID_MAX_BUFFER_SIZE from linux/hid.h
+const hidMaxReportSize = 4096
+
+// busUSB is BUS_USB from linux/input.h
+const busUSB = 0x03
+
+// hidrawReportDescriptor is struct hidraw_report_descriptor from linux/hidraw.h
+type hidrawReportDescriptor struct {
+	Size  uint32
+	Value [hidMaxDescriptorSize]byte
+}
+
+// hidrawDevinfo is struct hidraw_devinfo from linux/hidraw.h
+type hidrawDevinfo struct {
+	Bustype uint32
+	Vendor  int16
+	Product int16
+}
+
 var (
-	ioctlHIDIOCGRDESCSIZE = ioR('H', 0x01, C.sizeof_int)
-	ioctlHIDIOCGRDESC     = ioR('H', 0x02, C.sizeof_struct_hidraw_report_descriptor)
-	ioctlHIDIOCGRAWINFO   = ioR('H', 0x03, C.sizeof_struct_hidraw_devinfo)
-	hidUniq              = "HID_UNIQ"
+	ioctlHIDIOCGRDESCSIZE = ioR('H', 0x01, unsafe.Sizeof(int32(0)))
+	ioctlHIDIOCGRDESC     = ioR('H', 0x02, unsafe.Sizeof(hidrawReportDescriptor{}))
+	ioctlHIDIOCGRAWINFO   = ioR('H', 0x03, unsafe.Sizeof(hidrawDevinfo{}))
+	hidUniq               = "HID_UNIQ"
 )
 
 func ioctlHIDIOCGRAWNAME(size int) uintptr {
@@ -45,8 +67,7 @@ type linuxDevice struct {
 
 	writeLock *sync.Mutex
 	readSetup sync.Once
-	readErr   error
-	readCh    chan []byte
+	reports   *Reports
 }
 
 // Devices enumerates the attached USB HID devices as DeviceInfo objects
@@ -101,25 +122,33 @@ func getDeviceInfo(path string) (*DeviceInfo, error) {
 	defer dev.Close()
 	fd := uintptr(dev.Fd())
 
-	var descSize C.int
+	var descSize int32
 	if err := ioctl(fd, ioctlHIDIOCGRDESCSIZE, uintptr(unsafe.Pointer(&descSize))); err != nil {
 		return nil, err
 	}
+	if descSize < 0 || descSize > hidMaxDescriptorSize {
+		descSize = hidMaxDescriptorSize
+	}
 
-	rawDescriptor := C.struct_hidraw_report_descriptor{
-		size: C.__u32(descSize),
+	rawDescriptor := hidrawReportDescriptor{
+		Size: uint32(descSize),
 	}
 	if err := ioctl(fd, ioctlHIDIOCGRDESC, uintptr(unsafe.Pointer(&rawDescriptor))); err != nil {
 		return nil, err
 	}
-	d.parseReport(C.GoBytes(unsafe.Pointer(&rawDescriptor.value), descSize))
+	if desc, err := ParseDescriptor(append([]byte{}, rawDescriptor.Value[:descSize]...)); err == nil {
+		d.setDescriptor(desc)
+	} else {
+		tell.Warnf("failed to parse report descriptor of %s: %s", path, err)
+	}
 
-	var rawInfo C.struct_hidraw_devinfo
+	var rawInfo hidrawDevinfo
 	if err := ioctl(fd, ioctlHIDIOCGRAWINFO, uintptr(unsafe.Pointer(&rawInfo))); err != nil {
 		return nil, err
 	}
-	d.VendorID = uint16(rawInfo.vendor)
-	d.ProductID = uint16(rawInfo.product)
+	d.VendorID = uint16(rawInfo.Vendor)
+	d.ProductID = uint16(rawInfo.Product)
+	usb := rawInfo.Bustype == busUSB
 
 	rawName := make([]byte, 256)
 	if err := ioctl(fd, ioctlHIDIOCGRAWNAME(len(rawName)), uintptr(unsafe.Pointer(&rawName[0]))); err != nil {
@@ -128,6 +157,11 @@ func getDeviceInfo(path string) (*DeviceInfo, error) {
 	d.Product = string(rawName[:bytes.IndexByte(rawName, 0)])
 
 	if p, err := filepath.EvalSymlinks(filepath.Join("/sys/class/hidraw", filepath.Base(path), "device")); err == nil {
+		d.SysfsPath = p
+		if usb && !d.setUSBTopology(p) {
+			tell.Warnf("failed to find the USB port of %s from %s", path, p)
+		}
+
 		if rawManufacturer, err := ioutil.ReadFile(filepath.Join(p, "/../../manufacturer")); err == nil {
 			d.Manufacturer = string(bytes.TrimRight(rawManufacturer, "\n"))
 		}
@@ -156,51 +190,38 @@ func getDeviceInfo(path string) (*DeviceInfo, error) {
 	return d, nil
 }
 
-// very basic report parser that will pull out the usage page, usage, and the
-// sizes of the first input and output reports
-func (d *DeviceInfo) parseReport(b []byte) {
-	var reportSize uint16
-
-	for len(b) > 0 {
-		// read item size, type, and tag
-		size := int(b[0] & 0x03)
-		if size == 3 {
-			size = 4
-		}
-		typ := (b[0] >> 2) & 0x03
-		tag := (b[0] >> 4) & 0x0f
-		b = b[1:]
+// setUSBTopology fills in where a USB device is plugged in from the sysfs
+// path of its HID device, which is in the directory of the USB interface it
+// belongs to, named after the port path, configuration and interface number:
+//
+//	/sys/devices/pci0000:00/0000:00:14.0/usb1/1-1/1-1.3/1-1.3:1.0/0003:10C4:8212.0005
+func (d *DeviceInfo) setUSBTopology(sysfsPath string) bool {
+	intf := filepath.Base(filepath.Dir(sysfsPath))
+
+	colon := strings.Index(intf, ":")
+	dot := strings.LastIndex(intf, ".")
+	if colon < 0 || dot < colon {
+		return false
+	}
 
-		if len(b) < size {
-			return
-		}
+	port := intf[:colon]
+	dash := strings.Index(port, "-")
+	if dash < 0 {
+		return false
+	}
 
-		// read item value
-		var v uint64
-		for i := 0; i < size; i++ {
-			v += uint64(b[i]) << (8 * uint(i))
-		}
-		b = b[size:]
-
-		switch {
-		case typ == 0 && tag == 8 && d.InputReportLength == 0 && reportSize > 0: // input report type
-			d.InputReportLength = reportSize
-			reportSize = 0
-		case typ == 0 && tag == 9 && d.OutputReportLength == 0 && reportSize > 0: // output report type
-			d.OutputReportLength = reportSize
-			reportSize = 0
-		case typ == 1 && tag == 0: // usage page
-			d.UsagePage = uint16(v)
-		case typ == 1 && tag == 9: // report count
-			reportSize = uint16(v)
-		case typ == 2 && tag == 0 && d.Usage == 0: // usage
-			d.Usage = uint16(v)
-		}
+	bus, err := strconv.Atoi(port[:dash])
+	if err != nil {
+		return false
+	}
 
-		if d.UsagePage > 0 && d.Usage > 0 && d.InputReportLength > 0 && d.OutputReportLength > 0 {
-			return
-		}
+	n, err := strconv.Atoi(intf[dot+1:])
+	if err != nil {
+		return false
 	}
+
+	d.BusNumber, d.PortPath, d.InterfaceNumber = bus, port, n
+	return true
 }
 
 // ByPath returns device info via it's file path
@@ -215,10 +236,11 @@ func (d *DeviceInfo) Open() (Device, error) {
 		return nil, err
 	}
 
-	return &linuxDevice{f: f, info: d, writeLock: new(sync.Mutex)}, nil
+	return &linuxDevice{f: f, info: d, writeLock: new(sync.Mutex), reports: NewReports(readBuffer)}, nil
 }
 
 func (d *linuxDevice) Close() {
+	d.reports.Close()
 	d.f.Close()
 }
 
@@ -229,30 +251,72 @@ func (d *linuxDevice) Write(data []byte) error {
 	return err
 }
 
+func (d *linuxDevice) GetFeatureReport(id byte, buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, ErrShortBuffer
+	}
+
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	buf[0] = id
+	return ioctlLen(d.f.Fd(), ioctlHIDIOCGFEATURE(len(buf)), uintptr(unsafe.Pointer(&buf[0])))
+}
+
+func (d *linuxDevice) SendFeatureReport(data []byte) error {
+	if len(data) == 0 {
+		return ErrShortBuffer
+	}
+
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	_, err := ioctlLen(d.f.Fd(), ioctlHIDIOCSFEATURE(len(data)), uintptr(unsafe.Pointer(&data[0])))
+	return err
+}
+
+// ioctlLen is an ioctl call that returns the length of the data it read or wrote
+func ioctlLen(fd, op, arg uintptr) (int, error) {
+	n, _, ep := syscall.Syscall(syscall.SYS_IOCTL, fd, op, arg)
+	if ep != 0 {
+		return 0, syscall.Errno(ep)
+	}
+	return int(n), nil
+}
+
 func (d *linuxDevice) ReadCh() <-chan []byte {
-	d.readSetup.Do(func() {
-		d.readCh = make(chan []byte, 30)
-		go d.readThread()
-	})
-	return d.readCh
+	d.readSetup.Do(func() { go d.readThread() })
+	return d.reports.Ch()
+}
+
+func (d *linuxDevice) Read(ctx context.Context) ([]byte, error) {
+	d.readSetup.Do(func() { go d.readThread() })
+	return d.reports.Read(ctx)
 }
 
 func (d *linuxDevice) ReadError() error {
-	return d.readErr
+	return d.reports.Err()
+}
+
+func (d *linuxDevice) Overflows() uint64 {
+	return d.reports.Overflows()
 }
 
 func (d *linuxDevice) readThread() {
-	defer close(d.readCh)
+	// fall back to the largest report hidraw can return when the length
+	// couldn't be read from the report descriptor
+	size := int(d.info.InputReportLength)
+	if size == 0 {
+		size = hidMaxReportSize
+	}
+
 	for {
-		buf := make([]byte, d.info.InputReportLength)
+		buf := make([]byte, size)
 		n, err := d.f.Read(buf)
 		if err != nil {
-			d.readErr = err
+			d.reports.Fail(err)
 			return
 		}
-		select {
-		case d.readCh <- buf[:n]:
-		default:
-		}
+		d.reports.Put(buf[:n])
 	}
 }
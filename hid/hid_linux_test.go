@@ -0,0 +1,51 @@
+package hid
+
+import (
+	"testing"
+)
+
+func TestIoctlNumbers(t *testing.T) {
+	// the values of the macros in linux/hidraw.h
+	tests := []struct {
+		name     string
+		got      uintptr
+		expected uintptr
+	}{
+		{"HIDIOCGRDESCSIZE", ioctlHIDIOCGRDESCSIZE, 0x80044801},
+		{"HIDIOCGRDESC", ioctlHIDIOCGRDESC, 0x90044802},
+		{"HIDIOCGRAWINFO", ioctlHIDIOCGRAWINFO, 0x80084803},
+		{"HIDIOCGRAWNAME(256)", ioctlHIDIOCGRAWNAME(256), 0x81004804},
+		{"HIDIOCSFEATURE(64)", ioctlHIDIOCSFEATURE(64), 0xc0404806},
+		{"HIDIOCGFEATURE(64)", ioctlHIDIOCGFEATURE(64), 0xc0404807},
+	}
+
+	for _, test := range tests {
+		if test.got != test.expected {
+			t.Errorf("expected %s to be %#x, got %#x", test.name, test.expected, test.got)
+		}
+	}
+}
+
+func TestSetUSBTopology(t *testing.T) {
+	var d DeviceInfo
+	if !d.setUSBTopology("/sys/devices/pci0000:00/0000:00:14.0/usb1/1-1/1-1.3/1-1.3:1.2/0003:10C4:8212.0005") {
+		t.Fatalf("expected the topology to be found")
+	}
+
+	if d.BusNumber != 1 || d.PortPath != "1-1.3" || d.InterfaceNumber != 2 {
+		t.Errorf("unexpected topology %d %s %d", d.BusNumber, d.PortPath, d.InterfaceNumber)
+	}
+
+	if d.Identity() != "usb-1-1.3:2" {
+		t.Errorf("expected the identity to come from the port, got %s", d.Identity())
+	}
+
+	d.SerialNumber = "ASLID06030112"
+	if d.Identity() != d.SerialNumber {
+		t.Errorf("expected the identity to be the serial number, got %s", d.Identity())
+	}
+
+	if d.setUSBTopology("/sys/devices/virtual/misc/uhid/0003:10C4:8212.0006") {
+		t.Errorf("expected no topology for a virtual device")
+	}
+}
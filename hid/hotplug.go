@@ -0,0 +1,71 @@
+package hid
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// Action is what happened to a device that was hotplugged
+type Action string
+
+// the actions a hotplug event can report
+const (
+	Add    Action = "add"
+	Remove Action = "remove"
+
+	// Lost means that some events were missed, so the devices have to be
+	// enumerated again to find out what changed
+	Lost Action = "lost"
+)
+
+// ErrHotplugUnsupported is returned when watching for hotplug events on a
+// backend or platform that can't report them
+var ErrHotplugUnsupported = errors.New("hotplug events are not supported")
+
+// Event is a device being plugged in or unplugged
+type Event struct {
+	Action Action
+	Path   string
+
+	// Info is the info of a device that was plugged in, or nil when it was
+	// unplugged
+	Info *DeviceInfo
+}
+
+// Hotplugger is implemented by backends that can report devices being
+// plugged in and unplugged as it happens
+type Hotplugger interface {
+	// Hotplug returns a channel of hotplug events.  The channel is closed
+	// when the stop channel is closed, or if the events can no longer be
+	// watched.
+	Hotplug(stop <-chan struct{}) (<-chan Event, error)
+}
+
+// parseUevent parses a kernel uevent for a hidraw device, which is a header
+// like "add@/devices/.../hidraw/hidraw0" followed by NUL separated KEY=value
+// pairs.  It returns false for events about anything else.
+func parseUevent(msg []byte) (Event, bool) {
+	parts := bytes.Split(msg, []byte{0})
+	if len(parts) < 2 || !bytes.Contains(parts[0], []byte("@/")) {
+		return Event{}, false
+	}
+
+	env := map[string]string{}
+	for _, part := range parts[1:] {
+		if kv := strings.SplitN(string(part), "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+
+	if env["SUBSYSTEM"] != "hidraw" || env["DEVNAME"] == "" {
+		return Event{}, false
+	}
+
+	ev := Event{Action: Action(env["ACTION"]), Path: "/dev/" + strings.TrimPrefix(env["DEVNAME"], "/dev/")}
+	if ev.Action != Add && ev.Action != Remove {
+		return Event{}, false
+	}
+
+	return ev, true
+}
@@ -0,0 +1,6 @@
+package hid
+
+// Hotplug isn't supported on Mac yet, so devices are only found by polling
+func (systemBackend) Hotplug(stop <-chan struct{}) (<-chan Event, error) {
+	return nil, ErrHotplugUnsupported
+}
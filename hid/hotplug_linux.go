@@ -0,0 +1,119 @@
+package hid
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/util/tell"
+)
+
+const (
+	// the netlink group the kernel sends uevents to
+	ueventKernelGroup = 1
+
+	ueventBufferSize = 8192
+
+	// how often the watcher checks whether it has been stopped while
+	// waiting for uevents
+	ueventTimeout = time.Second
+
+	// a new hidraw node can take a moment before udev lets it be opened
+	openRetries = 5
+	openDelay   = 200 * time.Millisecond
+)
+
+// Hotplug watches the kernel uevents on a netlink socket for hidraw devices
+// being plugged in and unplugged
+func (systemBackend) Hotplug(stop <-chan struct{}) (<-chan Event, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: ueventKernelGroup}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	timeout := syscall.NsecToTimeval(int64(ueventTimeout))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	events := make(chan Event)
+	go watchUevents(fd, events, stop)
+	return events, nil
+}
+
+func watchUevents(fd int, events chan<- Event, stop <-chan struct{}) {
+	defer close(events)
+	defer syscall.Close(fd)
+
+	buf := make([]byte, ueventBufferSize)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			continue
+		case err == syscall.ENOBUFS:
+			// the socket buffer overflowed, so carry on reading after
+			// asking for everything to be enumerated again
+			tell.Warnf("missed uevents, the socket buffer overflowed")
+			select {
+			case events <- Event{Action: Lost}:
+			case <-stop:
+				return
+			}
+			continue
+		case err != nil:
+			tell.Errorf("failed to read uevent: %s", err)
+			return
+		}
+
+		ev, ok := parseUevent(buf[:n])
+		if !ok {
+			continue
+		}
+
+		tell.Debugf("hotplug %s %s", ev.Action, ev.Path)
+
+		if ev.Action == Add {
+			ev.Info, err = openInfo(ev.Path)
+			if err != nil {
+				tell.Errorf("failed to read info of hotplugged device %s: %s", ev.Path, err)
+				continue
+			}
+		}
+
+		select {
+		case events <- ev:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// openInfo reads the info of a newly added device, giving udev time to set
+// up its permissions
+func openInfo(path string) (*DeviceInfo, error) {
+	var err error
+	for i := 0; i < openRetries; i++ {
+		var info *DeviceInfo
+		if info, err = getDeviceInfo(path); err == nil {
+			return info, nil
+		}
+
+		time.Sleep(openDelay)
+	}
+
+	return nil, err
+}
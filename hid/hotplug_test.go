@@ -0,0 +1,59 @@
+package hid
+
+import (
+	"strings"
+	"testing"
+)
+
+func uevent(fields ...string) []byte {
+	return []byte(strings.Join(fields, "\x00") + "\x00")
+}
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		ok   bool
+		ev   Event
+	}{
+		{
+			"add",
+			uevent("add@/devices/pci0000:00/usb1/1-1/1-1:1.0/0003:04D8:F8D1.0001/hidraw/hidraw0",
+				"ACTION=add", "DEVPATH=/devices/pci0000:00/usb1/1-1/1-1:1.0/0003:04D8:F8D1.0001/hidraw/hidraw0",
+				"SUBSYSTEM=hidraw", "MAJOR=247", "MINOR=0", "DEVNAME=hidraw0", "SEQNUM=2291"),
+			true,
+			Event{Action: Add, Path: "/dev/hidraw0"},
+		},
+		{
+			"remove",
+			uevent("remove@/devices/usb1/1-1/hidraw/hidraw3", "ACTION=remove", "SUBSYSTEM=hidraw", "DEVNAME=hidraw3"),
+			true,
+			Event{Action: Remove, Path: "/dev/hidraw3"},
+		},
+		{
+			"other subsystem",
+			uevent("add@/devices/usb1/1-1", "ACTION=add", "SUBSYSTEM=usb", "DEVNAME=bus/usb/001/005"),
+			false,
+			Event{},
+		},
+		{
+			"change",
+			uevent("change@/devices/usb1/1-1/hidraw/hidraw0", "ACTION=change", "SUBSYSTEM=hidraw", "DEVNAME=hidraw0"),
+			false,
+			Event{},
+		},
+		{
+			"udev",
+			[]byte("libudev\x00\xfe\xed\xca\xfe"),
+			false,
+			Event{},
+		},
+	}
+
+	for _, test := range tests {
+		ev, ok := parseUevent(test.msg)
+		if ok != test.ok || ev != test.ev {
+			t.Errorf("%s: expected %+v %v, got %+v %v", test.name, test.ev, test.ok, ev, ok)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package hid
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// readBuffer is the number of input reports the backends buffer
+const readBuffer = 30
+
+// ErrDeviceClosed is returned when reading from a device that has been closed
+var ErrDeviceClosed = errors.New("device is closed")
+
+// Reports is a queue of the input reports read from a device, shared by the
+// backends so they all buffer reports the same way.
+//
+// Until Read is called, reports that don't fit in the queue are dropped so a
+// device that nobody reads from can't block, and are counted as overflows.
+// Once Read has been called the queue is lossless, and Put waits for room in
+// the queue instead, holding up the device until its reports are read.
+type Reports struct {
+	mutex     *sync.Mutex
+	ch        chan []byte
+	done      chan struct{}
+	sending   *sync.WaitGroup
+	lossless  bool
+	closed    bool
+	overflows uint64
+	err       error
+}
+
+// NewReports returns a queue that buffers size reports
+func NewReports(size int) *Reports {
+	return &Reports{
+		mutex:   new(sync.Mutex),
+		ch:      make(chan []byte, size),
+		done:    make(chan struct{}),
+		sending: new(sync.WaitGroup),
+	}
+}
+
+// Put queues a report, returning false if it was dropped
+func (r *Reports) Put(report []byte) bool {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return false
+	}
+	lossless := r.lossless
+	r.sending.Add(1)
+	r.mutex.Unlock()
+
+	defer r.sending.Done()
+
+	if lossless {
+		select {
+		case r.ch <- report:
+			return true
+		case <-r.done:
+			return false
+		}
+	}
+
+	select {
+	case r.ch <- report:
+		return true
+	default:
+	}
+
+	r.mutex.Lock()
+	r.overflows++
+	r.mutex.Unlock()
+	return false
+}
+
+// Fail closes the queue because of a read error, which is returned by Read
+// and Err once the reports before it have been read
+func (r *Reports) Fail(err error) {
+	r.close(err)
+}
+
+// Close closes the queue, waking up anything waiting to put a report in it
+func (r *Reports) Close() {
+	r.close(ErrDeviceClosed)
+}
+
+func (r *Reports) close(err error) {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	r.err = err
+	close(r.done)
+	r.mutex.Unlock()
+
+	r.sending.Wait()
+	close(r.ch)
+}
+
+// Ch returns the channel the reports are sent on, which is closed along with
+// the queue
+func (r *Reports) Ch() <-chan []byte {
+	return r.ch
+}
+
+// Read makes the queue lossless and returns the next report, waiting until
+// there is one, the queue is closed or the context is done
+func (r *Reports) Read(ctx context.Context) ([]byte, error) {
+	r.mutex.Lock()
+	r.lossless = true
+	r.mutex.Unlock()
+
+	select {
+	case report, ok := <-r.ch:
+		if !ok {
+			return nil, r.Err()
+		}
+		return report, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Err returns the error the queue was closed with, if it is closed
+func (r *Reports) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
+
+// Overflows returns the number of reports dropped because the queue was full
+func (r *Reports) Overflows() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.overflows
+}
+
+// ReportQueue is embedded by the devices of backends that answer the output
+// reports written to them themselves, like simulated or replayed devices.  It
+// reads the input reports from a Reports queue that is made again each time
+// the device is opened, the same way the other backends buffer them.
+type ReportQueue struct {
+	mutex   *sync.Mutex
+	reports *Reports
+	closed  bool
+}
+
+// NewReportQueue returns an open queue
+func NewReportQueue() *ReportQueue {
+	q := &ReportQueue{mutex: new(sync.Mutex)}
+	q.Open()
+	return q
+}
+
+// Open makes a new queue so the device can be used again after being closed
+func (q *ReportQueue) Open() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.reports != nil && !q.closed {
+		return
+	}
+
+	q.reports = NewReports(readBuffer)
+	q.closed = false
+}
+
+// Close closes the queue
+func (q *ReportQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.closed = true
+	q.reports.Close()
+}
+
+// Queue returns the queue to put the input reports in, and false if the
+// device is closed
+func (q *ReportQueue) Queue() (*Reports, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.reports, !q.closed
+}
+
+// ReadCh returns the channel the input reports are sent on
+func (q *ReportQueue) ReadCh() <-chan []byte {
+	r, _ := q.Queue()
+	return r.Ch()
+}
+
+// Read returns the next input report
+func (q *ReportQueue) Read(ctx context.Context) ([]byte, error) {
+	r, _ := q.Queue()
+	return r.Read(ctx)
+}
+
+// ReadError returns the error that closed the read channel, if any
+func (q *ReportQueue) ReadError() error {
+	r, _ := q.Queue()
+	return r.Err()
+}
+
+// Overflows returns the number of input reports dropped as they weren't read
+func (q *ReportQueue) Overflows() uint64 {
+	r, _ := q.Queue()
+	return r.Overflows()
+}
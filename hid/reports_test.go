@@ -0,0 +1,99 @@
+package hid
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReportsOverflow(t *testing.T) {
+	r := NewReports(2)
+	for i := 0; i < 5; i++ {
+		r.Put([]byte{byte(i)})
+	}
+
+	if r.Overflows() != 3 {
+		t.Errorf("expected 3 overflows, got %d", r.Overflows())
+	}
+
+	r.Close()
+
+	var got []byte
+	for report := range r.Ch() {
+		got = append(got, report[0])
+	}
+
+	if len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("expected the first 2 reports to be kept, got %v", got)
+	}
+
+	if r.Err() != ErrDeviceClosed {
+		t.Errorf("expected %s, got %v", ErrDeviceClosed, r.Err())
+	}
+}
+
+func TestReportsLossless(t *testing.T) {
+	r := NewReports(2)
+	ctx := context.Background()
+
+	// the first read makes the queue lossless
+	r.Put([]byte{0})
+	if _, err := r.Read(ctx); err != nil {
+		t.Fatalf("failed to read report: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 10; i++ {
+			r.Put([]byte{byte(i)})
+		}
+		r.Fail(errors.New("unplugged"))
+	}()
+
+	for i := 1; i <= 10; i++ {
+		report, err := r.Read(ctx)
+		if err != nil || report[0] != byte(i) {
+			t.Fatalf("expected report %d, got %v %v", i, report, err)
+		}
+	}
+
+	if _, err := r.Read(ctx); err == nil || err.Error() != "unplugged" {
+		t.Errorf("expected the read error, got %v", err)
+	}
+
+	<-done
+
+	if r.Overflows() != 0 {
+		t.Errorf("expected no overflows, got %d", r.Overflows())
+	}
+}
+
+func TestReportsCloseWakesPut(t *testing.T) {
+	r := NewReports(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := r.Read(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	r.Put([]byte{0})
+
+	put := make(chan bool)
+	go func() { put <- r.Put([]byte{1}) }()
+
+	select {
+	case <-put:
+		t.Fatalf("expected put to wait for room in a lossless queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	r.Close()
+
+	if <-put {
+		t.Errorf("expected the waiting report to be dropped when closed")
+	}
+}
@@ -0,0 +1,115 @@
+package simulator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+)
+
+// serial number prefixes of the simulated devices, in the style of the real ones
+var serialPrefixes = map[string]string{
+	IntelliDose:    "SIMID",
+	IntelliClimate: "SIMIC",
+}
+
+// Backend is a hid.Backend of simulated devices
+type Backend struct {
+	mutex   *sync.Mutex
+	devices []*Device
+}
+
+// NewBackend returns a backend simulating the devices in the spec, which
+// gives the number of each kind of device like "dose=2,climate=1"
+func NewBackend(spec string) (*Backend, error) {
+	b := &Backend{mutex: new(sync.Mutex)}
+
+	counts, err := ParseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range []string{IntelliDose, IntelliClimate} {
+		for i := 1; i <= counts[kind]; i++ {
+			d, err := New(kind, fmt.Sprintf("%s%05d", serialPrefixes[kind], i))
+			if err != nil {
+				return nil, err
+			}
+
+			b.devices = append(b.devices, d)
+		}
+	}
+
+	return b, nil
+}
+
+// ParseSpec parses a spec like "dose=2,climate=1" into the number of each
+// kind of device to simulate.  A kind without a number is simulated once.
+func ParseSpec(spec string) (map[string]int, error) {
+	counts := map[string]int{}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kind, count := part, 1
+		if i := strings.Index(part, "="); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid number of devices in %q", part)
+			}
+			kind, count = part[:i], n
+		}
+
+		if _, ok := serialPrefixes[kind]; !ok {
+			return nil, fmt.Errorf("%s: %q", ErrUnknownKind, kind)
+		}
+
+		counts[kind] += count
+	}
+
+	return counts, nil
+}
+
+// Simulated returns the simulated devices
+func (b *Backend) Simulated() []*Device {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	devices := make([]*Device, len(b.devices))
+	copy(devices, b.devices)
+	return devices
+}
+
+// Devices returns the info of the simulated devices
+func (b *Backend) Devices() ([]*hid.DeviceInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	infos := make([]*hid.DeviceInfo, len(b.devices))
+	for i, d := range b.devices {
+		info := d.Info()
+		infos[i] = &info
+	}
+
+	return infos, nil
+}
+
+// Open opens the simulated device with the same path as the info
+func (b *Backend) Open(info *hid.DeviceInfo) (hid.Device, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, d := range b.devices {
+		if d.info.Path == info.Path {
+			d.Open()
+			return d, nil
+		}
+	}
+
+	return nil, hid.ErrDeviceNotFound
+}
@@ -0,0 +1,173 @@
+package simulator
+
+import (
+	"math"
+	"time"
+)
+
+// model is the process a simulated device controls.  It reads the settings
+// from the state packets and writes its readings and outputs back to them.
+type model interface {
+	// setup writes the factory settings to the state packets, naming the
+	// device after its serial number
+	setup(p [][]byte, serial string)
+
+	// step advances the process by the elapsed time
+	step(p [][]byte, elapsed time.Duration)
+}
+
+// doseModel is a nutrient tank: EC falls as the plants feed and pH creeps
+// up, until the dosers bring them back to their set points
+type doseModel struct {
+	ec      float64
+	ph      float64
+	nutTemp float64
+}
+
+// rates per second
+const (
+	ecUptake = 0.02
+	ecDosing = 0.5
+	phDrift  = 0.0005
+	phDosing = 0.01
+	phDetent = 0.1
+)
+
+func newDoseModel() *doseModel {
+	return &doseModel{ec: 80, ph: 6.4, nutTemp: 20.5}
+}
+
+func (m *doseModel) setup(p [][]byte, serial string) {
+	setU16(p[0], 7, 123) // firmware 1.23
+
+	// irrigation installed with one station, one nutrient part
+	setBit(p[1], 4, 4, true)
+	p[1][40] = 1
+	p[1][60] = 1
+
+	// nutrient dosing and pH dosing enabled, aiming for an EC of 100 and a
+	// pH of 6.0
+	setBit(p[1], 2, 3, true)
+	setBit(p[1], 5, 7, true)
+	setU16(p[1], 15, 100)
+	setU16(p[1], 17, 100)
+	p[1][19] = 60
+
+	copy(p[2][2:12], serial)
+	m.write(p, false, false)
+}
+
+func (m *doseModel) step(p [][]byte, elapsed time.Duration) {
+	dt := elapsed.Seconds()
+
+	dosing := getBit(p[1], 3, 0) || getBit(p[1], 2, 3) && m.ec < float64(getU16(p[1], 15))
+	phSetPoint := float64(p[1][19]) / 10
+	phDown := getBit(p[1], 3, 1) || getBit(p[1], 5, 7) && m.ph > phSetPoint+phDetent
+
+	m.ec -= ecUptake * dt
+	if dosing {
+		m.ec += ecDosing * dt
+	}
+	m.ec = math.Max(m.ec, 0)
+
+	m.ph += phDrift * dt
+	if phDown {
+		m.ph -= phDosing * dt
+	}
+	m.ph = math.Min(math.Max(m.ph, 0), 14)
+
+	m.write(p, dosing, phDown)
+}
+
+func (m *doseModel) write(p [][]byte, dosing, phDown bool) {
+	setU16(p[0], 9, int(math.Round(m.ec)))
+	setU16(p[0], 11, int(math.Round(m.ph*100)))
+	setU16(p[0], 13, int(math.Round(m.nutTemp*100)))
+	setBit(p[0], 15, 0, dosing)
+	setBit(p[0], 15, 1, phDown)
+}
+
+// climateModel is a grow room: the air drifts towards the outside
+// temperature, warmed by the heater and cooled by the exhaust fan
+type climateModel struct {
+	airTemp float64
+	outside float64
+	rh      int
+	co2     int
+}
+
+// rates per second
+const (
+	airLeakage = 0.001
+	heating    = 0.02
+	cooling    = 0.03
+)
+
+func newClimateModel() *climateModel {
+	return &climateModel{airTemp: 22, outside: 18, rh: 60, co2: 400}
+}
+
+func (m *climateModel) setup(p [][]byte, serial string) {
+	setU16(p[0], 7, 210) // firmware 2.10
+
+	// fan 1 and a heater installed and enabled, keeping the air between 20
+	// and 26 degrees
+	setBit(p[1], 2, 0, true)
+	setBit(p[1], 2, 3, true)
+	setBit(p[1], 5, 0, true)
+	setBit(p[1], 6, 0, true)
+	setBit(p[1], 6, 4, true)
+	setU16(p[1], 10, 2600)
+	setU16(p[1], 59, 2000)
+
+	copy(p[1][33:43], serial)
+	m.write(p, false, false)
+}
+
+func (m *climateModel) step(p [][]byte, elapsed time.Duration) {
+	dt := elapsed.Seconds()
+
+	heat := float64(getU16(p[1], 59)) / 100
+	cool := float64(getU16(p[1], 10)) / 100
+	heater := getBit(p[1], 6, 5) || getBit(p[1], 6, 4) && m.airTemp < heat
+	fan := getBit(p[1], 6, 1) || getBit(p[1], 6, 0) && m.airTemp > cool
+
+	m.airTemp += (m.outside - m.airTemp) * airLeakage * dt
+	if heater {
+		m.airTemp += heating * dt
+	}
+	if fan {
+		m.airTemp -= cooling * dt
+	}
+
+	m.write(p, heater, fan)
+}
+
+func (m *climateModel) write(p [][]byte, heater, fan bool) {
+	setU16(p[0], 13, int(math.Round(m.airTemp*100)))
+	setU16(p[0], 36, int(math.Round(m.outside*100)))
+	p[0][17] = byte(m.rh)
+	setU16(p[0], 28, m.co2)
+	setBit(p[0], 43, 0, fan)
+	setBit(p[0], 43, 2, heater)
+}
+
+func getU16(p []byte, offset int) int {
+	return int(p[offset]) | int(p[offset+1])<<8
+}
+
+func setU16(p []byte, offset, v int) {
+	p[offset], p[offset+1] = byte(v), byte(v>>8)
+}
+
+func getBit(p []byte, offset, bit uint) bool {
+	return p[offset]&(1<<bit) != 0
+}
+
+func setBit(p []byte, offset, bit uint, on bool) {
+	if on {
+		p[offset] |= 1 << bit
+	} else {
+		p[offset] &^= 1 << bit
+	}
+}
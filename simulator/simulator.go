@@ -0,0 +1,184 @@
+// Package simulator provides simulated IntelliDose and IntelliClimate devices
+// that answer requests over the hid.Device interface the same way the real
+// units do, so the gateway can be run without the hardware.
+package simulator
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AutogrowSystems/go-intelli/hid"
+	"github.com/snksoft/crc"
+)
+
+// the kinds of device that can be simulated
+const (
+	IntelliDose    = "dose"
+	IntelliClimate = "climate"
+)
+
+const (
+	packetLength = 64
+	crcOffset    = packetLength - 2
+
+	// the byte after the settings in each packet isn't written by S requests
+	settingsEnd = 61
+)
+
+var (
+	// ErrClosed is returned when writing to a simulated device that is closed
+	ErrClosed = errors.New("simulated device is closed")
+
+	// ErrUnknownKind is returned when asked to simulate an unknown kind of device
+	ErrUnknownKind = errors.New("unknown kind of device")
+)
+
+// Device is a simulated device.  It keeps the settings written to it in its
+// state packets, and updates the readings in them from a simple model of the
+// process it controls whenever they are read.
+type Device struct {
+	info hid.DeviceInfo
+	kind string
+
+	mutex   *sync.Mutex
+	packets [][]byte
+	model   model
+	stepped time.Time
+	now     func() time.Time
+
+	*hid.ReportQueue
+}
+
+// New returns a simulated device of the given kind with the serial number
+func New(kind, serial string) (*Device, error) {
+	d := &Device{
+		kind:        kind,
+		mutex:       new(sync.Mutex),
+		now:         time.Now,
+		ReportQueue: hid.NewReportQueue(),
+		info: hid.DeviceInfo{
+			Path:         "sim/" + serial,
+			Manufacturer: "Autogrow Systems",
+			SerialNumber: serial,
+
+			InputReportLength:  packetLength,
+			OutputReportLength: packetLength,
+		},
+	}
+
+	switch kind {
+	case IntelliDose:
+		d.info.Product = "ASL IntelliDose"
+		d.model = newDoseModel()
+		d.packets = make([][]byte, 3)
+	case IntelliClimate:
+		d.info.Product = "ASL IntelliClimate"
+		d.model = newClimateModel()
+		d.packets = make([][]byte, 4)
+	default:
+		return nil, ErrUnknownKind
+	}
+
+	for i := range d.packets {
+		d.packets[i] = make([]byte, packetLength)
+		d.packets[i][0], d.packets[i][1] = 'D', byte('0'+i)
+	}
+
+	d.model.setup(d.packets, serial)
+	d.stepped = d.now()
+	return d, nil
+}
+
+// Info returns the info the device is enumerated with
+func (d *Device) Info() hid.DeviceInfo {
+	return d.info
+}
+
+// GetFeatureReport isn't supported as the real devices don't have feature
+// reports
+func (d *Device) GetFeatureReport(id byte, buf []byte) (int, error) {
+	return 0, hid.ErrNoFeatureReports
+}
+
+// SendFeatureReport isn't supported as the real devices don't have feature
+// reports
+func (d *Device) SendFeatureReport(data []byte) error {
+	return hid.ErrNoFeatureReports
+}
+
+// Write handles a request to the device.  D requests are answered with the
+// state packet they ask for, and S requests store the settings in them and
+// are echoed back.  Anything else is ignored, like the real devices do.
+func (d *Device) Write(data []byte) error {
+	reports, open := d.Queue()
+	if !open {
+		return ErrClosed
+	}
+
+	// sent without holding the lock, as it waits for room once the
+	// responses are being read with Read
+	if response := d.handle(data); response != nil {
+		reports.Put(response)
+	}
+
+	return nil
+}
+
+// handle returns the response to a request
+func (d *Device) handle(data []byte) []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// skip the report number
+	if len(data) < 1+packetLength {
+		return nil
+	}
+	request := data[1 : 1+packetLength]
+
+	switch request[0] {
+	case 'D':
+		return d.read(int(request[1] - '0'))
+	case 'S':
+		return d.write(int(request[1]-'0'), request)
+	}
+
+	return nil
+}
+
+// read returns the state packet with the given number, after bringing the
+// readings in it up to date
+func (d *Device) read(n int) []byte {
+	if n < 0 || n >= len(d.packets) {
+		return nil
+	}
+
+	now := d.now()
+	if elapsed := now.Sub(d.stepped); elapsed > 0 {
+		d.model.step(d.packets, elapsed)
+		d.stepped = now
+	}
+
+	return frame(d.packets[n])
+}
+
+// write stores the settings in the set request in the state packet after the
+// one with the same number, and returns the request as the response
+func (d *Device) write(n int, request []byte) []byte {
+	if n < 0 || n+1 >= len(d.packets) {
+		return nil
+	}
+
+	copy(d.packets[n+1][2:settingsEnd], request[2:settingsEnd])
+	return frame(request)
+}
+
+// frame returns a copy of the packet with its CRC set
+func frame(packet []byte) []byte {
+	f := make([]byte, packetLength)
+	copy(f, packet)
+
+	sum := crc.CalculateCRC(crc.CRC16, f[:crcOffset])
+	f[crcOffset], f[crcOffset+1] = byte(sum), byte(sum>>8)
+	return f
+}
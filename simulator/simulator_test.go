@@ -0,0 +1,120 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+)
+
+// request builds a request for the command with the report number in front
+func request(command string, body []byte) []byte {
+	r := make([]byte, 1+packetLength)
+	copy(r[1:], command)
+	copy(r[3:], body)
+	return r
+}
+
+func roundTrip(t *testing.T, d *Device, command string, body []byte) []byte {
+	if err := d.Write(request(command, body)); err != nil {
+		t.Fatalf("failed to write %s: %s", command, err)
+	}
+
+	select {
+	case response := <-d.ReadCh():
+		if string(response[:2]) != command {
+			t.Fatalf("expected a response to %s, got %q", command, response[:2])
+		}
+		if sum := frame(response); sum[62] != response[62] || sum[63] != response[63] {
+			t.Fatalf("expected a valid CRC on the response to %s", command)
+		}
+		return response
+	default:
+		t.Fatalf("no response to %s", command)
+	}
+
+	return nil
+}
+
+func TestParseSpec(t *testing.T) {
+	counts, err := ParseSpec("dose=2, climate=1,dose")
+	if err != nil {
+		t.Fatalf("failed to parse spec: %s", err)
+	}
+
+	if counts[IntelliDose] != 3 || counts[IntelliClimate] != 1 {
+		t.Errorf("expected 3 doses and 1 climate, got %v", counts)
+	}
+
+	for _, spec := range []string{"toaster=1", "dose=many", "dose=-1"} {
+		if _, err := ParseSpec(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestSettingsAreKept(t *testing.T) {
+	d, _ := New(IntelliDose, "SIMID00001")
+
+	d2 := roundTrip(t, d, "D2", nil)
+	if string(d2[2:12]) != "SIMID00001" {
+		t.Errorf("expected the device to be named after its serial, got %q", d2[2:12])
+	}
+
+	s1 := append([]byte{}, d2...)
+	copy(s1[2:12], "tent 2\x00\x00\x00\x00")
+	roundTrip(t, d, "S1", s1[2:])
+
+	d2 = roundTrip(t, d, "D2", nil)
+	if string(d2[2:8]) != "tent 2" {
+		t.Errorf("expected the new device name to be kept, got %q", d2[2:12])
+	}
+
+	d.Close()
+	if err := d.Write(request("D0", nil)); err != ErrClosed {
+		t.Errorf("expected %s, got %v", ErrClosed, err)
+	}
+}
+
+func TestDoseModel(t *testing.T) {
+	d, _ := New(IntelliDose, "SIMID00001")
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	d.stepped = now
+
+	now = now.Add(10 * time.Second)
+	d0 := roundTrip(t, d, "D0", nil)
+
+	// EC starts below the set point, so the nutrient doser runs
+	if !getBit(d0, 15, 0) {
+		t.Errorf("expected nutrient dosing to be active")
+	}
+	if ec := getU16(d0, 9); ec <= 80 {
+		t.Errorf("expected the EC to rise while dosing, got %d", ec)
+	}
+
+	// pH starts above the set point, so the pH doser runs
+	if !getBit(d0, 15, 1) || getU16(d0, 11) >= 640 {
+		t.Errorf("expected pH dosing to lower the pH, got %d", getU16(d0, 11))
+	}
+}
+
+func TestClimateModel(t *testing.T) {
+	d, _ := New(IntelliClimate, "SIMIC00001")
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	d.stepped = now
+
+	// raise the heating set point above the air temperature
+	d1 := roundTrip(t, d, "D1", nil)
+	setU16(d1, 59, 3000)
+	roundTrip(t, d, "S0", d1[2:])
+
+	now = now.Add(time.Minute)
+	d0 := roundTrip(t, d, "D0", nil)
+
+	if !getBit(d0, 43, 2) || getBit(d0, 43, 0) {
+		t.Errorf("expected only the heater to be on, got %08b", d0[43])
+	}
+	if temp := getU16(d0, 13); temp <= 2200 {
+		t.Errorf("expected the heater to warm the air, got %d", temp)
+	}
+}